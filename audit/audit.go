@@ -0,0 +1,223 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"petclinic/database"
+	"petclinic/middleware"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionCreate   = "create"
+	ActionUpdate   = "update"
+	ActionDelete   = "delete"
+	ActionRestore  = "restore"
+	ActionView     = "view"
+	ActionDownload = "download"
+)
+
+// chainLockID serializes writers so each entry links to the one before it
+const chainLockID = 7340034
+
+// Entry is a single audit log row
+type Entry struct {
+	ID           int64           `json:"id"`
+	OccurredAt   time.Time       `json:"occurred_at"`
+	ActorID      int             `json:"actor_id"`
+	ActorRole    string          `json:"actor_role"`
+	Action       string          `json:"action"`
+	ResourceType string          `json:"resource_type"`
+	ResourceID   int             `json:"resource_id"`
+	Changes      json.RawMessage `json:"changes"`
+	IP           string          `json:"ip"`
+	RequestID    string          `json:"request_id"`
+	PrevHash     string          `json:"prev_hash"`
+	Hash         string          `json:"hash"`
+}
+
+// Change is the before/after value of a single field
+type Change struct {
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// Actor identifies who performed an audited action
+type Actor struct {
+	ID        int
+	Role      string
+	IP        string
+	RequestID string
+}
+
+// System is the actor recorded for background jobs
+var System = Actor{Role: "system"}
+
+// ActorFromRequest returns the authenticated caller of r (ID 0 for public endpoints)
+func ActorFromRequest(r *http.Request) Actor {
+	return Actor{
+		ID:        middleware.GetUserIDFromRequest(r),
+		Role:      middleware.GetUserRoleFromRequest(r),
+		IP:        middleware.GetClientIP(r),
+		RequestID: middleware.GetRequestID(r),
+	}
+}
+
+// Record appends an audit entry for the request's caller inside tx, so the entry commits or
+// rolls back together with the change it describes. before and after are the resource's state
+// (nil for creates and deletes respectively); only changed fields are kept.
+func Record(tx *sql.Tx, r *http.Request, action, resourceType string, resourceID int, before, after interface{}) error {
+	return Write(tx, ActorFromRequest(r), action, resourceType, resourceID, before, after)
+}
+
+// RecordAccess appends an entry for a read (view or download) in its own transaction. Callers
+// must not serve the data if it fails, so every access to audited data leaves a trace.
+func RecordAccess(r *http.Request, action, resourceType string, resourceID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := Record(tx, r, action, resourceType, resourceID, nil, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Write appends an audit entry for actor inside tx. Entries are chained, so concurrent
+// writers wait for each other until their transactions end; call it just before Commit.
+func Write(tx *sql.Tx, actor Actor, action, resourceType string, resourceID int, before, after interface{}) error {
+	changes, err := Diff(before, after)
+	if err != nil {
+		return fmt.Errorf("failed to diff audit entry: %w", err)
+	}
+
+	entry := &Entry{
+		OccurredAt:   time.Now().UTC().Truncate(time.Microsecond),
+		ActorID:      actor.ID,
+		ActorRole:    actor.Role,
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		Changes:      changes,
+		IP:           actor.IP,
+		RequestID:    actor.RequestID,
+	}
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", chainLockID); err != nil {
+		return err
+	}
+
+	err = tx.QueryRow("SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1").Scan(&entry.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	entry.Hash = entry.computeHash()
+
+	_, err = tx.Exec(`
+		INSERT INTO audit_log (occurred_at, actor_id, actor_role, action, resource_type, resource_id, changes, ip, request_id, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, entry.OccurredAt, entry.ActorID, entry.ActorRole, entry.Action, entry.ResourceType, entry.ResourceID,
+		string(entry.Changes), entry.IP, entry.RequestID, entry.PrevHash, entry.Hash)
+	return err
+}
+
+// computeHash returns SHA-256 over the previous hash and every recorded field
+func (e *Entry) computeHash() string {
+	fields := []string{
+		e.PrevHash,
+		e.OccurredAt.UTC().Format(time.RFC3339Nano),
+		strconv.Itoa(e.ActorID),
+		e.ActorRole,
+		e.Action,
+		e.ResourceType,
+		strconv.Itoa(e.ResourceID),
+		string(e.Changes),
+		e.IP,
+		e.RequestID,
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x1f")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Diff returns the fields that differ between before and after as {"field": {"from": .., "to": ..}}
+func Diff(before, after interface{}) (json.RawMessage, error) {
+	beforeFields, err := toFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := toFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]Change{}
+	for key, from := range beforeFields {
+		to, ok := afterFields[key]
+		if !ok {
+			changes[key] = Change{From: from}
+		} else if !reflect.DeepEqual(from, to) {
+			changes[key] = Change{From: from, To: to}
+		}
+	}
+	for key, to := range afterFields {
+		if _, ok := beforeFields[key]; !ok {
+			changes[key] = Change{To: to}
+		}
+	}
+	return json.Marshal(changes)
+}
+
+// toFields converts a struct or map to its JSON field map
+func toFields(v interface{}) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return fields, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return fields, json.Unmarshal(data, &fields)
+}
+
+// Verify walks the whole chain and returns the number of entries checked and the ID of
+// the first entry whose hash or link does not match (0 if the chain is intact)
+func Verify() (int, int64, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, occurred_at, actor_id, actor_role, action, resource_type, resource_id, changes, ip, request_id, prev_hash, hash
+		FROM audit_log ORDER BY id
+	`)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	checked := 0
+	prev := ""
+	for rows.Next() {
+		var e Entry
+		var changes []byte
+		if err := rows.Scan(&e.ID, &e.OccurredAt, &e.ActorID, &e.ActorRole, &e.Action, &e.ResourceType,
+			&e.ResourceID, &changes, &e.IP, &e.RequestID, &e.PrevHash, &e.Hash); err != nil {
+			return checked, 0, err
+		}
+		e.Changes = changes
+		checked++
+
+		if e.PrevHash != prev || e.computeHash() != e.Hash {
+			return checked, e.ID, nil
+		}
+		prev = e.Hash
+	}
+	return checked, 0, rows.Err()
+}
@@ -0,0 +1,198 @@
+// Command mockoidc runs a minimal OpenID Connect provider for exercising the
+// staff single sign-on flow locally. Every authorization request is approved
+// immediately for the configured user; do not expose it outside development.
+//
+//	go run ./cmd/mockoidc -groups clinic-staff
+//
+// then start the API with OIDC_ISSUER_URL=http://localhost:9999,
+// OIDC_CLIENT_ID=petclinic, OIDC_CLIENT_SECRET=secret and open /api/oidc/login.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const keyID = "mock"
+
+type authRequest struct {
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	email         string
+}
+
+var (
+	addr         = flag.String("addr", ":9999", "listen address")
+	issuer       = flag.String("issuer", "http://localhost:9999", "issuer URL")
+	clientID     = flag.String("client-id", "petclinic", "accepted client ID")
+	clientSecret = flag.String("client-secret", "secret", "accepted client secret")
+	email        = flag.String("email", "vet@clinic.example", "email of the signed-in user (override with ?login_hint=)")
+	name         = flag.String("name", "Mock Vet", "display name of the signed-in user")
+	groups       = flag.String("groups", "clinic-staff", "comma-separated groups claim")
+	amr          = flag.String("amr", "pwd,mfa", "comma-separated authentication methods claim")
+
+	signingKey *rsa.PrivateKey
+	codes      = map[string]authRequest{}
+	codesMu    sync.Mutex
+)
+
+func main() {
+	flag.Parse()
+
+	var err error
+	if signingKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", discoveryHandler)
+	http.HandleFunc("/jwks", jwksHandler)
+	http.HandleFunc("/authorize", authorizeHandler)
+	http.HandleFunc("/token", tokenHandler)
+
+	log.Printf("Mock OIDC provider %s listening on %s", *issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                *issuer,
+		"authorization_endpoint":                *issuer + "/authorize",
+		"token_endpoint":                        *issuer + "/token",
+		"jwks_uri":                              *issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	pub := signingKey.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": keyID,
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != *clientID || q.Get("response_type") != "code" || q.Get("redirect_uri") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	user := *email
+	if hint := q.Get("login_hint"); hint != "" {
+		user = hint
+	}
+
+	code := randomString()
+	codesMu.Lock()
+	codes[code] = authRequest{
+		redirectURI:   q.Get("redirect_uri"),
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		email:         user,
+	}
+	codesMu.Unlock()
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if subtle.ConstantTimeCompare([]byte(id), []byte(*clientID)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(secret), []byte(*clientSecret)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	codesMu.Lock()
+	req, found := codes[r.PostFormValue("code")]
+	delete(codes, r.PostFormValue("code"))
+	codesMu.Unlock()
+
+	if !found || r.PostFormValue("redirect_uri") != req.redirectURI {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if req.codeChallenge != "" && base64.RawURLEncoding.EncodeToString(verifier[:]) != req.codeChallenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            *issuer,
+		"aud":            *clientID,
+		"sub":            "mock|" + req.email,
+		"email":          req.email,
+		"email_verified": true,
+		"name":           *name,
+		"groups":         strings.Split(*groups, ","),
+		"amr":            strings.Split(*amr, ","),
+		"nonce":          req.nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+	})
+	token.Header["kid"] = keyID
+
+	idToken, err := token.SignedString(signingKey)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, code int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(payload)
+}
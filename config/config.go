@@ -1,9 +1,13 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"petclinic/utils"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -12,8 +16,14 @@ var (
 	// Server configuration
 	ServerPort string
 
+	// Environment: "development" enables insecure conveniences such as default secrets
+	AppEnv string
+
 	// JWT configuration
-	JWTSecret string
+	JWTSecret      string
+	JWTKeysDir     string
+	JWTActiveKeyID string
+	JWTAlgorithm   string // algorithm for generated development keys: "RS256" or "EdDSA"
 
 	// File upload configuration
 	UploadDir     string
@@ -27,12 +37,95 @@ var (
 	DBName     string
 	DBSSLMode  string
 
+	// Application URL used when building links sent to users
+	AppBaseURL string
+
+	// Mail configuration
+	MailerType   string // "smtp" or "log"
+	MailFrom     string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUser     string
+	SMTPPassword string
+	MailLogDir   string
+
+	// Password reset configuration
+	PasswordResetTTL time.Duration
+
+	// Email verification configuration
+	LinkSigningSecret    string
+	EmailVerificationTTL time.Duration
+	RequireVerifiedEmail bool
+
+	// Login brute-force protection
+	LoginAttemptStore    string // "memory" or "postgres"
+	LoginFreeAttempts    int
+	LoginMaxFailures     int
+	LoginMaxIPFailures   int
+	LoginBackoffBase     time.Duration
+	LoginLockoutDuration time.Duration
+	LoginFailureWindow   time.Duration
+
+	// Two-factor authentication
+	MFAIssuer        string
+	MFARequiredRoles []string
+	MFAChallengeTTL  time.Duration
+
+	// OpenID Connect single sign-on (disabled when OIDCIssuerURL is empty)
+	OIDCIssuerURL    string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       []string
+	OIDCGroupsClaim  string
+	OIDCGroupRoles   map[string]string // IdP group -> clinic role
+
+	// Soft deletion: deleted rows are purged after the retention period
+	SoftDeleteRetention time.Duration
+	PurgeInterval       time.Duration
+
+	// Pet guardians and ownership transfers
+	GuardianInviteTTL time.Duration
+	PetTransferTTL    time.Duration
+
+	// Appointment reminders
+	NotifierType     string          // "email", "sms" or "log"
+	ReminderOffsets  []time.Duration // how long before an appointment each reminder is sent
+	ReminderInterval time.Duration
+	SMSGatewayURL    string
+	SMSGatewayToken  string
+	SMSFrom          string
+
+	// Transactional outbox
+	OutboxPollInterval time.Duration
+	OutboxMaxAttempts  int
+	OutboxRetryBase    time.Duration
+	OutboxRetryMax     time.Duration
+	OutboxRetention    time.Duration // delivered messages are purged after this
+	EventLogRetention  time.Duration // how far back live event streams can resume
+
+	// Calendar export
+	ClinicName          string
+	ClinicAddress       string
+	ClinicLocation      *time.Location // time zone appointment times are stored in
+	AppointmentDuration time.Duration  // assumed length of an appointment in calendars and conflict checks
+
+	// Waitlist
+	WaitlistOfferTTL time.Duration // how long a waitlisted owner has to claim a freed slot
+	WaitlistInterval time.Duration // how often expired offers pass to the next entry
+
+	// Walk-in queue
+	ExamRooms int // rooms seeing patients at once, used to estimate waits
+
 	// Log levels
 	LogInfo  string
 	LogWarn  string
 	LogError string
 )
 
+// defaultJWTSecret is the placeholder secret that must be replaced outside development
+const defaultJWTSecret = "your-secret-key-change-in-production"
+
 // LoadConfig loads environment variables from .env file
 func LoadConfig() {
 	// Load .env file
@@ -43,8 +136,14 @@ func LoadConfig() {
 	// Server configuration
 	ServerPort = getEnv("SERVER_PORT", ":8080")
 
+	// Development mode relaxes safety checks, so it must be chosen explicitly
+	AppEnv = getEnv("APP_ENV", "production")
+
 	// JWT configuration
-	JWTSecret = getEnv("JWT_SECRET", "your-secret-key-change-in-production")
+	JWTSecret = getEnv("JWT_SECRET", defaultJWTSecret)
+	JWTKeysDir = getEnv("JWT_KEYS_DIR", "./keys")
+	JWTActiveKeyID = getEnv("JWT_ACTIVE_KID", "")
+	JWTAlgorithm = getEnv("JWT_ALGORITHM", "RS256")
 
 	// File upload configuration
 	UploadDir = getEnv("UPLOAD_DIR", "./uploads")
@@ -58,12 +157,115 @@ func LoadConfig() {
 	DBName = getEnv("DB_NAME", "petclinic")
 	DBSSLMode = getEnv("DB_SSLMODE", "disable")
 
+	// Application URL
+	AppBaseURL = getEnv("APP_BASE_URL", "http://localhost:8080")
+
+	// Mail configuration
+	MailerType = getEnv("MAILER", "log")
+	MailFrom = getEnv("MAIL_FROM", "no-reply@petclinic.local")
+	SMTPHost = getEnv("SMTP_HOST", "localhost")
+	SMTPPort = getEnv("SMTP_PORT", "587")
+	SMTPUser = getEnv("SMTP_USER", "")
+	SMTPPassword = getEnv("SMTP_PASSWORD", "")
+	MailLogDir = getEnv("MAIL_LOG_DIR", "./mail")
+
+	// Password reset configuration
+	PasswordResetTTL = getEnvAsDuration("PASSWORD_RESET_TTL", time.Hour)
+
+	// Email verification configuration
+	LinkSigningSecret = getEnv("LINK_SIGNING_SECRET", JWTSecret)
+	EmailVerificationTTL = getEnvAsDuration("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+	RequireVerifiedEmail = getEnvAsBool("REQUIRE_VERIFIED_EMAIL", true)
+
+	// Login brute-force protection
+	LoginAttemptStore = getEnv("LOGIN_ATTEMPT_STORE", "postgres")
+	LoginFreeAttempts = int(getEnvAsInt64("LOGIN_FREE_ATTEMPTS", 3))
+	LoginMaxFailures = int(getEnvAsInt64("LOGIN_MAX_FAILURES", 10))
+	LoginMaxIPFailures = int(getEnvAsInt64("LOGIN_MAX_IP_FAILURES", 50))
+	LoginBackoffBase = getEnvAsDuration("LOGIN_BACKOFF_BASE", time.Second)
+	LoginLockoutDuration = getEnvAsDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	LoginFailureWindow = getEnvAsDuration("LOGIN_FAILURE_WINDOW", time.Hour)
+
+	// Two-factor authentication
+	MFAIssuer = getEnv("MFA_ISSUER", "Pet Clinic")
+	MFARequiredRoles = getEnvAsList("MFA_REQUIRED_ROLES", []string{"staff"})
+	MFAChallengeTTL = getEnvAsDuration("MFA_CHALLENGE_TTL", 5*time.Minute)
+
+	// OpenID Connect single sign-on
+	OIDCIssuerURL = strings.TrimSuffix(getEnv("OIDC_ISSUER_URL", ""), "/")
+	OIDCClientID = getEnv("OIDC_CLIENT_ID", "")
+	OIDCClientSecret = getEnv("OIDC_CLIENT_SECRET", "")
+	OIDCRedirectURL = getEnv("OIDC_REDIRECT_URL", AppBaseURL+"/api/oidc/callback")
+	OIDCScopes = getEnvAsList("OIDC_SCOPES", []string{"openid", "email", "profile", "groups"})
+	OIDCGroupsClaim = getEnv("OIDC_GROUPS_CLAIM", "groups")
+	OIDCGroupRoles = getEnvAsMap("OIDC_GROUP_ROLES", map[string]string{"clinic-staff": "staff"})
+
+	// Soft deletion
+	SoftDeleteRetention = getEnvAsDuration("SOFT_DELETE_RETENTION", 30*24*time.Hour)
+	PurgeInterval = getEnvAsDuration("PURGE_INTERVAL", time.Hour)
+
+	// Pet guardians and ownership transfers
+	GuardianInviteTTL = getEnvAsDuration("GUARDIAN_INVITE_TTL", 7*24*time.Hour)
+	PetTransferTTL = getEnvAsDuration("PET_TRANSFER_TTL", 14*24*time.Hour)
+
+	// Appointment reminders
+	NotifierType = getEnv("NOTIFIER", "email")
+	ReminderOffsets = getEnvAsDurations("REMINDER_OFFSETS", []time.Duration{48 * time.Hour, 2 * time.Hour})
+	ReminderInterval = getEnvAsDuration("REMINDER_INTERVAL", time.Minute)
+	SMSGatewayURL = getEnv("SMS_GATEWAY_URL", "")
+	SMSGatewayToken = getEnv("SMS_GATEWAY_TOKEN", "")
+	SMSFrom = getEnv("SMS_FROM", "PetClinic")
+
+	// Transactional outbox
+	OutboxPollInterval = getEnvAsDuration("OUTBOX_POLL_INTERVAL", time.Second)
+	OutboxMaxAttempts = int(getEnvAsInt64("OUTBOX_MAX_ATTEMPTS", 10))
+	OutboxRetryBase = getEnvAsDuration("OUTBOX_RETRY_BASE", 10*time.Second)
+	OutboxRetryMax = getEnvAsDuration("OUTBOX_RETRY_MAX", time.Hour)
+	OutboxRetention = getEnvAsDuration("OUTBOX_RETENTION", 7*24*time.Hour)
+	EventLogRetention = getEnvAsDuration("EVENT_LOG_RETENTION", 24*time.Hour)
+
+	// Calendar export
+	ClinicName = getEnv("CLINIC_NAME", "Pet Clinic")
+	ClinicAddress = getEnv("CLINIC_ADDRESS", "")
+	ClinicLocation = getEnvAsLocation("CLINIC_TIMEZONE", time.UTC)
+	AppointmentDuration = getEnvAsDuration("APPOINTMENT_DURATION", 30*time.Minute)
+
+	// Waitlist
+	WaitlistOfferTTL = getEnvAsDuration("WAITLIST_OFFER_TTL", 2*time.Hour)
+	WaitlistInterval = getEnvAsDuration("WAITLIST_INTERVAL", time.Minute)
+
+	// Walk-in queue
+	ExamRooms = int(getEnvAsInt64("EXAM_ROOMS", 2))
+
 	// Log levels
 	LogInfo = getEnv("LOG_INFO", "INFO")
 	LogWarn = getEnv("LOG_WARN", "WARN")
 	LogError = getEnv("LOG_ERROR", "ERROR")
 }
 
+// IsDevelopment reports whether the application runs in development mode
+func IsDevelopment() bool {
+	return AppEnv == "development"
+}
+
+// Validate rejects configurations that are unsafe outside development
+func Validate() error {
+	if IsDevelopment() {
+		return nil
+	}
+	if JWTSecret == defaultJWTSecret {
+		return fmt.Errorf("JWT_SECRET must be changed from the default when APP_ENV=%s", AppEnv)
+	}
+	if LinkSigningSecret == defaultJWTSecret {
+		return fmt.Errorf("LINK_SIGNING_SECRET must be changed from the default when APP_ENV=%s", AppEnv)
+	}
+	// Any other mailer falls back to the log mailer, which writes reset and verification links to disk
+	if MailerType != "smtp" {
+		return fmt.Errorf("MAILER must be smtp when APP_ENV=%s", AppEnv)
+	}
+	return nil
+}
+
 // getEnv reads an environment variable or returns a default value
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -81,6 +283,93 @@ func getEnvAsInt64(key string, defaultValue int64) int64 {
 	return defaultValue
 }
 
+// getEnvAsDuration reads an environment variable as a duration (e.g. "30m") or returns a default value
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := os.Getenv(key)
+	if value, err := time.ParseDuration(valueStr); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvAsDurations reads a comma-separated list of durations or returns a default value.
+// Entries that don't parse are skipped.
+func getEnvAsDurations(key string, defaultValue []time.Duration) []time.Duration {
+	values := getEnvAsList(key, nil)
+	if values == nil {
+		return defaultValue
+	}
+
+	var result []time.Duration
+	for _, v := range values {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+// getEnvAsLocation reads an IANA time zone name (e.g. "Europe/London") or returns a default value
+func getEnvAsLocation(key string, defaultValue *time.Location) *time.Location {
+	valueStr := os.Getenv(key)
+	if value, err := time.LoadLocation(valueStr); err == nil && valueStr != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvAsBool reads an environment variable as a bool or returns a default value
+func getEnvAsBool(key string, defaultValue bool) bool {
+	valueStr := os.Getenv(key)
+	if value, err := strconv.ParseBool(valueStr); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvAsList reads a comma-separated environment variable or returns a default value
+func getEnvAsList(key string, defaultValue []string) []string {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+
+	var values []string
+	for _, v := range strings.Split(valueStr, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// getEnvAsMap reads a comma-separated list of key=value pairs or returns a default value
+func getEnvAsMap(key string, defaultValue map[string]string) map[string]string {
+	values := getEnvAsList(key, nil)
+	if values == nil {
+		return defaultValue
+	}
+
+	result := make(map[string]string)
+	for _, pair := range values {
+		if k, v, ok := strings.Cut(pair, "="); ok {
+			result[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return result
+}
+
+// IsMFARequired reports whether accounts with the given role must use two-factor authentication
+func IsMFARequired(role string) bool {
+	return utils.ContainsString(MFARequiredRoles, role)
+}
+
+// ClinicTime reads t's wall-clock fields as a time in ClinicLocation. Appointment times are
+// stored as TIMESTAMP (no zone) clinic wall-clock times, so this gives the instant they refer to.
+func ClinicTime(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), ClinicLocation)
+}
+
 // GetDBConnectionString returns the PostgreSQL connection string
 func GetDBConnectionString() string {
 	return "host=" + DBHost +
@@ -89,4 +378,4 @@ func GetDBConnectionString() string {
 		" password=" + DBPassword +
 		" dbname=" + DBName +
 		" sslmode=" + DBSSLMode
-}
\ No newline at end of file
+}
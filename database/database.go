@@ -5,11 +5,18 @@ import (
 	"petclinic/config"
 	"petclinic/utils"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var DB *sql.DB
 
+// ClinicNow returns a SQL expression for the current clinic wall-clock time. Appointment, series
+// and waitlist times are TIMESTAMP values in config.ClinicLocation, so compare them with this
+// rather than NOW().
+func ClinicNow() string {
+	return "(NOW() AT TIME ZONE " + pq.QuoteLiteral(config.ClinicLocation.String()) + ")"
+}
+
 // InitDB initializes the database connection and creates tables
 func InitDB() error {
 	var err error
@@ -72,7 +79,467 @@ func createTables() error {
 		file_path VARCHAR(500) NOT NULL,
 		file_type VARCHAR(50),
 		uploaded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
+	);
+
+	ALTER TABLE owners ADD COLUMN IF NOT EXISTS token_version INTEGER NOT NULL DEFAULT 0;
+	-- Accounts created before verification existed are treated as verified; new ones start unverified
+	ALTER TABLE owners ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT TRUE;
+
+	CREATE TABLE IF NOT EXISTS password_reset_tokens (
+		id SERIAL PRIMARY KEY,
+		owner_id INTEGER REFERENCES owners(id) ON DELETE CASCADE,
+		token_hash VARCHAR(64) UNIQUE NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		key VARCHAR(255) PRIMARY KEY,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure_at TIMESTAMPTZ NOT NULL,
+		blocked_until TIMESTAMPTZ
+	);
+
+	ALTER TABLE owners ADD COLUMN IF NOT EXISTS mfa_secret VARCHAR(64);
+	ALTER TABLE owners ADD COLUMN IF NOT EXISTS mfa_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE owners ADD COLUMN IF NOT EXISTS mfa_last_step BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE owners ADD COLUMN IF NOT EXISTS oidc_subject VARCHAR(255) UNIQUE;
+	ALTER TABLE owners ADD COLUMN IF NOT EXISTS oidc_provisioned BOOLEAN NOT NULL DEFAULT FALSE;
+
+	CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+		id SERIAL PRIMARY KEY,
+		owner_id INTEGER REFERENCES owners(id) ON DELETE CASCADE,
+		code_hash VARCHAR(64) NOT NULL,
+		used_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id SERIAL PRIMARY KEY,
+		owner_id INTEGER REFERENCES owners(id) ON DELETE CASCADE,
+		name VARCHAR(100) NOT NULL,
+		prefix VARCHAR(16) UNIQUE NOT NULL,
+		key_hash VARCHAR(64) NOT NULL,
+		scopes TEXT[] NOT NULL,
+		expires_at TIMESTAMPTZ,
+		last_used_at TIMESTAMPTZ,
+		revoked_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+
+	ALTER TABLE pets ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+	ALTER TABLE pets ADD COLUMN IF NOT EXISTS deleted_by INTEGER;
+	ALTER TABLE appointments ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+	ALTER TABLE appointments ADD COLUMN IF NOT EXISTS deleted_by INTEGER;
+	ALTER TABLE medical_records ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+	ALTER TABLE medical_records ADD COLUMN IF NOT EXISTS deleted_by INTEGER;
+	CREATE INDEX IF NOT EXISTS idx_pets_deleted_at ON pets (deleted_at) WHERE deleted_at IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS idx_appointments_deleted_at ON appointments (deleted_at) WHERE deleted_at IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS idx_medical_records_deleted_at ON medical_records (deleted_at) WHERE deleted_at IS NOT NULL;
+
+	-- List sort columns must not be NULL: the keyset cursor compares (column, id) and would skip NULL rows
+	UPDATE appointments SET status = 'scheduled' WHERE status IS NULL;
+	UPDATE appointments SET reason = '' WHERE reason IS NULL;
+	ALTER TABLE appointments ALTER COLUMN status SET NOT NULL;
+	ALTER TABLE appointments ALTER COLUMN reason SET DEFAULT '';
+	ALTER TABLE appointments ALTER COLUMN reason SET NOT NULL;
+	UPDATE medical_records SET uploaded_at = CURRENT_TIMESTAMP WHERE uploaded_at IS NULL;
+	ALTER TABLE medical_records ALTER COLUMN uploaded_at SET NOT NULL;
+	UPDATE api_keys SET created_at = CURRENT_TIMESTAMP WHERE created_at IS NULL;
+	ALTER TABLE api_keys ALTER COLUMN created_at SET NOT NULL;
+
+	ALTER TABLE pets ADD COLUMN IF NOT EXISTS date_of_birth DATE;
+	ALTER TABLE pets ADD COLUMN IF NOT EXISTS sex VARCHAR(10) NOT NULL DEFAULT 'unknown';
+	ALTER TABLE pets ADD COLUMN IF NOT EXISTS neutered BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE pets ADD COLUMN IF NOT EXISTS color VARCHAR(50) NOT NULL DEFAULT '';
+	ALTER TABLE pets ADD COLUMN IF NOT EXISTS markings TEXT NOT NULL DEFAULT '';
+	ALTER TABLE pets ADD COLUMN IF NOT EXISTS microchip VARCHAR(15);
+	ALTER TABLE pets ADD COLUMN IF NOT EXISTS deceased BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE pets ADD COLUMN IF NOT EXISTS deceased_at DATE;
+	-- A chip identifies one live pet; deleted pets release theirs
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_pets_microchip ON pets (microchip) WHERE microchip IS NOT NULL AND deleted_at IS NULL;
+
+	-- Vital signs are stored in one canonical unit per metric (kg, °C, bpm, breaths/min, 1-9 BCS)
+	CREATE TABLE IF NOT EXISTS pet_vitals (
+		id SERIAL PRIMARY KEY,
+		pet_id INTEGER REFERENCES pets(id) ON DELETE CASCADE,
+		appointment_id INTEGER REFERENCES appointments(id) ON DELETE SET NULL,
+		metric VARCHAR(30) NOT NULL,
+		value NUMERIC(8, 3) NOT NULL,
+		notes TEXT NOT NULL DEFAULT '',
+		recorded_by INTEGER REFERENCES owners(id) ON DELETE SET NULL,
+		recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_pet_vitals_series ON pet_vitals (pet_id, metric, recorded_at);
+
+	CREATE TABLE IF NOT EXISTS pet_alerts (
+		id SERIAL PRIMARY KEY,
+		pet_id INTEGER REFERENCES pets(id) ON DELETE CASCADE,
+		type VARCHAR(20) NOT NULL,
+		allergen_type VARCHAR(20) NOT NULL DEFAULT '',
+		substance VARCHAR(100) NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		severity VARCHAR(20) NOT NULL,
+		created_by INTEGER REFERENCES owners(id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_pet_alerts_pet ON pet_alerts (pet_id);
+
+	-- Prescriptions are checked against drug allergies; allergy_override records why a
+	-- high-severity match was prescribed anyway
+	CREATE TABLE IF NOT EXISTS prescriptions (
+		id SERIAL PRIMARY KEY,
+		pet_id INTEGER NOT NULL REFERENCES pets(id) ON DELETE CASCADE,
+		appointment_id INTEGER REFERENCES appointments(id) ON DELETE SET NULL,
+		drug VARCHAR(200) NOT NULL,
+		dose VARCHAR(100) NOT NULL DEFAULT '',
+		instructions TEXT NOT NULL DEFAULT '',
+		allergy_override TEXT NOT NULL DEFAULT '',
+		prescribed_by INTEGER REFERENCES owners(id) ON DELETE SET NULL,
+		prescribed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_prescriptions_pet ON prescriptions (pet_id, prescribed_at);
+
+	-- Everyone with access to a pet. pets.owner_id stays the primary guardian so existing
+	-- references (search, reporting) keep working; pets created before this table are backfilled.
+	CREATE TABLE IF NOT EXISTS pet_guardians (
+		pet_id INTEGER REFERENCES pets(id) ON DELETE CASCADE,
+		owner_id INTEGER REFERENCES owners(id) ON DELETE CASCADE,
+		role VARCHAR(20) NOT NULL,
+		can_book BOOLEAN NOT NULL DEFAULT FALSE,
+		added_by INTEGER REFERENCES owners(id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (pet_id, owner_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_pet_guardians_owner ON pet_guardians (owner_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_pet_guardians_primary ON pet_guardians (pet_id) WHERE role = 'primary';
+	INSERT INTO pet_guardians (pet_id, owner_id, role, can_book)
+		SELECT id, owner_id, 'primary', TRUE FROM pets WHERE owner_id IS NOT NULL
+		ON CONFLICT DO NOTHING;
+
+	CREATE TABLE IF NOT EXISTS pet_guardian_invitations (
+		id SERIAL PRIMARY KEY,
+		pet_id INTEGER REFERENCES pets(id) ON DELETE CASCADE,
+		email VARCHAR(100) NOT NULL,
+		role VARCHAR(20) NOT NULL,
+		can_book BOOLEAN NOT NULL DEFAULT FALSE,
+		token_hash VARCHAR(64) UNIQUE NOT NULL,
+		invited_by INTEGER REFERENCES owners(id) ON DELETE SET NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		accepted_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS pet_transfers (
+		id SERIAL PRIMARY KEY,
+		pet_id INTEGER REFERENCES pets(id) ON DELETE CASCADE,
+		from_owner_id INTEGER REFERENCES owners(id) ON DELETE SET NULL,
+		to_email VARCHAR(100) NOT NULL,
+		to_owner_id INTEGER REFERENCES owners(id) ON DELETE SET NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		note TEXT NOT NULL DEFAULT '',
+		initiated_by INTEGER REFERENCES owners(id) ON DELETE SET NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		responded_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_pet_transfers_pending ON pet_transfers (pet_id) WHERE status = 'pending';
+	-- Transfers are accepted with the token from the email; requests made before this can't be
+	ALTER TABLE pet_transfers ADD COLUMN IF NOT EXISTS token_hash VARCHAR(64) UNIQUE;
+
+	-- Chain of custody: one row per period a pet had a given primary owner
+	CREATE TABLE IF NOT EXISTS pet_ownership_history (
+		id SERIAL PRIMARY KEY,
+		pet_id INTEGER REFERENCES pets(id) ON DELETE CASCADE,
+		owner_id INTEGER REFERENCES owners(id) ON DELETE SET NULL,
+		transfer_id INTEGER REFERENCES pet_transfers(id) ON DELETE SET NULL,
+		started_at TIMESTAMPTZ NOT NULL,
+		ended_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS idx_pet_ownership_history_pet ON pet_ownership_history (pet_id);
+	INSERT INTO pet_ownership_history (pet_id, owner_id, started_at)
+		SELECT p.id, p.owner_id, COALESCE(p.created_at, NOW()) FROM pets p
+		WHERE NOT EXISTS (SELECT 1 FROM pet_ownership_history h WHERE h.pet_id = p.id);
+
+	-- One row per reminder per appointment time; the row is claimed before sending so
+	-- restarts and other instances never send the same reminder twice
+	CREATE TABLE IF NOT EXISTS appointment_reminders (
+		id SERIAL PRIMARY KEY,
+		appointment_id INTEGER REFERENCES appointments(id) ON DELETE CASCADE,
+		appointment_date TIMESTAMP NOT NULL,
+		offset_seconds BIGINT NOT NULL,
+		channel VARCHAR(20) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'sending',
+		attempts INTEGER NOT NULL DEFAULT 1,
+		last_error TEXT NOT NULL DEFAULT '',
+		sent_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (appointment_id, appointment_date, offset_seconds)
+	);
+
+	-- Transactional outbox: messages are written in the same transaction as the change they
+	-- describe and delivered by a background dispatcher
+	CREATE TABLE IF NOT EXISTS outbox (
+		id BIGSERIAL PRIMARY KEY,
+		kind VARCHAR(100) NOT NULL,
+		payload JSONB NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		delivered_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS idx_outbox_due ON outbox (next_attempt_at) WHERE status = 'pending';
+
+	-- Outgoing webhooks
+	CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+		id SERIAL PRIMARY KEY,
+		url TEXT NOT NULL,
+		event_types TEXT[] NOT NULL,
+		secret VARCHAR(100) NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_by INTEGER REFERENCES owners(id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id SERIAL PRIMARY KEY,
+		subscription_id INTEGER REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+		event_id VARCHAR(50) NOT NULL,
+		event_type VARCHAR(50) NOT NULL,
+		payload JSONB NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		response_status INTEGER,
+		last_error TEXT NOT NULL DEFAULT '',
+		replay_of INTEGER REFERENCES webhook_deliveries(id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		delivered_at TIMESTAMPTZ
+	);
+	-- An event is delivered once per subscription (replays are separate rows)
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_webhook_deliveries_event ON webhook_deliveries (subscription_id, event_id) WHERE replay_of IS NULL;
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_subscription ON webhook_deliveries (subscription_id, id);
+
+	-- Published events, kept for a while so live streams can resume after a disconnect.
+	-- Each insert is announced on the clinic_events channel when its transaction commits.
+	CREATE TABLE IF NOT EXISTS event_log (
+		id BIGSERIAL PRIMARY KEY,
+		event_id VARCHAR(50) NOT NULL UNIQUE,
+		type VARCHAR(50) NOT NULL,
+		pet_id INTEGER NOT NULL,
+		data JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_event_log_created_at ON event_log (created_at);
+
+	CREATE OR REPLACE FUNCTION notify_event_log() RETURNS trigger AS $$
+	BEGIN
+		PERFORM pg_notify('clinic_events', NEW.id::text);
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS event_log_notify ON event_log;
+	CREATE TRIGGER event_log_notify AFTER INSERT ON event_log
+		FOR EACH ROW EXECUTE FUNCTION notify_event_log();
+
+	-- Streams resume from commit_seq, which is assigned in commit order: id follows insert order,
+	-- so an event committed late could have a lower id than one a client has already seen.
+	-- The deferred trigger runs at commit and holds the lock until the commit completes.
+	CREATE SEQUENCE IF NOT EXISTS event_log_commit_seq;
+	ALTER TABLE event_log ADD COLUMN IF NOT EXISTS commit_seq BIGINT;
+	UPDATE event_log e SET commit_seq = s.seq
+		FROM (SELECT id, nextval('event_log_commit_seq') AS seq FROM event_log WHERE commit_seq IS NULL ORDER BY id) s
+		WHERE e.id = s.id;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_event_log_commit_seq ON event_log (commit_seq);
+
+	CREATE OR REPLACE FUNCTION event_log_assign_commit_seq() RETURNS trigger AS $$
+	BEGIN
+		PERFORM pg_advisory_xact_lock(7340046);
+		UPDATE event_log SET commit_seq = nextval('event_log_commit_seq') WHERE id = NEW.id;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS event_log_commit_seq ON event_log;
+	CREATE CONSTRAINT TRIGGER event_log_commit_seq AFTER INSERT ON event_log
+		DEFERRABLE INITIALLY DEFERRED
+		FOR EACH ROW EXECUTE FUNCTION event_log_assign_commit_seq();
+
+	-- Calendar export: SEQUENCE must rise whenever a calendar-visible field changes
+	ALTER TABLE appointments ADD COLUMN IF NOT EXISTS sequence INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE appointments ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+	CREATE OR REPLACE FUNCTION appointments_bump_sequence() RETURNS trigger AS $$
+	BEGIN
+		IF NEW.date IS DISTINCT FROM OLD.date OR NEW.reason IS DISTINCT FROM OLD.reason
+			OR NEW.status IS DISTINCT FROM OLD.status OR NEW.deleted_at IS DISTINCT FROM OLD.deleted_at THEN
+			NEW.sequence := OLD.sequence + 1;
+			NEW.updated_at := NOW();
+		END IF;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS appointments_sequence ON appointments;
+	CREATE TRIGGER appointments_sequence BEFORE UPDATE ON appointments
+		FOR EACH ROW EXECUTE FUNCTION appointments_bump_sequence();
+
+	-- One secret calendar feed per account; only the token's hash is stored
+	CREATE TABLE IF NOT EXISTS calendar_feeds (
+		owner_id INTEGER PRIMARY KEY REFERENCES owners(id) ON DELETE CASCADE,
+		token_hash VARCHAR(64) NOT NULL UNIQUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+
+	-- Recurring appointments: a series books one appointment per occurrence of its rule. Occurrences
+	-- edited on their own are marked as exceptions so later series-wide edits leave them alone.
+	CREATE TABLE IF NOT EXISTS appointment_series (
+		id SERIAL PRIMARY KEY,
+		pet_id INTEGER NOT NULL REFERENCES pets(id) ON DELETE CASCADE,
+		rrule TEXT NOT NULL,
+		dtstart TIMESTAMP NOT NULL,
+		reason TEXT,
+		created_by INTEGER REFERENCES owners(id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		cancelled_at TIMESTAMPTZ
+	);
+
+	ALTER TABLE appointments ADD COLUMN IF NOT EXISTS series_id INTEGER REFERENCES appointment_series(id) ON DELETE SET NULL;
+	ALTER TABLE appointments ADD COLUMN IF NOT EXISTS series_exception BOOLEAN NOT NULL DEFAULT FALSE;
+	-- The occurrence's slot in the series (its original date, like RECURRENCE-ID), kept if it is moved
+	ALTER TABLE appointments ADD COLUMN IF NOT EXISTS series_date TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS idx_appointments_series ON appointments (series_id, series_date) WHERE series_id IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS idx_appointments_pet_date ON appointments (pet_id, date) WHERE deleted_at IS NULL;
+
+	-- The vet seeing the pet; waitlist entries with a preferred vet are only offered that vet's slots
+	ALTER TABLE appointments ADD COLUMN IF NOT EXISTS vet TEXT NOT NULL DEFAULT '';
+
+	-- Waitlist: owners ask for a slot within a date range. A cancelled booking's slot is offered to
+	-- matching entries one at a time, oldest first; each offer can be claimed until it expires.
+	CREATE TABLE IF NOT EXISTS waitlist_entries (
+		id SERIAL PRIMARY KEY,
+		pet_id INTEGER NOT NULL REFERENCES pets(id) ON DELETE CASCADE,
+		owner_id INTEGER NOT NULL REFERENCES owners(id) ON DELETE CASCADE,
+		earliest TIMESTAMP NOT NULL,
+		latest TIMESTAMP NOT NULL,
+		preferred_vet TEXT NOT NULL DEFAULT '',
+		reason TEXT NOT NULL DEFAULT '',
+		status VARCHAR(20) NOT NULL DEFAULT 'waiting', -- waiting, booked, cancelled, expired
+		appointment_id INTEGER REFERENCES appointments(id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		CHECK (latest > earliest)
+	);
+	CREATE INDEX IF NOT EXISTS idx_waitlist_entries_waiting ON waitlist_entries (created_at, id) WHERE status = 'waiting';
+
+	CREATE TABLE IF NOT EXISTS waitlist_offers (
+		id SERIAL PRIMARY KEY,
+		entry_id INTEGER NOT NULL REFERENCES waitlist_entries(id) ON DELETE CASCADE,
+		slot_appointment_id INTEGER NOT NULL REFERENCES appointments(id) ON DELETE CASCADE,
+		slot_date TIMESTAMP NOT NULL,
+		token_hash VARCHAR(64) NOT NULL UNIQUE,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, claimed, declined, expired, withdrawn
+		expires_at TIMESTAMPTZ NOT NULL,
+		responded_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (slot_appointment_id, entry_id)
+	);
+	-- A slot is offered to one entry at a time and claimed at most once
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_waitlist_offers_slot ON waitlist_offers (slot_appointment_id) WHERE status IN ('pending', 'claimed');
+	CREATE INDEX IF NOT EXISTS idx_waitlist_offers_pending ON waitlist_offers (expires_at) WHERE status = 'pending';
+
+	-- Walk-in queue: patients checked in at the clinic, booked or not, seen by triage level and then arrival
+	CREATE TABLE IF NOT EXISTS queue_entries (
+		id SERIAL PRIMARY KEY,
+		pet_id INTEGER NOT NULL REFERENCES pets(id) ON DELETE CASCADE,
+		appointment_id INTEGER REFERENCES appointments(id) ON DELETE SET NULL,
+		triage_level SMALLINT NOT NULL CHECK (triage_level BETWEEN 1 AND 4), -- 1 is most urgent
+		reason TEXT NOT NULL DEFAULT '',
+		status VARCHAR(20) NOT NULL DEFAULT 'waiting', -- waiting, in_room, done, left
+		room TEXT NOT NULL DEFAULT '',
+		checked_in_by INTEGER REFERENCES owners(id) ON DELETE SET NULL,
+		checked_in_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		called_at TIMESTAMPTZ,
+		completed_at TIMESTAMPTZ
+	);
+	-- A pet can be in the queue only once at a time
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_queue_entries_active_pet ON queue_entries (pet_id) WHERE status IN ('waiting', 'in_room');
+	CREATE INDEX IF NOT EXISTS idx_queue_entries_waiting ON queue_entries (triage_level, checked_in_at, id) WHERE status = 'waiting';
+
+	-- Full-text search: owners index their own columns; pets also index their owner's name
+	-- (kept current by triggers) so "grey cat smith" finds the pet in one query
+	ALTER TABLE owners ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', coalesce(name, '')), 'A') ||
+		setweight(to_tsvector('simple', coalesce(email, '') || ' ' || coalesce(contact, '')), 'B')
+	) STORED;
+	CREATE INDEX IF NOT EXISTS idx_owners_search ON owners USING GIN (search_vector);
+
+	ALTER TABLE pets ADD COLUMN IF NOT EXISTS search_vector tsvector;
+	CREATE INDEX IF NOT EXISTS idx_pets_search ON pets USING GIN (search_vector);
+
+	CREATE OR REPLACE FUNCTION pet_search_vector(p pets) RETURNS tsvector AS $$
+		SELECT setweight(to_tsvector('english', coalesce(p.name, '')), 'A') ||
+			setweight(to_tsvector('english', coalesce(p.species, '') || ' ' || coalesce(p.breed, '') || ' ' ||
+				coalesce(p.color, '') || ' ' || coalesce(p.markings, '')), 'B') ||
+			setweight(to_tsvector('english', coalesce((SELECT name FROM owners WHERE id = p.owner_id), '')), 'B') ||
+			setweight(to_tsvector('english', coalesce(p.medical_history, '')), 'C');
+	$$ LANGUAGE sql STABLE;
+
+	CREATE OR REPLACE FUNCTION pets_search_vector_update() RETURNS trigger AS $$
+	BEGIN
+		NEW.search_vector := pet_search_vector(NEW);
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS pets_search_vector ON pets;
+	CREATE TRIGGER pets_search_vector BEFORE INSERT OR UPDATE ON pets
+		FOR EACH ROW EXECUTE FUNCTION pets_search_vector_update();
+
+	CREATE OR REPLACE FUNCTION owners_search_vector_cascade() RETURNS trigger AS $$
+	BEGIN
+		UPDATE pets SET search_vector = pet_search_vector(pets) WHERE owner_id = NEW.id;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS owners_search_vector ON owners;
+	CREATE TRIGGER owners_search_vector AFTER UPDATE OF name ON owners
+		FOR EACH ROW WHEN (OLD.name IS DISTINCT FROM NEW.name) EXECUTE FUNCTION owners_search_vector_cascade();
+
+	-- Backfill new rows and pick up changes to what pet_search_vector indexes
+	UPDATE pets SET search_vector = pet_search_vector(pets) WHERE search_vector IS DISTINCT FROM pet_search_vector(pets);
+
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		occurred_at TIMESTAMPTZ NOT NULL,
+		actor_id INTEGER,
+		actor_role VARCHAR(20),
+		action VARCHAR(20) NOT NULL,
+		resource_type VARCHAR(50) NOT NULL,
+		resource_id INTEGER,
+		changes JSON,
+		ip VARCHAR(64),
+		request_id VARCHAR(64),
+		prev_hash VARCHAR(64) NOT NULL,
+		hash VARCHAR(64) NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_resource ON audit_log (resource_type, resource_id);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log (actor_id);
+
+	-- The audit log is append-only: reject any attempt to change or remove entries
+	CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_log is append-only';
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS audit_log_no_modify ON audit_log;
+	CREATE TRIGGER audit_log_no_modify BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+		FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();`
 
 	_, err := DB.Exec(schema)
 	return err
@@ -0,0 +1,104 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"petclinic/outbox"
+	"petclinic/utils"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	AppointmentCreated   = "appointment.created"
+	AppointmentCancelled = "appointment.cancelled"
+	AppointmentCheckedIn = "appointment.checked_in"
+	RecordUploaded       = "medical_record.uploaded"
+	QueueUpdated         = "queue.updated"
+)
+
+// Types lists every event type that can be published
+var Types = []string{AppointmentCreated, AppointmentCancelled, AppointmentCheckedIn, RecordUploaded, QueueUpdated}
+
+// KindEvent is the outbox message kind that carries a published Event
+const KindEvent = "event"
+
+// Event is something that happened in the clinic. PetID identifies the pet it concerns,
+// which decides who may see it. Seq orders events in the live stream by commit.
+type Event struct {
+	Seq       int64           `json:"-"`
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	PetID     int             `json:"pet_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Subscriber handles published events. Returning an error makes the outbox retry the event
+// for every subscriber, so subscribers must tolerate seeing an event more than once.
+type Subscriber func(evt Event) error
+
+var (
+	subscribersMu sync.RWMutex
+	subscribers   []Subscriber
+)
+
+func init() {
+	outbox.Register(KindEvent, dispatch)
+}
+
+// Subscribe adds a subscriber for all events
+func Subscribe(s Subscriber) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	subscribers = append(subscribers, s)
+}
+
+// Publish records an event in the event log and the outbox. Pass the transaction that makes the
+// change so the event is published if and only if the change commits.
+func Publish(ex outbox.Execer, eventType string, petID int, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return err
+	}
+
+	evt := Event{
+		ID:        "evt_" + id,
+		Type:      eventType,
+		PetID:     petID,
+		CreatedAt: time.Now().UTC(),
+		Data:      payload,
+	}
+
+	// The event log feeds live streams; its insert trigger notifies listeners on commit
+	if _, err := ex.Exec(
+		"INSERT INTO event_log (event_id, type, pet_id, data, created_at) VALUES ($1, $2, $3, $4, $5)",
+		evt.ID, evt.Type, evt.PetID, string(evt.Data), evt.CreatedAt,
+	); err != nil {
+		return err
+	}
+
+	return outbox.Enqueue(ex, KindEvent, evt)
+}
+
+// dispatch hands an event from the outbox to every subscriber
+func dispatch(payload json.RawMessage) error {
+	var evt Event
+	if err := json.Unmarshal(payload, &evt); err != nil {
+		return err
+	}
+
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+	for _, s := range subscribers {
+		if err := s(evt); err != nil {
+			return fmt.Errorf("%s %s: %w", evt.Type, evt.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package events
+
+import (
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/utils"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// notifyChannel is the PostgreSQL channel the event_log trigger notifies
+const notifyChannel = "clinic_events"
+
+// watcherBuffer is how many events a watcher may fall behind before it is disconnected
+const watcherBuffer = 64
+
+// replayLimit caps how many missed events are replayed when a stream resumes
+const replayLimit = 1000
+
+var (
+	watchersMu sync.Mutex
+	watchers   = map[chan Event]struct{}{}
+)
+
+// StartListener listens for events committed by any instance and passes them to watchers.
+// It keeps its own connection because LISTEN needs one that isn't shared through the pool.
+func StartListener() {
+	listener := pq.NewListener(config.GetDBConnectionString(), 10*time.Second, time.Minute,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				utils.LogMessage(config.LogError, "Event listener: "+err.Error())
+			}
+		})
+	if err := listener.Listen(notifyChannel); err != nil {
+		utils.LogMessage(config.LogError, "Failed to listen for events: "+err.Error())
+		return
+	}
+
+	go func() {
+		for n := range listener.Notify {
+			// nil means the connection was re-established; notifications in between are lost,
+			// so watchers are dropped and resume from their Last-Event-ID
+			if n == nil {
+				closeWatchers()
+				continue
+			}
+
+			seq, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				continue
+			}
+			evts, err := loadEvents("id = $1", seq)
+			if err != nil || len(evts) == 0 {
+				continue
+			}
+			broadcast(evts[0])
+		}
+	}()
+}
+
+// Watch returns a channel receiving every event committed from now on and a function to stop
+// watching. The channel is closed if the watcher falls too far behind or the listener reconnects.
+func Watch() (<-chan Event, func()) {
+	ch := make(chan Event, watcherBuffer)
+	watchersMu.Lock()
+	watchers[ch] = struct{}{}
+	watchersMu.Unlock()
+
+	return ch, func() {
+		watchersMu.Lock()
+		defer watchersMu.Unlock()
+		if _, ok := watchers[ch]; ok {
+			delete(watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Since returns up to replayLimit events committed after the one with seq, oldest first
+func Since(seq int64) ([]Event, error) {
+	return loadEvents("commit_seq > $1 ORDER BY commit_seq LIMIT "+strconv.Itoa(replayLimit), seq)
+}
+
+// broadcast sends an event to every watcher, dropping any that are full
+func broadcast(evt Event) {
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+	for ch := range watchers {
+		select {
+		case ch <- evt:
+		default:
+			delete(watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// closeWatchers drops every watcher
+func closeWatchers() {
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+	for ch := range watchers {
+		delete(watchers, ch)
+		close(ch)
+	}
+}
+
+// loadEvents reads event_log rows matching condition
+func loadEvents(condition string, args ...interface{}) ([]Event, error) {
+	rows, err := database.DB.Query("SELECT commit_seq, event_id, type, pet_id, data, created_at FROM event_log WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var evts []Event
+	for rows.Next() {
+		var evt Event
+		var data []byte
+		if err := rows.Scan(&evt.Seq, &evt.ID, &evt.Type, &evt.PetID, &data, &evt.CreatedAt); err != nil {
+			return nil, err
+		}
+		evt.Data = data
+		evts = append(evts, evt)
+	}
+	return evts, rows.Err()
+}
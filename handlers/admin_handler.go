@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/lockout"
+	"petclinic/middleware"
+	"petclinic/utils"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// UnlockAccountHandler clears failed login attempts for an account (staff only).
+// An optional ?ip= query parameter also clears the block on that client IP.
+func UnlockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ownerID, _ := strconv.Atoi(vars["id"])
+
+	var email string
+	err := database.DB.QueryRow("SELECT email FROM owners WHERE id = $1", ownerID).Scan(&email)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to unlock account")
+		return
+	}
+	defer tx.Rollback()
+
+	// The attempt store may not be Postgres, so the entry is written first and only
+	// committed once the unlock has happened
+	if !recordAudit(w, r, tx, "Failed to unlock account", audit.ActionUpdate, "owner", ownerID, nil, map[string]bool{"unlocked": true}) {
+		return
+	}
+
+	if err := lockout.Reset(lockout.AccountKey(email)); err != nil {
+		utils.LogMessage(config.LogError, "Failed to unlock account: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to unlock account")
+		return
+	}
+
+	if ip := r.URL.Query().Get("ip"); ip != "" {
+		if err := lockout.Reset(lockout.IPKey(ip)); err != nil {
+			utils.LogMessage(config.LogError, "Failed to unlock IP: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to unlock IP")
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit account unlock: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to unlock account")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Account unlocked: User=%d by Staff=%d", ownerID, middleware.GetUserIDFromRequest(r)))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Account unlocked successfully"})
+}
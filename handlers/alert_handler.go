@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/utils"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// alertColumns are the pet_alerts columns read by scanning helpers, in order
+const alertColumns = "id, pet_id, type, allergen_type, substance, description, severity, COALESCE(created_by, 0), created_at"
+
+// alertOrder sorts the most severe alerts first
+const alertOrder = "CASE severity WHEN 'high' THEN 0 WHEN 'moderate' THEN 1 ELSE 2 END, id"
+
+// CreatePetAlertHandler records an allergy or warning for a pet (owners and co-owners, or staff)
+func CreatePetAlertHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+
+	var alert models.PetAlert
+	if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if !utils.ContainsString(models.AlertTypes, alert.Type) {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid type. Must be one of "+strings.Join(models.AlertTypes, ", "))
+		return
+	}
+	if !utils.ContainsString(models.AlertSeverities, alert.Severity) {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid severity. Must be one of "+strings.Join(models.AlertSeverities, ", "))
+		return
+	}
+	alert.Substance = strings.TrimSpace(alert.Substance)
+	if alert.Type == "allergy" {
+		if !utils.ContainsString(models.AllergenTypes, alert.AllergenType) {
+			utils.RespondWithError(w, http.StatusBadRequest, "Invalid allergen_type. Must be one of "+strings.Join(models.AllergenTypes, ", "))
+			return
+		}
+		if alert.Substance == "" {
+			utils.RespondWithError(w, http.StatusBadRequest, "Substance is required for allergies")
+			return
+		}
+	} else {
+		alert.AllergenType, alert.Substance = "", ""
+		if alert.Description == "" {
+			utils.RespondWithError(w, http.StatusBadRequest, "Description is required")
+			return
+		}
+	}
+
+	userID := middleware.GetUserIDFromRequest(r)
+
+	if _, err := loadPet(petID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, petID, accessWrite) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	alert.PetID = petID
+	alert.CreatedBy = userID
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create alert")
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO pet_alerts (pet_id, type, allergen_type, substance, description, severity, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at
+	`, petID, alert.Type, alert.AllergenType, alert.Substance, alert.Description, alert.Severity, userID,
+	).Scan(&alert.ID, &alert.CreatedAt)
+
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create alert: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create alert")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to create alert", audit.ActionCreate, "pet_alert", alert.ID, nil, alert) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit alert: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create alert")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Pet alert created: ID=%d, Pet=%d, Type=%s, Severity=%s", alert.ID, petID, alert.Type, alert.Severity))
+	utils.RespondWithJSON(w, http.StatusCreated, alert)
+}
+
+// GetPetAlertsHandler lists a pet's alerts, most severe first
+func GetPetAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+
+	if _, err := loadPet(petID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, petID, accessRead) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	alerts, err := loadPetAlerts(petID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch alerts: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch alerts")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, alerts[petID])
+}
+
+// DeletePetAlertHandler removes an alert that no longer applies (staff only)
+func DeletePetAlertHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+	alertID, _ := strconv.Atoi(vars["alert_id"])
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete alert")
+		return
+	}
+	defer tx.Rollback()
+
+	var before models.PetAlert
+	err = tx.QueryRow("SELECT "+alertColumns+" FROM pet_alerts WHERE id = $1 AND pet_id = $2 FOR UPDATE", alertID, petID).Scan(
+		&before.ID, &before.PetID, &before.Type, &before.AllergenType, &before.Substance, &before.Description,
+		&before.Severity, &before.CreatedBy, &before.CreatedAt)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Alert not found")
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM pet_alerts WHERE id = $1", alertID); err != nil {
+		utils.LogMessage(config.LogError, "Failed to delete alert: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete alert")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to delete alert", audit.ActionDelete, "pet_alert", alertID, before, nil) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit alert deletion: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete alert")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Pet alert deleted: ID=%d, Pet=%d", alertID, petID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Alert deleted successfully"})
+}
+
+// CheckDrugAllergyHandler reports the pet's drug allergies that match a drug about to be prescribed.
+// "blocked" is true when any match is high severity, in which case CreatePrescriptionHandler refuses
+// the drug without an override.
+func CheckDrugAllergyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+
+	var req models.AllergyCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Drug) == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Drug is required")
+		return
+	}
+
+	if _, err := loadPet(petID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+
+	conflicts, err := drugAllergyConflicts(petID, req.Drug)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to check drug allergies: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to check drug allergies")
+		return
+	}
+
+	blocked := allergyBlocks(conflicts)
+	if len(conflicts) > 0 {
+		utils.LogMessage(config.LogWarn, fmt.Sprintf("Drug allergy warning: Pet=%d, Drug=%s, Matches=%d, Blocked=%t", petID, req.Drug, len(conflicts), blocked))
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"drug":      req.Drug,
+		"conflicts": conflicts,
+		"blocked":   blocked,
+	})
+}
+
+// allergyBlocks reports whether any of the matched allergies is high severity, which stops the
+// drug being prescribed without an override
+func allergyBlocks(conflicts []models.PetAlert) bool {
+	for _, alert := range conflicts {
+		if alert.Severity == "high" {
+			return true
+		}
+	}
+	return false
+}
+
+// drugAllergyConflicts returns the pet's drug allergies whose substance appears in drug as whole
+// words or vice versa, so "Amoxicillin 250mg" matches an "amoxicillin" allergy but "pen" does not
+// match "penicillin"
+func drugAllergyConflicts(petID int, drug string) ([]models.PetAlert, error) {
+	alerts, err := loadPetAlerts(petID)
+	if err != nil {
+		return nil, err
+	}
+
+	drugWords := alertWords(drug)
+	conflicts := []models.PetAlert{}
+	for _, alert := range alerts[petID] {
+		if alert.Type != "allergy" || alert.AllergenType != "drug" {
+			continue
+		}
+		substanceWords := alertWords(alert.Substance)
+		if containsWords(drugWords, substanceWords) || containsWords(substanceWords, drugWords) {
+			conflicts = append(conflicts, alert)
+		}
+	}
+	return conflicts, nil
+}
+
+// alertWords splits s into lower-case runs of letters and digits
+func alertWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// containsWords reports whether words contains the non-empty sequence want, in order and adjacent
+func containsWords(words, want []string) bool {
+	if len(want) == 0 {
+		return false
+	}
+	for i := 0; i+len(want) <= len(words); i++ {
+		match := true
+		for j, w := range want {
+			if words[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// loadPetAlerts returns the alerts for each of the given pets, most severe first
+func loadPetAlerts(petIDs ...int) (map[int][]models.PetAlert, error) {
+	alerts := make(map[int][]models.PetAlert, len(petIDs))
+	for _, id := range petIDs {
+		alerts[id] = []models.PetAlert{}
+	}
+	if len(petIDs) == 0 {
+		return alerts, nil
+	}
+
+	rows, err := database.DB.Query("SELECT "+alertColumns+" FROM pet_alerts WHERE pet_id = ANY($1) ORDER BY "+alertOrder, pq.Array(petIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alert models.PetAlert
+		if err := rows.Scan(&alert.ID, &alert.PetID, &alert.Type, &alert.AllergenType, &alert.Substance,
+			&alert.Description, &alert.Severity, &alert.CreatedBy, &alert.CreatedAt); err != nil {
+			return nil, err
+		}
+		alerts[alert.PetID] = append(alerts[alert.PetID], alert)
+	}
+	return alerts, rows.Err()
+}
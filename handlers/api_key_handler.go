@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// CreateAPIKeyHandler creates an API key acting as the current user; the key is only shown once
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if req.Name == "" || len(req.Scopes) == 0 {
+		utils.RespondWithError(w, http.StatusBadRequest, "Name and at least one scope are required")
+		return
+	}
+
+	for _, scope := range req.Scopes {
+		if !utils.ContainsString(models.APIKeyScopes, scope) {
+			utils.RespondWithError(w, http.StatusBadRequest, "Invalid scope: "+scope+". Must be one of "+strings.Join(models.APIKeyScopes, ", "))
+			return
+		}
+	}
+
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		utils.RespondWithError(w, http.StatusBadRequest, "Expiry must be in the future")
+		return
+	}
+
+	userID := middleware.GetUserIDFromRequest(r)
+
+	prefix, err := utils.GenerateToken(6)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+	secret, err := utils.GenerateToken(32)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+	// Underscores separate the key's parts, so keep them out of the prefix
+	prefix = strings.NewReplacer("_", "x", "-", "y").Replace(prefix)
+
+	key := models.APIKey{
+		OwnerID:   userID,
+		Name:      req.Name,
+		Prefix:    prefix,
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO api_keys (owner_id, name, prefix, key_hash, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at",
+		userID, req.Name, prefix, utils.HashToken(secret), pq.Array(req.Scopes), req.ExpiresAt,
+	).Scan(&key.ID, &key.CreatedAt)
+
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create API key: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to create API key", audit.ActionCreate, "api_key", key.ID, nil, key) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit API key: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("API key created: ID=%d, Prefix=%s, Owner=%d", key.ID, prefix, userID))
+	utils.RespondWithJSON(w, http.StatusCreated, map[string]interface{}{
+		"api_key": key,
+		"key":     middleware.APIKeyPrefix + prefix + "_" + secret,
+		"message": "Store this key now; it cannot be shown again",
+	})
+}
+
+// GetAPIKeysHandler lists the current user's API keys (staff may pass ?all=true to list every key).
+// Sort: created_at, id, name (prefix "-" for descending); limit, cursor.
+func GetAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserIDFromRequest(r)
+	role := middleware.GetUserRoleFromRequest(r)
+
+	lq, err := newListQuery(r, listOptions{
+		sortColumns: map[string]string{"created_at": "created_at", "id": "id", "name": "name"},
+		defaultSort: "-created_at",
+		idColumn:    "id",
+	})
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if role != "staff" || r.URL.Query().Get("all") != "true" {
+		lq.filter("owner_id =", userID)
+	}
+
+	keys := []models.APIKey{}
+	total, next, err := lq.run("id, owner_id, name, prefix, scopes, expires_at, last_used_at, revoked_at, created_at", "api_keys", func(rows *sql.Rows, sortKey *string) (int, error) {
+		var key models.APIKey
+		if err := rows.Scan(sortKey, &key.ID, &key.OwnerID, &key.Name, &key.Prefix, pq.Array(&key.Scopes),
+			&key.ExpiresAt, &key.LastUsedAt, &key.RevokedAt, &key.CreatedAt); err != nil {
+			return 0, err
+		}
+		keys = append(keys, key)
+		return key.ID, nil
+	})
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch API keys: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch API keys")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, models.Page{Items: keys, NextCursor: next, TotalCount: total})
+}
+
+// RevokeAPIKeyHandler revokes an API key owned by the current user (staff may revoke any key)
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	keyID, _ := strconv.Atoi(vars["id"])
+
+	userID := middleware.GetUserIDFromRequest(r)
+	role := middleware.GetUserRoleFromRequest(r)
+
+	// Check ownership
+	var ownerID int
+	err := database.DB.QueryRow("SELECT owner_id FROM api_keys WHERE id = $1", keyID).Scan(&ownerID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "API key not found")
+		return
+	}
+	if role != "staff" && ownerID != userID {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to revoke API key")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", keyID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to revoke API key: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to revoke API key")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondWithError(w, http.StatusBadRequest, "API key is already revoked")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to revoke API key", audit.ActionUpdate, "api_key", keyID, nil, map[string]bool{"revoked": true}) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit API key revocation: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to revoke API key")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("API key revoked: ID=%d by User=%d", keyID, userID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "API key revoked successfully"})
+}
@@ -5,12 +5,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"petclinic/audit"
 	"petclinic/config"
 	"petclinic/database"
+	"petclinic/events"
 	"petclinic/middleware"
 	"petclinic/models"
 	"petclinic/utils"
+	"petclinic/waitlist"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -29,33 +34,49 @@ func CreateAppointmentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID := middleware.GetUserIDFromRequest(r)
-	role := middleware.GetUserRoleFromRequest(r)
+	pet, err := loadPet(appointment.PetID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
 
-	// Check if user owns the pet (unless staff)
-	if role != "staff" {
-		var ownerID int
-		err := database.DB.QueryRow("SELECT owner_id FROM pets WHERE id = $1", appointment.PetID).Scan(&ownerID)
-		if err != nil {
-			utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
-			return
-		}
-		if ownerID != userID {
-			utils.RespondWithError(w, http.StatusForbidden, "Access denied - you don't own this pet")
-			return
-		}
+	// Owners, co-owners and caretakers with booking rights can book (as can staff)
+	if !canAccessPet(r, appointment.PetID, accessBook) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied - you can't book for this pet")
+		return
+	}
+
+	if pet.Deceased {
+		utils.RespondWithError(w, http.StatusConflict, "Cannot book an appointment for a deceased pet")
+		return
 	}
 
+	// Series occurrences are booked through /api/appointments/series
+	appointment.SeriesID, appointment.SeriesException = nil, false
+
 	// Default status
 	if appointment.Status == "" {
 		appointment.Status = "scheduled"
 	}
+	if !validAppointmentStatus(r, appointment.Status) {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid status")
+		return
+	}
+	appointment.Vet = strings.TrimSpace(appointment.Vet)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create appointment")
+		return
+	}
+	defer tx.Rollback()
 
 	// Insert appointment
 	var id int
-	err := database.DB.QueryRow(
-		"INSERT INTO appointments (pet_id, date, reason, status) VALUES ($1, $2, $3, $4) RETURNING id",
-		appointment.PetID, appointment.Date, appointment.Reason, appointment.Status,
+	err = tx.QueryRow(
+		"INSERT INTO appointments (pet_id, date, reason, vet, status) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		appointment.PetID, appointment.Date, appointment.Reason, appointment.Vet, appointment.Status,
 	).Scan(&id)
 
 	if err != nil {
@@ -65,53 +86,92 @@ func CreateAppointmentHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	appointment.ID = id
+	if err := events.Publish(tx, events.AppointmentCreated, appointment.PetID, appointment); err != nil {
+		utils.LogMessage(config.LogError, "Failed to publish appointment event: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create appointment")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to create appointment", audit.ActionCreate, "appointment", id, nil, appointment) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit appointment: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create appointment")
+		return
+	}
+
 	utils.LogMessage(config.LogInfo, fmt.Sprintf("Appointment created: ID=%d, Pet=%d", id, appointment.PetID))
 	utils.RespondWithJSON(w, http.StatusCreated, appointment)
 }
 
-// GetAppointmentsHandler retrieves all appointments (filtered by ownership for non-staff)
+// GetAppointmentsHandler lists appointments (only those for pets the caller is a guardian of for non-staff users).
+// Filters: pet_id, status, from, to (RFC 3339); sort: date, id, status (prefix "-" for descending); limit, cursor.
 func GetAppointmentsHandler(w http.ResponseWriter, r *http.Request) {
 	userID := middleware.GetUserIDFromRequest(r)
 	role := middleware.GetUserRoleFromRequest(r)
 
-	var rows *sql.Rows
-	var err error
-
-	if role == "staff" {
-		// Staff can see all appointments
-		rows, err = database.DB.Query(`
-			SELECT id, pet_id, date, reason, status 
-			FROM appointments 
-			ORDER BY date DESC
-		`)
-	} else {
-		// Owners can only see appointments for their pets
-		rows, err = database.DB.Query(`
-			SELECT a.id, a.pet_id, a.date, a.reason, a.status 
-			FROM appointments a 
-			JOIN pets p ON a.pet_id = p.id 
-			WHERE p.owner_id = $1 
-			ORDER BY a.date DESC
-		`, userID)
+	lq, err := newListQuery(r, listOptions{
+		sortColumns: map[string]string{"date": "a.date", "id": "a.id", "status": "a.status"},
+		defaultSort: "-date",
+		idColumn:    "a.id",
+	})
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	if err != nil {
-		utils.LogMessage(config.LogError, "Failed to fetch appointments: "+err.Error())
-		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch appointments")
+	lq.where("a.deleted_at IS NULL")
+	if role != "staff" {
+		// Owners can only see appointments for pets they are a guardian of
+		lq.where(guardianPetsCondition("a.pet_id", lq.arg(userID)))
+	}
+	if err := lq.filterInt(r, "pet_id", "a.pet_id ="); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer rows.Close()
+	if v := r.URL.Query().Get("status"); v != "" {
+		lq.filter("a.status =", v)
+	}
+	for _, f := range []struct{ param, expr string }{{"from", "a.date >="}, {"to", "a.date <"}} {
+		if err := lq.filterTime(r, f.param, f.expr); err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
 
 	appointments := []models.Appointment{}
-	for rows.Next() {
+	total, next, err := lq.run("a.id, a.pet_id, a.date, a.reason, a.vet, a.status, a.series_id, a.series_exception", "appointments a JOIN pets p ON a.pet_id = p.id", func(rows *sql.Rows, sortKey *string) (int, error) {
 		var apt models.Appointment
-		if err := rows.Scan(&apt.ID, &apt.PetID, &apt.Date, &apt.Reason, &apt.Status); err != nil {
-			continue
+		if err := rows.Scan(sortKey, &apt.ID, &apt.PetID, &apt.Date, &apt.Reason, &apt.Vet, &apt.Status, &apt.SeriesID, &apt.SeriesException); err != nil {
+			return 0, err
 		}
 		appointments = append(appointments, apt)
+		return apt.ID, nil
+	})
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch appointments: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch appointments")
+		return
+	}
+
+	// Attach each pet's alerts with one query for the whole page
+	petIDs := make([]int, 0, len(appointments))
+	for _, apt := range appointments {
+		petIDs = append(petIDs, apt.PetID)
+	}
+	alerts, err := loadPetAlerts(petIDs...)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch pet alerts: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch appointments")
+		return
+	}
+	for i := range appointments {
+		appointments[i].Alerts = alerts[appointments[i].PetID]
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, appointments)
+	utils.RespondWithJSON(w, http.StatusOK, models.Page{Items: appointments, NextCursor: next, TotalCount: total})
 }
 
 // GetAppointmentByIDHandler retrieves a specific appointment
@@ -119,72 +179,102 @@ func GetAppointmentByIDHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	aptID, _ := strconv.Atoi(vars["id"])
 
-	userID := middleware.GetUserIDFromRequest(r)
-	role := middleware.GetUserRoleFromRequest(r)
-
-	var appointment models.Appointment
-	var ownerID int
-
-	err := database.DB.QueryRow(`
-		SELECT a.id, a.pet_id, a.date, a.reason, a.status, p.owner_id
-		FROM appointments a
-		JOIN pets p ON a.pet_id = p.id
-		WHERE a.id = $1
-	`, aptID).Scan(&appointment.ID, &appointment.PetID, &appointment.Date, &appointment.Reason, &appointment.Status, &ownerID)
-
+	appointment, err := loadAppointment(aptID)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusNotFound, "Appointment not found")
 		return
 	}
 
-	// Check ownership
-	if role != "staff" && ownerID != userID {
+	// Check access
+	if !canAccessPet(r, appointment.PetID, accessRead) {
 		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
 		return
 	}
 
+	alerts, err := loadPetAlerts(appointment.PetID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch pet alerts: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch appointment")
+		return
+	}
+	appointment.Alerts = alerts[appointment.PetID]
+
 	utils.RespondWithJSON(w, http.StatusOK, appointment)
 }
 
-// UpdateAppointmentHandler updates an existing appointment
+// UpdateAppointmentHandler updates an existing appointment; omitted fields keep their current values.
+// A cancelled appointment can be reinstated only while its slot hasn't been claimed from the waitlist.
 func UpdateAppointmentHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	aptID, _ := strconv.Atoi(vars["id"])
 
-	var appointment models.Appointment
+	before, err := loadAppointment(aptID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Appointment not found")
+		return
+	}
+
+	// Check access
+	if !canAccessPet(r, before.PetID, accessBook) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	// Decode over a copy of the current appointment; the series ID pointer is dropped first so
+	// a client-sent series_id can't write through it
+	appointment := before
+	appointment.SeriesID = nil
 	if err := json.NewDecoder(r.Body).Decode(&appointment); err != nil {
 		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
 		return
 	}
+	appointment.Vet = strings.TrimSpace(appointment.Vet)
 
-	userID := middleware.GetUserIDFromRequest(r)
-	role := middleware.GetUserRoleFromRequest(r)
+	if appointment.Status != before.Status && !validAppointmentStatus(r, appointment.Status) {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid status")
+		return
+	}
+	// Reinstating or keeping a booking active for a deceased pet is a new booking in all but name
+	if utils.ContainsString(models.ActiveAppointmentStatuses, appointment.Status) {
+		pet, err := loadPet(before.PetID)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+			return
+		}
+		if pet.Deceased {
+			utils.RespondWithError(w, http.StatusConflict, "Cannot book an appointment for a deceased pet")
+			return
+		}
+	}
 
-	// Check ownership
-	if role != "staff" {
-		var ownerID int
-		err := database.DB.QueryRow(`
-			SELECT p.owner_id 
-			FROM appointments a 
-			JOIN pets p ON a.pet_id = p.id 
-			WHERE a.id = $1
-		`, aptID).Scan(&ownerID)
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment")
+		return
+	}
+	defer tx.Rollback()
 
-		if err != nil {
-			utils.RespondWithError(w, http.StatusNotFound, "Appointment not found")
+	// Reinstating a cancelled booking takes its slot back from the waitlist
+	if before.Status == "cancelled" && appointment.Status != "cancelled" {
+		err := waitlist.ReclaimSlot(tx, aptID)
+		if err == waitlist.ErrSlotClaimed {
+			utils.RespondWithError(w, http.StatusConflict, "The slot has been booked from the waitlist")
 			return
 		}
-		if ownerID != userID {
-			utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		if err != nil {
+			utils.LogMessage(config.LogError, "Failed to withdraw waitlist offer: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment")
 			return
 		}
 	}
 
-	// Update appointment
-	result, err := database.DB.Exec(
-		"UPDATE appointments SET date=$1, reason=$2, status=$3 WHERE id=$4",
-		appointment.Date, appointment.Reason, appointment.Status, aptID,
-	)
+	// Update appointment; changing one occurrence of a series makes it an exception to the series
+	result, err := tx.Exec(`
+		UPDATE appointments SET date = $1, reason = $2, vet = $3, status = $4,
+			series_exception = series_exception OR (series_id IS NOT NULL AND (date, reason, status) IS DISTINCT FROM ($1, $2, $4))
+		WHERE id = $5 AND deleted_at IS NULL
+	`, appointment.Date, appointment.Reason, appointment.Vet, appointment.Status, aptID)
 
 	if err != nil {
 		utils.LogMessage(config.LogError, "Failed to update appointment: "+err.Error())
@@ -198,6 +288,37 @@ func UpdateAppointmentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	appointment.ID = aptID
+	appointment.PetID = before.PetID
+	appointment.SeriesID = before.SeriesID
+	statusEvents := map[string]string{"cancelled": events.AppointmentCancelled, "checked_in": events.AppointmentCheckedIn}
+	if eventType, ok := statusEvents[appointment.Status]; ok && appointment.Status != before.Status {
+		if err := events.Publish(tx, eventType, appointment.PetID, appointment); err != nil {
+			utils.LogMessage(config.LogError, "Failed to publish appointment event: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment")
+			return
+		}
+	}
+
+	// A cancelled slot goes to the waitlist
+	if appointment.Status == "cancelled" && before.Status != "cancelled" {
+		if err := waitlist.OfferSlot(tx, aptID); err != nil {
+			utils.LogMessage(config.LogError, "Failed to offer slot to waitlist: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment")
+			return
+		}
+	}
+
+	if !recordAudit(w, r, tx, "Failed to update appointment", audit.ActionUpdate, "appointment", aptID, before, appointment) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit appointment: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment")
+		return
+	}
+
 	utils.LogMessage(config.LogInfo, fmt.Sprintf("Appointment updated: ID=%d", aptID))
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Appointment updated successfully"})
 }
@@ -208,30 +329,33 @@ func DeleteAppointmentHandler(w http.ResponseWriter, r *http.Request) {
 	aptID, _ := strconv.Atoi(vars["id"])
 
 	userID := middleware.GetUserIDFromRequest(r)
-	role := middleware.GetUserRoleFromRequest(r)
 
-	// Check ownership
-	if role != "staff" {
-		var ownerID int
-		err := database.DB.QueryRow(`
-			SELECT p.owner_id 
-			FROM appointments a 
-			JOIN pets p ON a.pet_id = p.id 
-			WHERE a.id = $1
-		`, aptID).Scan(&ownerID)
+	before, err := loadAppointment(aptID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Appointment not found")
+		return
+	}
 
-		if err != nil {
-			utils.RespondWithError(w, http.StatusNotFound, "Appointment not found")
-			return
-		}
-		if ownerID != userID {
-			utils.RespondWithError(w, http.StatusForbidden, "Access denied")
-			return
-		}
+	// Check access
+	if !canAccessPet(r, before.PetID, accessBook) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
 	}
 
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete appointment")
+		return
+	}
+	defer tx.Rollback()
+
 	// Delete appointment
-	result, err := database.DB.Exec("DELETE FROM appointments WHERE id = $1", aptID)
+	// Soft delete; the purge job removes the row after the retention period
+	result, err := tx.Exec(
+		"UPDATE appointments SET deleted_at = NOW(), deleted_by = $1 WHERE id = $2 AND deleted_at IS NULL",
+		userID, aptID,
+	)
 	if err != nil {
 		utils.LogMessage(config.LogError, "Failed to delete appointment: "+err.Error())
 		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete appointment")
@@ -244,6 +368,88 @@ func DeleteAppointmentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Deleting a booking cancels it as far as subscribers are concerned, and frees its slot for the waitlist
+	if before.Status != "cancelled" {
+		if err := events.Publish(tx, events.AppointmentCancelled, before.PetID, before); err != nil {
+			utils.LogMessage(config.LogError, "Failed to publish appointment event: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete appointment")
+			return
+		}
+		if err := waitlist.OfferSlot(tx, aptID); err != nil {
+			utils.LogMessage(config.LogError, "Failed to offer slot to waitlist: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete appointment")
+			return
+		}
+	}
+
+	if !recordAudit(w, r, tx, "Failed to delete appointment", audit.ActionDelete, "appointment", aptID, before, nil) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit appointment delete: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete appointment")
+		return
+	}
+
 	utils.LogMessage(config.LogInfo, fmt.Sprintf("Appointment deleted: ID=%d", aptID))
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Appointment deleted successfully"})
-}
\ No newline at end of file
+}
+
+// GetAppointmentRemindersHandler lists the reminders sent (or being sent) for an appointment (staff only)
+func GetAppointmentRemindersHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	aptID, _ := strconv.Atoi(vars["id"])
+
+	if _, err := loadAppointment(aptID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Appointment not found")
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT appointment_id, appointment_date, offset_seconds, channel, status, attempts, last_error, sent_at, created_at
+		FROM appointment_reminders
+		WHERE appointment_id = $1
+		ORDER BY created_at, id
+	`, aptID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch reminders: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch reminders")
+		return
+	}
+	defer rows.Close()
+
+	reminders := []models.AppointmentReminder{}
+	for rows.Next() {
+		var reminder models.AppointmentReminder
+		var offsetSeconds int64
+		if err := rows.Scan(&reminder.AppointmentID, &reminder.AppointmentDate, &offsetSeconds, &reminder.Channel,
+			&reminder.Status, &reminder.Attempts, &reminder.LastError, &reminder.SentAt, &reminder.CreatedAt); err != nil {
+			continue
+		}
+		reminder.Offset = (time.Duration(offsetSeconds) * time.Second).String()
+		reminders = append(reminders, reminder)
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, reminders)
+}
+
+// validAppointmentStatus reports whether the caller may set an appointment to status
+func validAppointmentStatus(r *http.Request, status string) bool {
+	if middleware.GetUserRoleFromRequest(r) == "staff" {
+		return utils.ContainsString(models.AppointmentStatuses, status)
+	}
+	return utils.ContainsString(models.OwnerAppointmentStatuses, status)
+}
+
+// loadAppointment fetches an appointment that has not been deleted
+func loadAppointment(aptID int) (models.Appointment, error) {
+	var appointment models.Appointment
+	err := database.DB.QueryRow(`
+		SELECT id, pet_id, date, reason, vet, status, series_id, series_exception
+		FROM appointments
+		WHERE id = $1 AND deleted_at IS NULL
+	`, aptID).Scan(&appointment.ID, &appointment.PetID, &appointment.Date, &appointment.Reason, &appointment.Vet, &appointment.Status,
+		&appointment.SeriesID, &appointment.SeriesException)
+	return appointment, err
+}
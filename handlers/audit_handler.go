@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/models"
+	"petclinic/utils"
+)
+
+// GetAuditLogHandler queries the audit log, newest first (staff only).
+// Filters: actor_id, action, resource_type, resource_id, from, to (RFC 3339); limit (default 100, max 1000), cursor.
+func GetAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	lq, err := newListQuery(r, listOptions{
+		sortColumns: map[string]string{"id": "id"},
+		defaultSort: "-id",
+		idColumn:    "id",
+		defaultSize: 100,
+		maxSize:     1000,
+	})
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	for _, param := range []string{"actor_id", "resource_id"} {
+		if err := lq.filterInt(r, param, param+" ="); err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if v := q.Get("action"); v != "" {
+		lq.filter("action =", v)
+	}
+	if v := q.Get("resource_type"); v != "" {
+		lq.filter("resource_type =", v)
+	}
+	for _, f := range []struct{ param, expr string }{{"from", "occurred_at >="}, {"to", "occurred_at <"}} {
+		if err := lq.filterTime(r, f.param, f.expr); err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	entries := []audit.Entry{}
+	total, next, err := lq.run("id, occurred_at, actor_id, actor_role, action, resource_type, resource_id, changes, ip, request_id, prev_hash, hash", "audit_log", func(rows *sql.Rows, sortKey *string) (int, error) {
+		var e audit.Entry
+		var changes []byte
+		if err := rows.Scan(sortKey, &e.ID, &e.OccurredAt, &e.ActorID, &e.ActorRole, &e.Action, &e.ResourceType,
+			&e.ResourceID, &changes, &e.IP, &e.RequestID, &e.PrevHash, &e.Hash); err != nil {
+			return 0, err
+		}
+		e.Changes = changes
+		entries = append(entries, e)
+		return int(e.ID), nil
+	})
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch audit log: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch audit log")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, models.Page{Items: entries, NextCursor: next, TotalCount: total})
+}
+
+// VerifyAuditLogHandler checks the audit log's hash chain for tampering (staff only)
+func VerifyAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	checked, firstInvalid, err := audit.Verify()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to verify audit log: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to verify audit log")
+		return
+	}
+
+	if firstInvalid != 0 {
+		utils.LogMessage(config.LogError, fmt.Sprintf("Audit log chain broken at entry %d", firstInvalid))
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"valid":            firstInvalid == 0,
+		"entries_checked":  checked,
+		"first_invalid_id": firstInvalid,
+	})
+}
+
+// recordAudit writes an audit entry in tx ahead of its commit. If that fails it responds
+// with 500 and failMessage and returns false, so the change is rolled back unaudited.
+func recordAudit(w http.ResponseWriter, r *http.Request, tx *sql.Tx, failMessage, action, resourceType string, resourceID int, before, after interface{}) bool {
+	if err := audit.Record(tx, r, action, resourceType, resourceID, before, after); err != nil {
+		utils.LogMessage(config.LogError, fmt.Sprintf("Failed to write audit entry (%s %s %d): %s", action, resourceType, resourceID, err.Error()))
+		utils.RespondWithError(w, http.StatusInternalServerError, failMessage)
+		return false
+	}
+	return true
+}
+
+// recordAccess audits a read of sensitive data, responding with 500 and failMessage if it
+// can't be recorded so the data is never served unaudited
+func recordAccess(w http.ResponseWriter, r *http.Request, failMessage, action, resourceType string, resourceID int) bool {
+	if err := audit.RecordAccess(r, action, resourceType, resourceID); err != nil {
+		utils.LogMessage(config.LogError, fmt.Sprintf("Failed to write audit entry (%s %s %d): %s", action, resourceType, resourceID, err.Error()))
+		utils.RespondWithError(w, http.StatusInternalServerError, failMessage)
+		return false
+	}
+	return true
+}
@@ -6,8 +6,12 @@ import (
 	"net/http"
 	"petclinic/config"
 	"petclinic/database"
+	"petclinic/jwtkeys"
+	"petclinic/lockout"
+	"petclinic/middleware"
 	"petclinic/models"
 	"petclinic/utils"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -48,10 +52,18 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Registration failed")
+		return
+	}
+	defer tx.Rollback()
+
 	// Insert user into database
 	var id int
-	err = database.DB.QueryRow(
-		"INSERT INTO owners (name, contact, email, password, role) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+	err = tx.QueryRow(
+		"INSERT INTO owners (name, contact, email, password, role, email_verified) VALUES ($1, $2, $3, $4, $5, FALSE) RETURNING id",
 		user.Name, user.Contact, user.Email, string(hashedPassword), user.Role,
 	).Scan(&id)
 
@@ -61,14 +73,31 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := sendVerificationEmail(tx, id, user.Email); err != nil {
+		utils.LogMessage(config.LogError, "Failed to queue verification email: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Registration failed")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit registration: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Registration failed")
+		return
+	}
+
 	utils.LogMessage(config.LogInfo, fmt.Sprintf("User registered: %s (%s)", user.Email, user.Role))
 	utils.RespondWithJSON(w, http.StatusCreated, map[string]interface{}{
-		"message": "User registered successfully",
-		"user_id": id,
-		"role":    user.Role,
+		"message":        "User registered successfully. Please check your email to verify your account",
+		"user_id":        id,
+		"role":           user.Role,
+		"email_verified": false,
 	})
 }
 
+// dummyPasswordHash is compared against when no account matches, so failed logins take
+// the same time whether or not the email exists
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
 // LoginHandler handles user login and JWT token generation
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var credentials models.LoginRequest
@@ -84,15 +113,24 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Refuse attempts while the account or client IP is backing off
+	attempt := beginLoginAttempt(w, lockout.AccountKey(credentials.Email), lockout.IPKey(middleware.GetClientIP(r)))
+	if attempt == nil {
+		return
+	}
+
 	// Fetch user from database
 	var id int
-	var hashedPassword, role, name string
+	var mfaEnabled bool
+	var hashedPassword, role string
 	err := database.DB.QueryRow(
-		"SELECT id, password, role, name FROM owners WHERE email = $1",
+		"SELECT id, password, role, mfa_enabled FROM owners WHERE email = $1",
 		credentials.Email,
-	).Scan(&id, &hashedPassword, &role, &name)
+	).Scan(&id, &hashedPassword, &role, &mfaEnabled)
 
 	if err != nil {
+		// Compare against a dummy hash so unknown emails take as long as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(credentials.Password))
 		utils.LogMessage(config.LogWarn, "Login failed for: "+credentials.Email)
 		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid credentials")
 		return
@@ -105,29 +143,163 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, models.Claims{
-		UserID: id,
-		Email:  credentials.Email,
-		Role:   role,
+	// Second step: the password alone is not enough for accounts with two-factor authentication
+	if mfaEnabled || config.IsMFARequired(role) {
+		attempt.release()
+	}
+	if mfaEnabled {
+		respondWithMFAToken(w, id, models.PurposeMFAChallenge, "mfa_required")
+		return
+	}
+	if config.IsMFARequired(role) {
+		utils.LogMessage(config.LogInfo, fmt.Sprintf("Two-factor enrollment required: User=%d", id))
+		respondWithMFAToken(w, id, models.PurposeMFAEnroll, "mfa_enrollment_required")
+		return
+	}
+
+	attempt.succeed()
+	respondWithSession(w, id)
+}
+
+// loginAttempt is a login already counted as a failure against the account and client IP.
+// Failed attempts need no further bookkeeping; successful ones must call release or succeed.
+type loginAttempt struct {
+	accountKey string
+	account    *lockout.Reservation
+	ip         *lockout.Reservation
+}
+
+// beginLoginAttempt reserves an attempt for the account and client IP. It responds with 429
+// and returns nil if either is backing off.
+func beginLoginAttempt(w http.ResponseWriter, accountKey, ipKey string) *loginAttempt {
+	fail := func(err error) *loginAttempt {
+		utils.LogMessage(config.LogError, "Failed to check login attempts: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Login failed")
+		return nil
+	}
+
+	account, wait, err := lockout.Reserve(accountKey, lockout.AccountPolicy)
+	if err != nil {
+		return fail(err)
+	}
+	if account != nil {
+		var ip *lockout.Reservation
+		ip, wait, err = lockout.Reserve(ipKey, lockout.IPPolicy)
+		if err != nil || ip == nil {
+			if releaseErr := account.Release(); releaseErr != nil {
+				utils.LogMessage(config.LogWarn, "Failed to release login attempt: "+releaseErr.Error())
+			}
+			if err != nil {
+				return fail(err)
+			}
+		} else {
+			return &loginAttempt{accountKey: accountKey, account: account, ip: ip}
+		}
+	}
+
+	utils.LogMessage(config.LogWarn, fmt.Sprintf("Throttled login: %s %s", accountKey, ipKey))
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	utils.RespondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts. Try again later")
+	return nil
+}
+
+// release gives back both reservations, for a correct password that still needs a second step
+func (a *loginAttempt) release() {
+	for _, reservation := range []*lockout.Reservation{a.account, a.ip} {
+		if err := reservation.Release(); err != nil {
+			utils.LogMessage(config.LogWarn, "Failed to release login attempt: "+err.Error())
+		}
+	}
+}
+
+// succeed clears the account's failed attempts and gives back the client IP's reservation
+func (a *loginAttempt) succeed() {
+	if err := lockout.Reset(a.accountKey); err != nil {
+		utils.LogMessage(config.LogWarn, "Failed to reset login attempts: "+err.Error())
+	}
+	if err := a.ip.Release(); err != nil {
+		utils.LogMessage(config.LogWarn, "Failed to release login attempt: "+err.Error())
+	}
+}
+
+// generateToken signs a JWT for the user with the given purpose and lifetime
+func generateToken(userID int, email, role string, tokenVersion int, purpose string, ttl time.Duration) (string, error) {
+	return jwtkeys.Sign(models.Claims{
+		UserID:       userID,
+		Email:        email,
+		Role:         role,
+		TokenVersion: tokenVersion,
+		Purpose:      purpose,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	})
+}
+
+// respondWithSession issues a regular access token for the user and writes the login response
+func respondWithSession(w http.ResponseWriter, userID int) {
+	session, err := newSession(userID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create session: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Login failed")
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, session)
+}
+
+// newSession issues a regular access token for the user and returns the login response body
+func newSession(userID int) (map[string]interface{}, error) {
+	var tokenVersion int
+	var emailVerified bool
+	var email, role, name string
+	err := database.DB.QueryRow(
+		"SELECT email, role, name, token_version, email_verified FROM owners WHERE id = $1",
+		userID,
+	).Scan(&email, &role, &name, &tokenVersion, &emailVerified)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenString, err := generateToken(userID, email, role, tokenVersion, "", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("User logged in: %s (%s)", email, role))
+	return map[string]interface{}{
+		"token":          tokenString,
+		"role":           role,
+		"name":           name,
+		"user_id":        userID,
+		"email_verified": emailVerified,
+	}, nil
+}
+
+// respondWithMFAToken issues a short-lived restricted token for the second login step
+func respondWithMFAToken(w http.ResponseWriter, userID int, purpose, flag string) {
+	var tokenVersion int
+	var email, role string
+	err := database.DB.QueryRow(
+		"SELECT email, role, token_version FROM owners WHERE id = $1",
+		userID,
+	).Scan(&email, &role, &tokenVersion)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to load user for login: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Login failed")
+		return
+	}
 
-	tokenString, err := token.SignedString([]byte(config.JWTSecret))
+	tokenString, err := generateToken(userID, email, role, tokenVersion, purpose, config.MFAChallengeTTL)
 	if err != nil {
 		utils.LogMessage(config.LogError, "Token generation failed: "+err.Error())
 		utils.RespondWithError(w, http.StatusInternalServerError, "Token generation failed")
 		return
 	}
 
-	utils.LogMessage(config.LogInfo, fmt.Sprintf("User logged in: %s (%s)", credentials.Email, role))
 	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
-		"token":   tokenString,
-		"role":    role,
-		"name":    name,
-		"user_id": id,
+		flag:        true,
+		"mfa_token": tokenString,
+		"user_id":   userID,
 	})
 }
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/ical"
+	"petclinic/middleware"
+	"petclinic/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// calendarFeedLookback is how far back the feed goes, so recent cancellations still reach calendars
+const calendarFeedLookback = 30 * 24 * time.Hour
+
+// calendarFeedLimit caps the number of events in a feed
+const calendarFeedLimit = 1000
+
+// CreateCalendarFeedHandler issues a secret iCalendar feed URL for the caller's appointments.
+// Calling it again replaces the previous URL.
+func CreateCalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserIDFromRequest(r)
+
+	token, err := utils.GenerateToken(32)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create calendar feed")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create calendar feed")
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO calendar_feeds (owner_id, token_hash) VALUES ($1, $2)
+		ON CONFLICT (owner_id) DO UPDATE SET token_hash = EXCLUDED.token_hash, created_at = NOW()
+	`, userID, utils.HashToken(token))
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create calendar feed: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create calendar feed")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to create calendar feed", audit.ActionCreate, "calendar_feed", userID, nil, nil) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit calendar feed: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create calendar feed")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Calendar feed issued: User=%d", userID))
+	utils.RespondWithJSON(w, http.StatusCreated, map[string]string{
+		"url": config.AppBaseURL + "/api/calendar/feed/" + url.PathEscape(token) + ".ics",
+	})
+}
+
+// DeleteCalendarFeedHandler revokes the caller's calendar feed URL
+func DeleteCalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserIDFromRequest(r)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to revoke calendar feed")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM calendar_feeds WHERE owner_id = $1", userID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to revoke calendar feed: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to revoke calendar feed")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondWithError(w, http.StatusNotFound, "No calendar feed to revoke")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to revoke calendar feed", audit.ActionDelete, "calendar_feed", userID, nil, nil) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit calendar feed revocation: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to revoke calendar feed")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Calendar feed revoked: User=%d", userID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Calendar feed revoked"})
+}
+
+// CalendarFeedHandler serves a calendar feed identified by its secret token (no other authentication,
+// since calendar apps can't send headers). Owners get their pets' appointments; staff get the clinic's.
+func CalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var ownerID int
+	var role string
+	err := database.DB.QueryRow(`
+		SELECT f.owner_id, COALESCE(o.role, 'owner') FROM calendar_feeds f JOIN owners o ON f.owner_id = o.id
+		WHERE f.token_hash = $1
+	`, utils.HashToken(vars["token"])).Scan(&ownerID, &role)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Calendar feed not found")
+		return
+	}
+
+	conditions := []string{"a.date >= " + database.ClinicNow() + " - $1 * INTERVAL '1 second'"}
+	args := []interface{}{calendarFeedLookback.Seconds()}
+	if role != "staff" {
+		args = append(args, ownerID)
+		conditions = append(conditions, guardianPetsCondition("a.pet_id", len(args)))
+	}
+
+	evts, _, err := appointmentCalendarEvents(strings.Join(conditions, " AND ")+" ORDER BY a.date LIMIT "+strconv.Itoa(calendarFeedLimit), args...)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to build calendar feed: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to build calendar feed")
+		return
+	}
+
+	w.Header().Set("Content-Type", ical.ContentType)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ical.Calendar{Name: config.ClinicName, Method: ical.MethodPublish, Events: evts}.Render())
+}
+
+// AppointmentICSHandler downloads a single appointment as an .ics file. A cancelled appointment
+// is sent with METHOD:CANCEL so importing it removes the event from the calendar.
+func AppointmentICSHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	aptID, _ := strconv.Atoi(vars["id"])
+
+	// Deleted appointments are exported too, as a cancellation calendars can apply
+	evts, petIDs, err := appointmentCalendarEvents("a.id = $1", aptID)
+	if err != nil {
+		utils.LogMessage(config.LogError, fmt.Sprintf("Failed to export appointment %d: %v", aptID, err))
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to export appointment")
+		return
+	}
+	if len(evts) == 0 {
+		utils.RespondWithError(w, http.StatusNotFound, "Appointment not found")
+		return
+	}
+	if !canAccessPet(r, petIDs[0], accessRead) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	method := ical.MethodPublish
+	if evts[0].Status == ical.StatusCancelled {
+		method = ical.MethodCancel
+	}
+
+	w.Header().Set("Content-Type", ical.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="appointment-%d.ics"`, aptID))
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ical.Calendar{Method: method, Events: evts}.Render())
+}
+
+// appointmentCalendarEvents converts the appointments matching condition into calendar events,
+// returning each event's pet ID alongside it. Deleted appointments are included as cancelled
+// until they are purged, so calendars drop them.
+func appointmentCalendarEvents(condition string, args ...interface{}) ([]ical.Event, []int, error) {
+	rows, err := database.DB.Query(`
+		SELECT a.id, a.pet_id, a.date, COALESCE(a.reason, ''), COALESCE(a.status, ''), a.sequence, a.updated_at, a.deleted_at IS NOT NULL, p.name
+		FROM appointments a JOIN pets p ON a.pet_id = p.id
+		WHERE `+condition, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	host := "petclinic"
+	if u, err := url.Parse(config.AppBaseURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+
+	evts := []ical.Event{}
+	var petIDs []int
+	for rows.Next() {
+		var id, petID, sequence int
+		var date, updatedAt time.Time
+		var reason, status, petName string
+		var deleted bool
+		if err := rows.Scan(&id, &petID, &date, &reason, &status, &sequence, &updatedAt, &deleted, &petName); err != nil {
+			return nil, nil, err
+		}
+
+		// Appointment times are wall-clock times in the clinic's time zone
+		start := config.ClinicTime(date)
+		summary := petName + " at " + config.ClinicName
+		if reason != "" {
+			summary = petName + ": " + reason
+		}
+
+		evt := ical.Event{
+			UID:          fmt.Sprintf("appointment-%d@%s", id, host),
+			Sequence:     sequence,
+			Start:        start,
+			End:          start.Add(config.AppointmentDuration),
+			Summary:      summary,
+			Description:  fmt.Sprintf("Appointment for %s at %s.\n%s/appointments/%d", petName, config.ClinicName, config.AppBaseURL, id),
+			Location:     config.ClinicAddress,
+			Status:       ical.StatusConfirmed,
+			LastModified: updatedAt,
+		}
+		if deleted || status == "cancelled" {
+			evt.Status = ical.StatusCancelled
+		}
+		evts = append(evts, evt)
+		petIDs = append(petIDs, petID)
+	}
+	return evts, petIDs, rows.Err()
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/events"
+	"petclinic/middleware"
+	"petclinic/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// streamHeartbeat keeps idle connections from being closed by proxies
+	streamHeartbeat = 25 * time.Second
+
+	// streamMaxDuration ends streams periodically so clients reconnect and re-authenticate
+	streamMaxDuration = 30 * time.Minute
+
+	// streamAccessRefresh is how often a stream re-reads which pets the caller may see
+	streamAccessRefresh = time.Minute
+)
+
+// petVisibility decides which pets' events a stream's caller may see
+type petVisibility struct {
+	r        *http.Request
+	staff    bool
+	pets     map[int]bool
+	loadedAt time.Time
+}
+
+// allows reports whether the caller may see events about the pet
+func (v *petVisibility) allows(petID int) bool {
+	if v.staff {
+		return true
+	}
+	if time.Since(v.loadedAt) > streamAccessRefresh {
+		v.reload()
+	}
+	return v.pets[petID]
+}
+
+// reload reads the pets the caller is a guardian of
+func (v *petVisibility) reload() {
+	v.loadedAt = time.Now()
+	rows, err := database.DB.Query("SELECT pet_id FROM pet_guardians WHERE owner_id = $1", middleware.GetUserIDFromRequest(v.r))
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to load stream access: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	pets := map[int]bool{}
+	for rows.Next() {
+		var petID int
+		if err := rows.Scan(&petID); err != nil {
+			continue
+		}
+		pets[petID] = true
+	}
+	v.pets = pets
+}
+
+// EventStreamHandler streams clinic events as Server-Sent Events: staff see everything, everyone
+// else sees events about pets they are a guardian of. Reconnecting with a Last-Event-ID header
+// (or ?last_event_id=) replays what was missed. Optional ?types= is a comma-separated filter.
+func EventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	var types map[string]bool
+	if v := r.URL.Query().Get("types"); v != "" {
+		types = map[string]bool{}
+		for _, t := range strings.Split(v, ",") {
+			t = strings.TrimSpace(t)
+			if !utils.ContainsString(events.Types, t) {
+				utils.RespondWithError(w, http.StatusBadRequest, "Invalid event type: "+t+". Must be one of "+strings.Join(events.Types, ", "))
+				return
+			}
+			types[t] = true
+		}
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	lastSeq, _ := strconv.ParseInt(lastID, 10, 64)
+
+	visibility := &petVisibility{r: r, staff: middleware.GetUserRoleFromRequest(r) == "staff"}
+	if !visibility.staff {
+		visibility.reload()
+	}
+
+	// Start watching before replaying so nothing falls between the two
+	live, stop := events.Watch()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	// Events replayed from the log may also arrive live; sent remembers them until their live copy is skipped
+	sent := map[int64]bool{}
+	send := func(evt events.Event) bool {
+		if sent[evt.Seq] {
+			return true
+		}
+		sent[evt.Seq] = true
+		if (types != nil && !types[evt.Type]) || !visibility.allows(evt.PetID) {
+			return true
+		}
+		data, err := json.Marshal(evt)
+		if err != nil {
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", evt.Seq, evt.Type, data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	if lastSeq > 0 {
+		missed, err := events.Since(lastSeq)
+		if err != nil {
+			utils.LogMessage(config.LogError, "Failed to replay events: "+err.Error())
+			return
+		}
+		for _, evt := range missed {
+			if !send(evt) {
+				return
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	deadline := time.NewTimer(streamMaxDuration)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-deadline.C:
+			return
+		case evt, ok := <-live:
+			// A closed channel means this stream fell behind; the client resumes from its last ID
+			if !ok || !send(evt) {
+				return
+			}
+			delete(sent, evt.Seq)
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -1,14 +1,16 @@
 package handlers
 
 import (
-	//"database/sql"
+	"database/sql"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"petclinic/audit"
 	"petclinic/config"
 	"petclinic/database"
+	"petclinic/events"
 	"petclinic/middleware"
 	"petclinic/models"
 	"petclinic/utils"
@@ -34,21 +36,14 @@ func UploadMedicalRecordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID := middleware.GetUserIDFromRequest(r)
-	role := middleware.GetUserRoleFromRequest(r)
-
-	// Check ownership
-	if role != "staff" {
-		var ownerID int
-		err := database.DB.QueryRow("SELECT owner_id FROM pets WHERE id = $1", petID).Scan(&ownerID)
-		if err != nil {
-			utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
-			return
-		}
-		if ownerID != userID {
-			utils.RespondWithError(w, http.StatusForbidden, "Access denied")
-			return
-		}
+	// Check access
+	if _, err := loadPet(petID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, petID, accessWrite) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
 	}
 
 	// Get file from form
@@ -88,8 +83,17 @@ func UploadMedicalRecordHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Save metadata to database
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		os.Remove(filepath)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to save record")
+		return
+	}
+	defer tx.Rollback()
+
 	var id int
-	err = database.DB.QueryRow(
+	err = tx.QueryRow(
 		"INSERT INTO medical_records (pet_id, file_name, file_path, file_type) VALUES ($1, $2, $3, $4) RETURNING id",
 		petID, header.Filename, filepath, header.Header.Get("Content-Type"),
 	).Scan(&id)
@@ -102,6 +106,38 @@ func UploadMedicalRecordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := events.Publish(tx, events.RecordUploaded, petID, map[string]interface{}{
+		"id":        id,
+		"pet_id":    petID,
+		"file_name": header.Filename,
+		"file_type": header.Header.Get("Content-Type"),
+	}); err != nil {
+		utils.LogMessage(config.LogError, "Failed to publish record event: "+err.Error())
+		os.Remove(filepath)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to save record")
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.ActionCreate, "medical_record", id, nil, models.MedicalRecord{
+		ID:       id,
+		PetID:    petID,
+		FileName: header.Filename,
+		FilePath: filepath,
+		FileType: header.Header.Get("Content-Type"),
+	}); err != nil {
+		utils.LogMessage(config.LogError, "Failed to write audit entry: "+err.Error())
+		os.Remove(filepath)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to save record")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit record: "+err.Error())
+		os.Remove(filepath)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to save record")
+		return
+	}
+
 	utils.LogMessage(config.LogInfo, fmt.Sprintf("Medical record uploaded: ID=%d, Pet=%d, File=%s", id, petID, header.Filename))
 	utils.RespondWithJSON(w, http.StatusCreated, map[string]interface{}{
 		"message":   "File uploaded successfully",
@@ -110,50 +146,59 @@ func UploadMedicalRecordHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// GetMedicalRecordsHandler retrieves all medical records for a pet
+// GetMedicalRecordsHandler lists a pet's medical records.
+// Filters: file_type; sort: uploaded_at, id, file_name (prefix "-" for descending); limit, cursor.
 func GetMedicalRecordsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	petID, _ := strconv.Atoi(vars["pet_id"])
 
-	userID := middleware.GetUserIDFromRequest(r)
-	role := middleware.GetUserRoleFromRequest(r)
-
-	// Check ownership
-	if role != "staff" {
-		var ownerID int
-		err := database.DB.QueryRow("SELECT owner_id FROM pets WHERE id = $1", petID).Scan(&ownerID)
-		if err != nil {
-			utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
-			return
-		}
-		if ownerID != userID {
-			utils.RespondWithError(w, http.StatusForbidden, "Access denied")
-			return
-		}
+	// Check access
+	if _, err := loadPet(petID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, petID, accessRead) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
 	}
 
-	// Fetch records
-	rows, err := database.DB.Query(
-		"SELECT id, pet_id, file_name, file_path, file_type FROM medical_records WHERE pet_id = $1 ORDER BY uploaded_at DESC",
-		petID,
-	)
+	lq, err := newListQuery(r, listOptions{
+		sortColumns: map[string]string{"uploaded_at": "uploaded_at", "id": "id", "file_name": "file_name"},
+		defaultSort: "-uploaded_at",
+		idColumn:    "id",
+	})
 	if err != nil {
-		utils.LogMessage(config.LogError, "Failed to fetch records: "+err.Error())
-		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch records")
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer rows.Close()
 
+	if !recordAccess(w, r, "Failed to fetch records", audit.ActionView, "medical_records", petID) {
+		return
+	}
+
+	lq.filter("pet_id =", petID)
+	lq.where("deleted_at IS NULL")
+	if v := r.URL.Query().Get("file_type"); v != "" {
+		lq.filter("file_type =", v)
+	}
+
+	// Fetch records
 	records := []models.MedicalRecord{}
-	for rows.Next() {
+	total, next, err := lq.run("id, pet_id, file_name, file_path, file_type", "medical_records", func(rows *sql.Rows, sortKey *string) (int, error) {
 		var record models.MedicalRecord
-		if err := rows.Scan(&record.ID, &record.PetID, &record.FileName, &record.FilePath, &record.FileType); err != nil {
-			continue
+		if err := rows.Scan(sortKey, &record.ID, &record.PetID, &record.FileName, &record.FilePath, &record.FileType); err != nil {
+			return 0, err
 		}
 		records = append(records, record)
+		return record.ID, nil
+	})
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch records: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch records")
+		return
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, records)
+	utils.RespondWithJSON(w, http.StatusOK, models.Page{Items: records, NextCursor: next, TotalCount: total})
 }
 
 // DownloadMedicalRecordHandler handles file downloads
@@ -162,26 +207,24 @@ func DownloadMedicalRecordHandler(w http.ResponseWriter, r *http.Request) {
 	recordID, _ := strconv.Atoi(vars["id"])
 
 	userID := middleware.GetUserIDFromRequest(r)
-	role := middleware.GetUserRoleFromRequest(r)
 
-	// Fetch record and check ownership
+	// Fetch record and check access
 	var filepath, filename string
-	var petID, ownerID int
+	var petID int
 
 	err := database.DB.QueryRow(`
-		SELECT mr.file_path, mr.file_name, mr.pet_id, p.owner_id
-		FROM medical_records mr
-		JOIN pets p ON mr.pet_id = p.id
-		WHERE mr.id = $1
-	`, recordID).Scan(&filepath, &filename, &petID, &ownerID)
+		SELECT file_path, file_name, pet_id
+		FROM medical_records
+		WHERE id = $1 AND deleted_at IS NULL
+	`, recordID).Scan(&filepath, &filename, &petID)
 
 	if err != nil {
 		utils.RespondWithError(w, http.StatusNotFound, "Record not found")
 		return
 	}
 
-	// Check ownership
-	if role != "staff" && ownerID != userID {
+	// Check access
+	if !canAccessPet(r, petID, accessRead) {
 		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
 		return
 	}
@@ -193,6 +236,10 @@ func DownloadMedicalRecordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !recordAccess(w, r, "Failed to download record", audit.ActionDownload, "medical_record", recordID) {
+		return
+	}
+
 	// Set headers and serve file
 	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
 	w.Header().Set("Content-Type", "application/octet-stream")
@@ -207,32 +254,42 @@ func DeleteMedicalRecordHandler(w http.ResponseWriter, r *http.Request) {
 	recordID, _ := strconv.Atoi(vars["id"])
 
 	userID := middleware.GetUserIDFromRequest(r)
-	role := middleware.GetUserRoleFromRequest(r)
 
-	// Fetch record and check ownership
-	var filepath string
-	var ownerID int
+	// Fetch record and check access
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete record")
+		return
+	}
+	defer tx.Rollback()
+
+	var record models.MedicalRecord
 
-	err := database.DB.QueryRow(`
-		SELECT mr.file_path, p.owner_id
-		FROM medical_records mr
-		JOIN pets p ON mr.pet_id = p.id
-		WHERE mr.id = $1
-	`, recordID).Scan(&filepath, &ownerID)
+	err = tx.QueryRow(`
+		SELECT id, pet_id, file_name, file_path, file_type
+		FROM medical_records
+		WHERE id = $1 AND deleted_at IS NULL
+		FOR UPDATE
+	`, recordID).Scan(&record.ID, &record.PetID, &record.FileName, &record.FilePath, &record.FileType)
 
 	if err != nil {
 		utils.RespondWithError(w, http.StatusNotFound, "Record not found")
 		return
 	}
 
-	// Check ownership
-	if role != "staff" && ownerID != userID {
+	// Check access
+	if !canAccessPet(r, record.PetID, accessWrite) {
 		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
 		return
 	}
 
 	// Delete from database
-	result, err := database.DB.Exec("DELETE FROM medical_records WHERE id = $1", recordID)
+	// Soft delete; the file stays on disk until the purge job removes the record
+	result, err := tx.Exec(
+		"UPDATE medical_records SET deleted_at = NOW(), deleted_by = $1 WHERE id = $2 AND deleted_at IS NULL",
+		userID, recordID,
+	)
 	if err != nil {
 		utils.LogMessage(config.LogError, "Failed to delete record: "+err.Error())
 		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete record")
@@ -245,9 +302,13 @@ func DeleteMedicalRecordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete file from disk
-	if err := os.Remove(filepath); err != nil {
-		utils.LogMessage(config.LogWarn, "Failed to delete file from disk: "+err.Error())
+	if !recordAudit(w, r, tx, "Failed to delete record", audit.ActionDelete, "medical_record", recordID, record, nil) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit record deletion: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete record")
+		return
 	}
 
 	utils.LogMessage(config.LogInfo, fmt.Sprintf("Medical record deleted: ID=%d", recordID))
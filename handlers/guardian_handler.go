@@ -0,0 +1,349 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/outbox"
+	"petclinic/utils"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// petAccess is what a caller may do with a pet; each level includes the ones below it
+type petAccess int
+
+const (
+	accessNone   petAccess = iota
+	accessRead             // view the pet, its records and appointments
+	accessBook             // also book, change and cancel appointments
+	accessWrite            // also edit the pet, upload records and add alerts
+	accessManage           // also delete the pet and manage its guardians
+)
+
+// petAccessFor returns the caller's access to a pet. Staff can do everything;
+// everyone else gets what their pet_guardians row grants.
+func petAccessFor(r *http.Request, petID int) petAccess {
+	if middleware.GetUserRoleFromRequest(r) == "staff" {
+		return accessManage
+	}
+
+	var role string
+	var canBook bool
+	err := database.DB.QueryRow(
+		"SELECT role, can_book FROM pet_guardians WHERE pet_id = $1 AND owner_id = $2",
+		petID, middleware.GetUserIDFromRequest(r),
+	).Scan(&role, &canBook)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			utils.LogMessage(config.LogError, "Failed to check pet access: "+err.Error())
+		}
+		return accessNone
+	}
+
+	switch {
+	case role == "primary":
+		return accessManage
+	case role == "co_owner":
+		return accessWrite
+	case canBook:
+		return accessBook
+	default:
+		return accessRead
+	}
+}
+
+// canAccessPet reports whether the caller has at least the given access to a pet
+func canAccessPet(r *http.Request, petID int, level petAccess) bool {
+	return petAccessFor(r, petID) >= level
+}
+
+// guardianPetsCondition restricts a pet ID column to pets the user is a guardian of
+func guardianPetsCondition(column string, argIndex int) string {
+	return fmt.Sprintf("%s IN (SELECT pet_id FROM pet_guardians WHERE owner_id = $%d)", column, argIndex)
+}
+
+// GetPetGuardiansHandler lists everyone with access to a pet
+func GetPetGuardiansHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+
+	if _, err := loadPet(petID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, petID, accessRead) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT g.pet_id, g.owner_id, o.name, o.email, g.role, g.can_book, g.created_at
+		FROM pet_guardians g
+		JOIN owners o ON g.owner_id = o.id
+		WHERE g.pet_id = $1
+		ORDER BY CASE g.role WHEN 'primary' THEN 0 WHEN 'co_owner' THEN 1 ELSE 2 END, g.created_at
+	`, petID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch guardians: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch guardians")
+		return
+	}
+	defer rows.Close()
+
+	guardians := []models.PetGuardian{}
+	for rows.Next() {
+		var g models.PetGuardian
+		if err := rows.Scan(&g.PetID, &g.OwnerID, &g.Name, &g.Email, &g.Role, &g.CanBook, &g.CreatedAt); err != nil {
+			continue
+		}
+		guardians = append(guardians, g)
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, guardians)
+}
+
+// InviteGuardianHandler emails an invitation to share a pet (primary guardian or staff)
+func InviteGuardianHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+
+	var invite models.GuardianInvitation
+	if err := json.NewDecoder(r.Body).Decode(&invite); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	invite.Email = strings.TrimSpace(invite.Email)
+	if invite.Email == "" || !strings.Contains(invite.Email, "@") {
+		utils.RespondWithError(w, http.StatusBadRequest, "A valid email is required")
+		return
+	}
+	if !utils.ContainsString(models.GuardianInviteRoles, invite.Role) {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid role. Must be one of "+strings.Join(models.GuardianInviteRoles, ", "))
+		return
+	}
+	if invite.Role != "caretaker" {
+		invite.CanBook = true
+	}
+
+	pet, err := loadPet(petID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, petID, accessManage) {
+		utils.RespondWithError(w, http.StatusForbidden, "Only the primary owner can invite guardians")
+		return
+	}
+
+	var exists bool
+	if err := database.DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM pet_guardians g JOIN owners o ON g.owner_id = o.id WHERE g.pet_id = $1 AND LOWER(o.email) = LOWER($2))
+	`, petID, invite.Email).Scan(&exists); err != nil {
+		utils.LogMessage(config.LogError, "Failed to check existing guardians: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create invitation")
+		return
+	}
+	if exists {
+		utils.RespondWithError(w, http.StatusConflict, "This person already has access to the pet")
+		return
+	}
+
+	token, err := utils.GenerateToken(32)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create invitation")
+		return
+	}
+
+	invite.PetID = petID
+	invite.InvitedBy = middleware.GetUserIDFromRequest(r)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create invitation")
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO pet_guardian_invitations (pet_id, email, role, can_book, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW() + $7 * INTERVAL '1 second') RETURNING id, expires_at
+	`, petID, invite.Email, invite.Role, invite.CanBook, utils.HashToken(token), invite.InvitedBy, config.GuardianInviteTTL.Seconds(),
+	).Scan(&invite.ID, &invite.ExpiresAt)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create invitation: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create invitation")
+		return
+	}
+
+	access := "view " + pet.Name + "'s records and appointments"
+	switch {
+	case invite.Role == "co_owner":
+		access = "co-own " + pet.Name
+	case invite.CanBook:
+		access += " and book visits"
+	}
+	link := config.AppBaseURL + "/accept-invitation?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("You have been invited to %s at Pet Clinic.\n\n"+
+		"Sign in (or register with this email address) and open the link below to accept. It expires in %s.\n\n%s\n\n"+
+		"If you weren't expecting this, you can ignore this email.", access, config.GuardianInviteTTL, link)
+
+	if err := outbox.EnqueueEmail(tx, invite.Email, "You've been invited to share "+pet.Name+"'s care", body); err != nil {
+		utils.LogMessage(config.LogError, "Failed to queue invitation email: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create invitation")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to create invitation", audit.ActionCreate, "guardian_invitation", invite.ID, nil, invite) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit invitation: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create invitation")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Guardian invited: Pet=%d, Role=%s, By=%d", petID, invite.Role, invite.InvitedBy))
+	utils.RespondWithJSON(w, http.StatusCreated, invite)
+}
+
+// AcceptGuardianInvitationHandler adds the caller as a guardian using an emailed invitation.
+// The invitation must have been sent to the caller's own email address.
+func AcceptGuardianInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.AcceptInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	userID := middleware.GetUserIDFromRequest(r)
+	email := middleware.GetUserEmailFromRequest(r)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to accept invitation")
+		return
+	}
+	defer tx.Rollback()
+
+	var guardian models.PetGuardian
+	err = tx.QueryRow(`
+		UPDATE pet_guardian_invitations SET accepted_at = NOW()
+		WHERE token_hash = $1 AND accepted_at IS NULL AND expires_at > NOW() AND LOWER(email) = LOWER($2)
+		RETURNING pet_id, role, can_book
+	`, utils.HashToken(req.Token), email).Scan(&guardian.PetID, &guardian.Role, &guardian.CanBook)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid or expired invitation")
+		return
+	}
+
+	if _, err := loadPet(guardian.PetID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+
+	guardian.OwnerID = userID
+	err = tx.QueryRow(`
+		INSERT INTO pet_guardians (pet_id, owner_id, role, can_book, added_by)
+		SELECT $1, $2, $3, $4, invited_by FROM pet_guardian_invitations WHERE token_hash = $5
+		ON CONFLICT DO NOTHING
+		RETURNING created_at
+	`, guardian.PetID, userID, guardian.Role, guardian.CanBook, utils.HashToken(req.Token)).Scan(&guardian.CreatedAt)
+	if err == sql.ErrNoRows {
+		utils.RespondWithError(w, http.StatusConflict, "You already have access to this pet")
+		return
+	}
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to add guardian: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to accept invitation")
+		return
+	}
+
+	// Access changes are recorded against the pet, with the guardian added or removed as the change
+	if !recordAudit(w, r, tx, "Failed to accept invitation", audit.ActionUpdate, "pet", guardian.PetID,
+		nil, map[string]models.PetGuardian{"guardian": guardian}) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit invitation: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to accept invitation")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Guardian added: Pet=%d, User=%d, Role=%s", guardian.PetID, userID, guardian.Role))
+	utils.RespondWithJSON(w, http.StatusOK, guardian)
+}
+
+// RemoveGuardianHandler revokes someone's access to a pet. The primary guardian and staff can
+// remove anyone but the primary guardian; other guardians can remove themselves.
+func RemoveGuardianHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+	ownerID, _ := strconv.Atoi(vars["owner_id"])
+
+	if _, err := loadPet(petID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+
+	self := ownerID == middleware.GetUserIDFromRequest(r)
+	if !self && !canAccessPet(r, petID, accessManage) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to remove guardian")
+		return
+	}
+	defer tx.Rollback()
+
+	var before models.PetGuardian
+	err = tx.QueryRow(
+		"SELECT pet_id, owner_id, role, can_book, created_at FROM pet_guardians WHERE pet_id = $1 AND owner_id = $2 FOR UPDATE",
+		petID, ownerID,
+	).Scan(&before.PetID, &before.OwnerID, &before.Role, &before.CanBook, &before.CreatedAt)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Guardian not found")
+		return
+	}
+	if before.Role == "primary" {
+		utils.RespondWithError(w, http.StatusBadRequest, "The primary owner can't be removed; transfer the pet instead")
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM pet_guardians WHERE pet_id = $1 AND owner_id = $2", petID, ownerID); err != nil {
+		utils.LogMessage(config.LogError, "Failed to remove guardian: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to remove guardian")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to remove guardian", audit.ActionUpdate, "pet", petID,
+		map[string]models.PetGuardian{"guardian": before}, nil) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit guardian removal: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to remove guardian")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Guardian removed: Pet=%d, User=%d", petID, ownerID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Guardian removed successfully"})
+}
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"petclinic/database"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes used when an endpoint doesn't set its own
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// listQuery builds a filtered, sorted, cursor-paginated SELECT for list endpoints.
+// Sorting is always tie-broken on the row ID so cursors stay stable when sort values repeat.
+type listQuery struct {
+	conditions []string
+	args       []interface{}
+	sort       string // the sort parameter as given, e.g. "-date"
+	sortColumn string
+	idColumn   string
+	desc       bool
+	limit      int
+	cursor     *listCursor
+}
+
+// listOptions describes what an endpoint can be sorted by
+type listOptions struct {
+	sortColumns map[string]string // sort parameter name -> SQL column
+	defaultSort string            // e.g. "id" or "-date"
+	idColumn    string
+	defaultSize int
+	maxSize     int
+}
+
+// listCursor marks the last row of the previous page
+type listCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   int    `json:"id"`
+}
+
+// newListQuery reads limit, sort and cursor from the request.
+// sort takes a column name, prefixed with "-" for descending order.
+func newListQuery(r *http.Request, opts listOptions) (*listQuery, error) {
+	q := r.URL.Query()
+	lq := &listQuery{idColumn: opts.idColumn}
+
+	if opts.defaultSize == 0 {
+		opts.defaultSize, opts.maxSize = defaultPageSize, maxPageSize
+	}
+	lq.limit = opts.defaultSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > opts.maxSize {
+			return nil, fmt.Errorf("Invalid limit (must be 1-%d)", opts.maxSize)
+		}
+		lq.limit = n
+	}
+
+	lq.sort = opts.defaultSort
+	if v := q.Get("sort"); v != "" {
+		lq.sort = v
+	}
+	name := strings.TrimPrefix(lq.sort, "-")
+	column, ok := opts.sortColumns[name]
+	if !ok {
+		names := make([]string, 0, len(opts.sortColumns))
+		for n := range opts.sortColumns {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, errors.New("Invalid sort (must be one of " + strings.Join(names, ", ") + ")")
+	}
+	lq.sortColumn = column
+	lq.desc = strings.HasPrefix(lq.sort, "-")
+
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := decodeCursor(v)
+		if err != nil || cursor.Sort != lq.sort {
+			return nil, errors.New("Invalid cursor")
+		}
+		lq.cursor = cursor
+	}
+
+	return lq, nil
+}
+
+// filter adds a condition of the form "<expr> $n", e.g. filter("p.species =", "cat")
+func (lq *listQuery) filter(expr string, value interface{}) {
+	lq.args = append(lq.args, value)
+	lq.conditions = append(lq.conditions, fmt.Sprintf("%s $%d", expr, len(lq.args)))
+}
+
+// arg adds a query argument for use in a where condition and returns its placeholder number
+func (lq *listQuery) arg(value interface{}) int {
+	lq.args = append(lq.args, value)
+	return len(lq.args)
+}
+
+// where adds a condition that takes no arguments (or refers to ones added with arg)
+func (lq *listQuery) where(condition string) {
+	lq.conditions = append(lq.conditions, condition)
+}
+
+// filterTime adds a time filter from an RFC 3339 query parameter, if present
+func (lq *listQuery) filterTime(r *http.Request, param, expr string) error {
+	v := r.URL.Query().Get(param)
+	if v == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return errors.New("Invalid " + param + " (use RFC 3339)")
+	}
+	lq.filter(expr, t)
+	return nil
+}
+
+// filterInt adds an integer filter from a query parameter, if present
+func (lq *listQuery) filterInt(r *http.Request, param, expr string) error {
+	v := r.URL.Query().Get(param)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return errors.New("Invalid " + param)
+	}
+	lq.filter(expr, n)
+	return nil
+}
+
+// filterPrefix adds a case-insensitive prefix match from a query parameter, if present
+func (lq *listQuery) filterPrefix(r *http.Request, param, column string) {
+	if v := r.URL.Query().Get(param); v != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(v)
+		lq.filter(column+" ILIKE", escaped+"%")
+	}
+}
+
+// run counts the matching rows and fetches one page. The SELECT is prefixed with the sort
+// column as text, so scan must read that into sortKey before columns and return the row's ID.
+// A scan error fails the whole page rather than returning it with rows missing.
+func (lq *listQuery) run(columns, from string, scan func(rows *sql.Rows, sortKey *string) (int, error)) (int, string, error) {
+	where := ""
+	if len(lq.conditions) > 0 {
+		where = " WHERE " + strings.Join(lq.conditions, " AND ")
+	}
+
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM "+from+where, lq.args...).Scan(&total); err != nil {
+		return 0, "", err
+	}
+
+	args := lq.args
+	conditions := lq.conditions
+	direction, op := "ASC", ">"
+	if lq.desc {
+		direction, op = "DESC", "<"
+	}
+	if lq.cursor != nil {
+		args = append(args[:len(args):len(args)], lq.cursor.Key, lq.cursor.ID)
+		conditions = append(conditions[:len(conditions):len(conditions)],
+			fmt.Sprintf("(%s, %s) %s ($%d, $%d)", lq.sortColumn, lq.idColumn, op, len(args)-1, len(args)))
+	}
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	query := fmt.Sprintf("SELECT %s::text, %s FROM %s%s ORDER BY %s %s, %s %s LIMIT %d",
+		lq.sortColumn, columns, from, where,
+		lq.sortColumn, direction, lq.idColumn, direction, lq.limit+1)
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rows.Close()
+
+	var last *listCursor
+	count := 0
+	hasMore := false
+	for rows.Next() {
+		if count == lq.limit {
+			hasMore = true
+			break
+		}
+		var sortKey string
+		id, err := scan(rows, &sortKey)
+		if err != nil {
+			return 0, "", err
+		}
+		last = &listCursor{Sort: lq.sort, Key: sortKey, ID: id}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, "", err
+	}
+
+	nextCursor := ""
+	if hasMore && last != nil {
+		nextCursor = encodeCursor(last)
+	}
+	return total, nextCursor, nil
+}
+
+// encodeCursor serializes a cursor as opaque URL-safe text
+func encodeCursor(c *listCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reverses encodeCursor
+func decodeCursor(s string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c listCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
@@ -0,0 +1,365 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/lockout"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/totp"
+	"petclinic/utils"
+	"strings"
+	"time"
+)
+
+// recoveryCodeCount is the number of single-use recovery codes issued at enrollment
+const recoveryCodeCount = 10
+
+// VerifyMFAHandler completes a two-step login with a TOTP or recovery code
+func VerifyMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.MFAVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		utils.RespondWithError(w, http.StatusBadRequest, "MFA token and code are required")
+		return
+	}
+
+	claims, err := middleware.ParseToken(req.MFAToken)
+	if err != nil || claims.Purpose != models.PurposeMFAChallenge {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+
+	attempt := beginLoginAttempt(w, lockout.AccountKey(claims.Email), lockout.IPKey(middleware.GetClientIP(r)))
+	if attempt == nil {
+		return
+	}
+
+	var ok bool
+	if req.Code != "" {
+		ok, err = verifyTOTP(claims.UserID, req.Code)
+	} else {
+		ok, err = useRecoveryCode(claims.UserID, req.RecoveryCode)
+	}
+	if err != nil {
+		attempt.release()
+		utils.LogMessage(config.LogError, "MFA verification failed: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Login failed")
+		return
+	}
+	if !ok {
+		utils.LogMessage(config.LogWarn, fmt.Sprintf("Invalid MFA code for user %d", claims.UserID))
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	attempt.succeed()
+	respondWithSession(w, claims.UserID)
+}
+
+// EnrollMFAHandler generates a new TOTP secret for the current user, pending confirmation
+func EnrollMFAHandler(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserIDFromRequest(r)
+
+	var email string
+	var enabled bool
+	err := database.DB.QueryRow("SELECT email, mfa_enabled FROM owners WHERE id = $1", userID).Scan(&email, &enabled)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	if enabled {
+		utils.RespondWithError(w, http.StatusBadRequest, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to generate MFA secret: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to start enrollment")
+		return
+	}
+
+	if _, err := database.DB.Exec(
+		"UPDATE owners SET mfa_secret = $1, mfa_last_step = 0 WHERE id = $2",
+		secret, userID,
+	); err != nil {
+		utils.LogMessage(config.LogError, "Failed to store MFA secret: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to start enrollment")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("MFA enrollment started: User=%d", userID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"secret":           secret,
+		"provisioning_uri": totp.ProvisioningURI(config.MFAIssuer, email, secret),
+	})
+}
+
+// ConfirmMFAHandler enables two-factor authentication once the user proves their authenticator works.
+// The response includes recovery codes (shown only once) and a fresh access token.
+func ConfirmMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Code is required")
+		return
+	}
+
+	userID := middleware.GetUserIDFromRequest(r)
+
+	if !checkSessionCode(w, r, userID, req.Code, "Failed to enable two-factor authentication") {
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+		return
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create recovery codes: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE owners SET mfa_enabled = TRUE WHERE id = $1", userID); err != nil {
+		utils.LogMessage(config.LogError, "Failed to enable MFA: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to enable two-factor authentication", audit.ActionUpdate, "owner", userID,
+		map[string]bool{"mfa_enabled": false}, map[string]bool{"mfa_enabled": true}) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit MFA enrollment: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+		return
+	}
+
+	session, err := newSession(userID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create session: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+		return
+	}
+	session["recovery_codes"] = codes
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("MFA enabled: User=%d", userID))
+	utils.RespondWithJSON(w, http.StatusOK, session)
+}
+
+// DisableMFAHandler turns off two-factor authentication, unless the user's role requires it
+func DisableMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Code is required")
+		return
+	}
+
+	userID := middleware.GetUserIDFromRequest(r)
+	role := middleware.GetUserRoleFromRequest(r)
+
+	if config.IsMFARequired(role) {
+		utils.RespondWithError(w, http.StatusForbidden, "Two-factor authentication is required for your role")
+		return
+	}
+
+	if !checkSessionCode(w, r, userID, req.Code, "Failed to disable two-factor authentication") {
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to disable two-factor authentication")
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"UPDATE owners SET mfa_enabled = FALSE, mfa_secret = NULL, mfa_last_step = 0 WHERE id = $1",
+		userID,
+	); err != nil {
+		utils.LogMessage(config.LogError, "Failed to disable MFA: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to disable two-factor authentication")
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE owner_id = $1", userID); err != nil {
+		utils.LogMessage(config.LogError, "Failed to delete recovery codes: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to disable two-factor authentication")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to disable two-factor authentication", audit.ActionUpdate, "owner", userID,
+		map[string]bool{"mfa_enabled": true}, map[string]bool{"mfa_enabled": false}) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit MFA removal: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to disable two-factor authentication")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("MFA disabled: User=%d", userID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodesHandler replaces all recovery codes for the current user
+func RegenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Code is required")
+		return
+	}
+
+	userID := middleware.GetUserIDFromRequest(r)
+
+	if !checkSessionCode(w, r, userID, req.Code, "Failed to create recovery codes") {
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create recovery codes")
+		return
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create recovery codes: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create recovery codes")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to create recovery codes", audit.ActionUpdate, "owner", userID,
+		map[string]string{"recovery_codes": "old"}, map[string]string{"recovery_codes": "regenerated"}) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit recovery codes: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create recovery codes")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("MFA recovery codes regenerated: User=%d", userID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes})
+}
+
+// checkSessionCode verifies a signed-in user's TOTP code under the same attempt limits as login,
+// so a stolen session can't be used to guess codes. It responds and returns false unless the code is valid.
+func checkSessionCode(w http.ResponseWriter, r *http.Request, userID int, code, failMessage string) bool {
+	attempt := beginLoginAttempt(w, lockout.AccountKey(middleware.GetUserEmailFromRequest(r)), lockout.IPKey(middleware.GetClientIP(r)))
+	if attempt == nil {
+		return false
+	}
+
+	ok, err := verifyTOTP(userID, code)
+	if err != nil {
+		attempt.release()
+		utils.LogMessage(config.LogError, "MFA verification failed: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, failMessage)
+		return false
+	}
+	if !ok {
+		utils.LogMessage(config.LogWarn, fmt.Sprintf("Invalid MFA code for user %d", userID))
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid code")
+		return false
+	}
+
+	attempt.release()
+	return true
+}
+
+// verifyTOTP checks a code against the user's secret and records its time step to prevent replay
+func verifyTOTP(userID int, code string) (bool, error) {
+	var secret sql.NullString
+	var lastStep int64
+	err := database.DB.QueryRow(
+		"SELECT mfa_secret, mfa_last_step FROM owners WHERE id = $1",
+		userID,
+	).Scan(&secret, &lastStep)
+	if err != nil {
+		return false, err
+	}
+	if !secret.Valid {
+		return false, nil
+	}
+
+	step, ok := totp.Validate(secret.String, code, time.Now(), lastStep)
+	if !ok {
+		return false, nil
+	}
+
+	// Only one request can advance the step, so a code used concurrently is accepted once
+	result, err := database.DB.Exec(
+		"UPDATE owners SET mfa_last_step = $1 WHERE id = $2 AND mfa_last_step < $1",
+		step, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected == 1, nil
+}
+
+// useRecoveryCode consumes one of the user's unused recovery codes
+func useRecoveryCode(userID int, code string) (bool, error) {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	result, err := database.DB.Exec(
+		"UPDATE mfa_recovery_codes SET used_at = NOW() WHERE owner_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userID, utils.HashToken(code),
+	)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 1 {
+		utils.LogMessage(config.LogWarn, fmt.Sprintf("MFA recovery code used: User=%d", userID))
+	}
+	return rowsAffected == 1, nil
+}
+
+// replaceRecoveryCodes deletes the user's recovery codes and returns a new set in plain text
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE owner_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		// 10 base32 characters (50 bits), lowercase so codes are easy to read and type
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(raw))[:10]
+		if _, err := tx.Exec(
+			"INSERT INTO mfa_recovery_codes (owner_id, code_hash) VALUES ($1, $2)",
+			userID, utils.HashToken(code),
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
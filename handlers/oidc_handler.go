@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/oidc"
+	"petclinic/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// oidcCookieName holds the signed state, nonce, PKCE verifier and link target between login and callback
+	oidcCookieName = "oidc_auth"
+	oidcPurpose    = "oidc"
+	oidcFlowTTL    = 10 * time.Minute
+)
+
+// errOIDCEmailTaken means an IdP identity's email belongs to an account that hasn't linked SSO
+var errOIDCEmailTaken = errors.New("email belongs to an unlinked account")
+
+// OIDCLoginHandler redirects staff to the identity provider to sign in
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	authURL, ok := startOIDCFlow(w, 0)
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// LinkOIDCHandler starts single sign-on for the current user so the IdP identity is linked to
+// their existing account. It returns the URL to send the browser to.
+func LinkOIDCHandler(w http.ResponseWriter, r *http.Request) {
+	authURL, ok := startOIDCFlow(w, middleware.GetUserIDFromRequest(r))
+	if !ok {
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"authorization_url": authURL})
+}
+
+// startOIDCFlow stores the signed flow state in a cookie and returns the IdP authorization URL.
+// A non-zero linkUserID makes the callback link the identity to that account instead of signing in.
+func startOIDCFlow(w http.ResponseWriter, linkUserID int) (string, bool) {
+	provider, err := oidc.GetProvider()
+	if err != nil {
+		utils.LogMessage(config.LogError, "OIDC login unavailable: "+err.Error())
+		utils.RespondWithError(w, http.StatusServiceUnavailable, "Single sign-on is not available")
+		return "", false
+	}
+
+	state, err1 := utils.GenerateToken(16)
+	nonce, err2 := utils.GenerateToken(16)
+	verifier, err3 := utils.GenerateToken(32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to start single sign-on")
+		return "", false
+	}
+
+	expires := time.Now().Add(oidcFlowTTL).Unix()
+	payload := strings.Join([]string{
+		oidcPurpose, state, nonce, verifier, strconv.FormatInt(expires, 10), strconv.Itoa(linkUserID),
+	}, "|")
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    utils.SignPayload(config.LinkSigningSecret, payload),
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.AppBaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	return provider.AuthCodeURL(state, nonce, base64.RawURLEncoding.EncodeToString(challenge[:])), true
+}
+
+// OIDCCallbackHandler completes single sign-on, provisioning the staff account on first login.
+// For flows started by LinkOIDCHandler it links the identity to the requesting account instead.
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, err := oidc.GetProvider()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusServiceUnavailable, "Single sign-on is not available")
+		return
+	}
+
+	if idpErr := r.URL.Query().Get("error"); idpErr != "" {
+		utils.LogMessage(config.LogWarn, "OIDC provider returned error: "+idpErr)
+		utils.RespondWithError(w, http.StatusUnauthorized, "Single sign-on was not completed")
+		return
+	}
+
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Single sign-on session not found")
+		return
+	}
+	// The flow state is single-use
+	http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Path: "/api/oidc", MaxAge: -1})
+
+	// Every field is a base64url token or a number, so "|" can't appear inside one
+	payload, ok := utils.VerifySignedPayload(config.LinkSigningSecret, cookie.Value)
+	parts := strings.Split(payload, "|")
+	if !ok || len(parts) != 6 || parts[0] != oidcPurpose {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid single sign-on session")
+		return
+	}
+	state, nonce, verifier := parts[1], parts[2], parts[3]
+	expires, _ := strconv.ParseInt(parts[4], 10, 64)
+	linkUserID, _ := strconv.Atoi(parts[5])
+	if time.Now().Unix() > expires || r.URL.Query().Get("state") != state {
+		utils.LogMessage(config.LogWarn, "OIDC state mismatch or expired flow")
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid single sign-on session")
+		return
+	}
+
+	rawIDToken, err := provider.Exchange(r.URL.Query().Get("code"), verifier)
+	if err != nil {
+		utils.LogMessage(config.LogError, "OIDC code exchange failed: "+err.Error())
+		utils.RespondWithError(w, http.StatusUnauthorized, "Single sign-on failed")
+		return
+	}
+
+	identity, err := provider.VerifyIDToken(rawIDToken, nonce)
+	if err != nil {
+		utils.LogMessage(config.LogWarn, "OIDC ID token rejected: "+err.Error())
+		utils.RespondWithError(w, http.StatusUnauthorized, "Single sign-on failed")
+		return
+	}
+
+	role := oidc.MapRole(identity.Groups)
+	if role == "" {
+		utils.LogMessage(config.LogWarn, "OIDC login without a mapped group: "+identity.Email)
+		utils.RespondWithError(w, http.StatusForbidden, "Your account is not authorized for clinic access")
+		return
+	}
+
+	if linkUserID != 0 {
+		linkOIDCIdentity(w, linkUserID, identity)
+		return
+	}
+
+	userID, err := provisionOIDCUser(identity, role)
+	if err == errOIDCEmailTaken {
+		utils.LogMessage(config.LogWarn, "OIDC login for an unlinked account: "+identity.Email)
+		utils.RespondWithError(w, http.StatusConflict,
+			"An account with this email already exists. Sign in with your password and link single sign-on from your account")
+		return
+	}
+	if err != nil {
+		utils.LogMessage(config.LogError, "OIDC provisioning failed: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Single sign-on failed")
+		return
+	}
+
+	// Accounts with two-factor authentication still need it unless the IdP already checked a second factor
+	if !identity.MFA {
+		var mfaEnabled bool
+		var accountRole string
+		err := database.DB.QueryRow("SELECT mfa_enabled, role FROM owners WHERE id = $1", userID).Scan(&mfaEnabled, &accountRole)
+		if err != nil {
+			utils.LogMessage(config.LogError, "Failed to load user for login: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Single sign-on failed")
+			return
+		}
+		if mfaEnabled {
+			respondWithMFAToken(w, userID, models.PurposeMFAChallenge, "mfa_required")
+			return
+		}
+		if config.IsMFARequired(accountRole) {
+			utils.LogMessage(config.LogInfo, fmt.Sprintf("Two-factor enrollment required: User=%d", userID))
+			respondWithMFAToken(w, userID, models.PurposeMFAEnroll, "mfa_enrollment_required")
+			return
+		}
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("OIDC login: User=%d (%s)", userID, role))
+	respondWithSession(w, userID)
+}
+
+// linkOIDCIdentity attaches an IdP identity to an existing account that has none yet
+func linkOIDCIdentity(w http.ResponseWriter, userID int, identity *oidc.Identity) {
+	result, err := database.DB.Exec(
+		"UPDATE owners SET oidc_subject = $1 WHERE id = $2 AND oidc_subject IS NULL",
+		identity.Subject, userID,
+	)
+	if isUniqueViolation(err) {
+		utils.RespondWithError(w, http.StatusConflict, "This identity is already linked to another account")
+		return
+	}
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to link OIDC identity: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to link single sign-on")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondWithError(w, http.StatusConflict, "Your account is already linked to single sign-on")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("OIDC identity linked: User=%d (%s)", userID, identity.Email))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Single sign-on linked successfully"})
+}
+
+// provisionOIDCUser finds or creates the owners row for an IdP identity. Only accounts created
+// through SSO have their role synced from the IdP; linked password accounts keep their own role.
+// Existing accounts are never matched by email: they must link from a signed-in session.
+func provisionOIDCUser(identity *oidc.Identity, role string) (int, error) {
+	var id int
+	err := database.DB.QueryRow("SELECT id FROM owners WHERE oidc_subject = $1", identity.Subject).Scan(&id)
+
+	if err == sql.ErrNoRows {
+		// SSO accounts get a random password nobody knows, so they can only sign in through the IdP
+		random, tokenErr := utils.GenerateToken(32)
+		if tokenErr != nil {
+			return 0, tokenErr
+		}
+		hashedPassword, hashErr := bcrypt.GenerateFromPassword([]byte(random), bcrypt.DefaultCost)
+		if hashErr != nil {
+			return 0, hashErr
+		}
+
+		name := identity.Name
+		if name == "" {
+			name = identity.Email
+		}
+		err = database.DB.QueryRow(`
+			INSERT INTO owners (name, email, password, role, email_verified, oidc_subject, oidc_provisioned)
+			VALUES ($1, $2, $3, $4, TRUE, $5, TRUE) RETURNING id
+		`, name, identity.Email, string(hashedPassword), role, identity.Subject).Scan(&id)
+		if isUniqueViolation(err) {
+			return 0, errOIDCEmailTaken
+		}
+		if err == nil {
+			utils.LogMessage(config.LogInfo, fmt.Sprintf("OIDC user provisioned: %s (%s)", identity.Email, role))
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = database.DB.Exec(
+		"UPDATE owners SET role = $1, name = COALESCE(NULLIF($2, ''), name) WHERE id = $3 AND oidc_provisioned",
+		role, identity.Name, id,
+	)
+	return id, err
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/models"
+	"petclinic/outbox"
+	"petclinic/utils"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// GetOutboxHandler lists outbox messages, newest first (staff only). Email payloads are
+// redacted to their recipient and subject, since the bodies hold reset and verification links.
+// Filters: status (pending, delivered, dead), kind; limit, cursor.
+func GetOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	lq, err := newListQuery(r, listOptions{
+		sortColumns: map[string]string{"id": "id"},
+		defaultSort: "-id",
+		idColumn:    "id",
+		defaultSize: 100,
+		maxSize:     1000,
+	})
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if v := q.Get("status"); v != "" {
+		lq.filter("status =", v)
+	}
+	if v := q.Get("kind"); v != "" {
+		lq.filter("kind =", v)
+	}
+
+	messages := []outbox.Message{}
+	total, next, err := lq.run("id, kind, payload, status, attempts, next_attempt_at, last_error, created_at, delivered_at", "outbox", func(rows *sql.Rows, sortKey *string) (int, error) {
+		var m outbox.Message
+		var payload []byte
+		if err := rows.Scan(sortKey, &m.ID, &m.Kind, &payload, &m.Status, &m.Attempts, &m.NextAttemptAt,
+			&m.LastError, &m.CreatedAt, &m.DeliveredAt); err != nil {
+			return 0, err
+		}
+		m.Payload = payload
+		m.Payload = outbox.Redact(m)
+		messages = append(messages, m)
+		return int(m.ID), nil
+	})
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch outbox: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch outbox")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, models.Page{Items: messages, NextCursor: next, TotalCount: total})
+}
+
+// RetryOutboxMessageHandler requeues a dead-lettered message (staff only). Emails can't be
+// retried because their body is cleared when they are dead-lettered.
+func RetryOutboxMessageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to retry message")
+		return
+	}
+	defer tx.Rollback()
+
+	ok, err := outbox.Retry(tx, id)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to retry outbox message: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to retry message")
+		return
+	}
+	if !ok {
+		utils.RespondWithError(w, http.StatusNotFound, "No retryable dead-lettered message with this ID")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to retry message", audit.ActionUpdate, "outbox_message", int(id),
+		map[string]string{"status": "dead"}, map[string]string{"status": "pending"}) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit outbox retry: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to retry message")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Outbox message requeued: ID=%d", id))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Message requeued"})
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/models"
+	"petclinic/outbox"
+	"petclinic/utils"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ForgotPasswordHandler emails a single-use password reset link
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if req.Email == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Email is required")
+		return
+	}
+
+	// Always respond the same way so the endpoint cannot be used to discover accounts
+	response := map[string]string{"message": "If the account exists, a reset link has been sent"}
+
+	var ownerID int
+	err := database.DB.QueryRow("SELECT id FROM owners WHERE email = $1", req.Email).Scan(&ownerID)
+	if err != nil {
+		utils.LogMessage(config.LogWarn, "Password reset requested for unknown email: "+req.Email)
+		utils.RespondWithJSON(w, http.StatusOK, response)
+		return
+	}
+
+	// Failures past this point are logged but not reported, since only existing accounts get here
+	if err := sendPasswordReset(ownerID, req.Email); err != nil {
+		utils.LogMessage(config.LogError, fmt.Sprintf("Password reset failed: User=%d: %s", ownerID, err.Error()))
+	} else {
+		utils.LogMessage(config.LogInfo, fmt.Sprintf("Password reset requested: User=%d", ownerID))
+	}
+	utils.RespondWithJSON(w, http.StatusOK, response)
+}
+
+// sendPasswordReset replaces the account's outstanding reset tokens with a new one and queues
+// the email in the same transaction
+func sendPasswordReset(ownerID int, email string) error {
+	token, err := utils.GenerateToken(32)
+	if err != nil {
+		return err
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Invalidate any outstanding tokens so only the latest link works
+	if _, err := tx.Exec(
+		"UPDATE password_reset_tokens SET used_at = NOW() WHERE owner_id = $1 AND used_at IS NULL",
+		ownerID,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO password_reset_tokens (owner_id, token_hash, expires_at) VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second')",
+		ownerID, utils.HashToken(token), config.PasswordResetTTL.Seconds(),
+	); err != nil {
+		return err
+	}
+
+	link := config.AppBaseURL + "/reset-password?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("A password reset was requested for your Pet Clinic account.\n\n"+
+		"Use the link below to choose a new password. It expires in %s and can be used once.\n\n%s\n\n"+
+		"If you did not request this, you can ignore this email.", config.PasswordResetTTL, link)
+
+	if err := outbox.EnqueueEmail(tx, email, "Reset your Pet Clinic password", body); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ResetPasswordHandler sets a new password using a reset token and invalidates existing sessions
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if req.Token == "" || req.Password == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Token and password are required")
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Password hashing failed: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Password reset failed")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Password reset failed")
+		return
+	}
+	defer tx.Rollback()
+
+	// Consume the token atomically so it can only ever be used once
+	var ownerID int
+	err = tx.QueryRow(`
+		UPDATE password_reset_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING owner_id
+	`, utils.HashToken(req.Token)).Scan(&ownerID)
+	if err != nil {
+		utils.LogMessage(config.LogWarn, "Invalid or expired password reset token")
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+		return
+	}
+
+	// Bumping token_version revokes every JWT issued before the reset
+	if _, err := tx.Exec(
+		"UPDATE owners SET password = $1, token_version = token_version + 1 WHERE id = $2",
+		string(hashedPassword), ownerID,
+	); err != nil {
+		utils.LogMessage(config.LogError, "Failed to update password: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Password reset failed")
+		return
+	}
+
+	// API keys outlive sessions, so a reset revokes them too
+	if _, err := tx.Exec(
+		"UPDATE api_keys SET revoked_at = NOW() WHERE owner_id = $1 AND revoked_at IS NULL",
+		ownerID,
+	); err != nil {
+		utils.LogMessage(config.LogError, "Failed to revoke API keys: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Password reset failed")
+		return
+	}
+
+	// The request is unauthenticated; the token identifies whose password changed
+	actor := audit.ActorFromRequest(r)
+	actor.ID = ownerID
+	if err := audit.Write(tx, actor, audit.ActionUpdate, "owner", ownerID,
+		map[string]string{"password": "old"}, map[string]string{"password": "reset"}); err != nil {
+		utils.LogMessage(config.LogError, "Failed to write audit entry: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Password reset failed")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit password reset: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Password reset failed")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Password reset completed: User=%d", ownerID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Password reset successfully"})
+}
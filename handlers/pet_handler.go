@@ -3,16 +3,22 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"petclinic/audit"
 	"petclinic/config"
 	"petclinic/database"
 	"petclinic/middleware"
 	"petclinic/models"
 	"petclinic/utils"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 // CreatePetHandler handles creating a new pet
@@ -28,6 +34,10 @@ func CreatePetHandler(w http.ResponseWriter, r *http.Request) {
 		utils.RespondWithError(w, http.StatusBadRequest, "Name and species are required")
 		return
 	}
+	if err := normalizePetProfile(&pet); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	userID := middleware.GetUserIDFromRequest(r)
 	role := middleware.GetUserRoleFromRequest(r)
@@ -41,60 +51,133 @@ func CreatePetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Insert pet into database
+	// Insert the pet and make its owner the primary guardian
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create pet")
+		return
+	}
+	defer tx.Rollback()
+
 	var id int
-	err := database.DB.QueryRow(
-		"INSERT INTO pets (name, species, breed, owner_id, medical_history) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		pet.Name, pet.Species, pet.Breed, pet.OwnerID, pet.MedicalHistory,
+	err = tx.QueryRow(`
+		INSERT INTO pets (name, species, breed, owner_id, medical_history, date_of_birth, sex, neutered, color, markings, microchip, deceased, deceased_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, ''), $12, $13) RETURNING id
+	`, pet.Name, pet.Species, pet.Breed, pet.OwnerID, pet.MedicalHistory, pet.DateOfBirth, pet.Sex, pet.Neutered,
+		pet.Color, pet.Markings, pet.Microchip, pet.Deceased, pet.DeceasedAt,
 	).Scan(&id)
 
+	if isUniqueViolation(err) {
+		utils.RespondWithError(w, http.StatusConflict, "Microchip is already registered to another pet")
+		return
+	}
 	if err != nil {
 		utils.LogMessage(config.LogError, "Failed to create pet: "+err.Error())
 		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create pet")
 		return
 	}
 
+	if _, err := tx.Exec(
+		"INSERT INTO pet_guardians (pet_id, owner_id, role, can_book, added_by) VALUES ($1, $2, 'primary', TRUE, $3)",
+		id, pet.OwnerID, userID,
+	); err != nil {
+		utils.LogMessage(config.LogError, "Failed to add pet guardian: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create pet")
+		return
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO pet_ownership_history (pet_id, owner_id, started_at) VALUES ($1, $2, NOW())",
+		id, pet.OwnerID,
+	); err != nil {
+		utils.LogMessage(config.LogError, "Failed to record pet ownership: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create pet")
+		return
+	}
+
 	pet.ID = id
+	if !recordAudit(w, r, tx, "Failed to create pet", audit.ActionCreate, "pet", id, nil, pet) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit pet: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create pet")
+		return
+	}
+
 	utils.LogMessage(config.LogInfo, fmt.Sprintf("Pet created: ID=%d, Name=%s, Owner=%d", id, pet.Name, pet.OwnerID))
+	pet.Alerts = []models.PetAlert{}
 	utils.RespondWithJSON(w, http.StatusCreated, pet)
 }
 
-// GetPetsHandler retrieves all pets (filtered by owner for non-staff users)
+// GetPetsHandler lists pets (only those the caller is a guardian of for non-staff users).
+// owner_id filters on the primary owner.
+// Filters: species, breed, owner_id, name (prefix); sort: id, name, species (prefix "-" for descending); limit, cursor.
 func GetPetsHandler(w http.ResponseWriter, r *http.Request) {
 	userID := middleware.GetUserIDFromRequest(r)
 	role := middleware.GetUserRoleFromRequest(r)
 
-	var rows *sql.Rows
-	var err error
+	lq, err := newListQuery(r, listOptions{
+		sortColumns: map[string]string{"id": "id", "name": "name", "species": "species"},
+		defaultSort: "id",
+		idColumn:    "id",
+	})
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	if role == "staff" {
-		// Staff can see all pets
-		rows, err = database.DB.Query("SELECT id, name, species, breed, owner_id, medical_history FROM pets ORDER BY id")
-	} else {
-		// Owners can only see their pets
-		rows, err = database.DB.Query(
-			"SELECT id, name, species, breed, owner_id, medical_history FROM pets WHERE owner_id = $1 ORDER BY id",
-			userID,
-		)
+	lq.where("deleted_at IS NULL")
+	if role != "staff" {
+		// Owners can only see pets they are a guardian of
+		lq.where(guardianPetsCondition("id", lq.arg(userID)))
+	}
+	if err := lq.filterInt(r, "owner_id", "owner_id ="); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
 	}
+	q := r.URL.Query()
+	if v := q.Get("species"); v != "" {
+		lq.filter("LOWER(species) =", strings.ToLower(v))
+	}
+	if v := q.Get("breed"); v != "" {
+		lq.filter("LOWER(breed) =", strings.ToLower(v))
+	}
+	lq.filterPrefix(r, "name", "name")
 
+	pets := []models.Pet{}
+	total, next, err := lq.run(petColumns, "pets", func(rows *sql.Rows, sortKey *string) (int, error) {
+		pet, err := scanPet(rows, sortKey)
+		if err != nil {
+			return 0, err
+		}
+		pets = append(pets, pet)
+		return pet.ID, nil
+	})
 	if err != nil {
 		utils.LogMessage(config.LogError, "Failed to fetch pets: "+err.Error())
 		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch pets")
 		return
 	}
-	defer rows.Close()
 
-	pets := []models.Pet{}
-	for rows.Next() {
-		var pet models.Pet
-		if err := rows.Scan(&pet.ID, &pet.Name, &pet.Species, &pet.Breed, &pet.OwnerID, &pet.MedicalHistory); err != nil {
-			continue
-		}
-		pets = append(pets, pet)
+	// Attach each pet's alerts with one query for the whole page
+	petIDs := make([]int, 0, len(pets))
+	for _, pet := range pets {
+		petIDs = append(petIDs, pet.ID)
+	}
+	alerts, err := loadPetAlerts(petIDs...)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch pet alerts: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch pets")
+		return
+	}
+	for i := range pets {
+		pets[i].Alerts = alerts[pets[i].ID]
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, pets)
+	utils.RespondWithJSON(w, http.StatusOK, models.Page{Items: pets, NextCursor: next, TotalCount: total})
 }
 
 // GetPetByIDHandler retrieves a specific pet by ID
@@ -102,63 +185,107 @@ func GetPetByIDHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	petID, _ := strconv.Atoi(vars["id"])
 
-	userID := middleware.GetUserIDFromRequest(r)
-	role := middleware.GetUserRoleFromRequest(r)
+	pet, err := loadPet(petID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
 
-	var pet models.Pet
-	err := database.DB.QueryRow(
-		"SELECT id, name, species, breed, owner_id, medical_history FROM pets WHERE id = $1",
-		petID,
-	).Scan(&pet.ID, &pet.Name, &pet.Species, &pet.Breed, &pet.OwnerID, &pet.MedicalHistory)
+	// Check access
+	if !canAccessPet(r, petID, accessRead) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
 
+	alerts, err := loadPetAlerts(petID)
 	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch pet alerts: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch pet")
+		return
+	}
+	pet.Alerts = alerts[petID]
+
+	utils.RespondWithJSON(w, http.StatusOK, pet)
+}
+
+// GetPetByMicrochipHandler looks up a pet by its microchip number. Owners only see their own pets;
+// anyone else's chip reads as not found so owners can't probe which chips are registered.
+func GetPetByMicrochipHandler(w http.ResponseWriter, r *http.Request) {
+	chip := strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(mux.Vars(r)["chip"]))
+
+	pet, err := scanPet(database.DB.QueryRow("SELECT "+petColumns+" FROM pets WHERE microchip = $1 AND deleted_at IS NULL", chip))
+	if err != nil || !canAccessPet(r, pet.ID, accessRead) {
 		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
 		return
 	}
 
-	// Check ownership
-	if role != "staff" && pet.OwnerID != userID {
-		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+	alerts, err := loadPetAlerts(pet.ID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch pet alerts: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch pet")
 		return
 	}
+	pet.Alerts = alerts[pet.ID]
 
 	utils.RespondWithJSON(w, http.StatusOK, pet)
 }
 
-// UpdatePetHandler updates an existing pet
+// UpdatePetHandler updates an existing pet. Fields missing from the body keep their current values.
 func UpdatePetHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	petID, _ := strconv.Atoi(vars["id"])
 
-	var pet models.Pet
+	before, err := loadPet(petID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+
+	// Check access
+	if !canAccessPet(r, petID, accessWrite) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	// Decode over a copy of the current pet so omitted fields are left as they are. The decoder
+	// writes through existing pointers, so the dates are copied rather than shared with before.
+	pet := before
+	pet.DateOfBirth = copyDate(before.DateOfBirth)
+	pet.DeceasedAt = copyDate(before.DeceasedAt)
 	if err := json.NewDecoder(r.Body).Decode(&pet); err != nil {
 		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
 		return
 	}
+	if before.Deceased && !pet.Deceased {
+		pet.DeceasedAt = nil
+	}
 
-	userID := middleware.GetUserIDFromRequest(r)
-	role := middleware.GetUserRoleFromRequest(r)
+	if err := normalizePetProfile(&pet); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	// Check ownership
-	if role != "staff" {
-		var ownerID int
-		err := database.DB.QueryRow("SELECT owner_id FROM pets WHERE id = $1", petID).Scan(&ownerID)
-		if err != nil {
-			utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
-			return
-		}
-		if ownerID != userID {
-			utils.RespondWithError(w, http.StatusForbidden, "Access denied")
-			return
-		}
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update pet")
+		return
 	}
+	defer tx.Rollback()
 
 	// Update pet
-	result, err := database.DB.Exec(
-		"UPDATE pets SET name=$1, species=$2, breed=$3, medical_history=$4 WHERE id=$5",
-		pet.Name, pet.Species, pet.Breed, pet.MedicalHistory, petID,
+	result, err := tx.Exec(`
+		UPDATE pets SET name=$1, species=$2, breed=$3, medical_history=$4, date_of_birth=$5, sex=$6, neutered=$7,
+			color=$8, markings=$9, microchip=NULLIF($10, ''), deceased=$11, deceased_at=$12
+		WHERE id=$13 AND deleted_at IS NULL
+	`, pet.Name, pet.Species, pet.Breed, pet.MedicalHistory, pet.DateOfBirth, pet.Sex, pet.Neutered,
+		pet.Color, pet.Markings, pet.Microchip, pet.Deceased, pet.DeceasedAt, petID,
 	)
 
+	if isUniqueViolation(err) {
+		utils.RespondWithError(w, http.StatusConflict, "Microchip is already registered to another pet")
+		return
+	}
 	if err != nil {
 		utils.LogMessage(config.LogError, "Failed to update pet: "+err.Error())
 		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update pet")
@@ -171,6 +298,17 @@ func UpdatePetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	pet.ID = petID
+	pet.OwnerID = before.OwnerID
+	if !recordAudit(w, r, tx, "Failed to update pet", audit.ActionUpdate, "pet", petID, before, pet) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit pet update: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update pet")
+		return
+	}
+
 	utils.LogMessage(config.LogInfo, fmt.Sprintf("Pet updated: ID=%d", petID))
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Pet updated successfully"})
 }
@@ -181,24 +319,33 @@ func DeletePetHandler(w http.ResponseWriter, r *http.Request) {
 	petID, _ := strconv.Atoi(vars["id"])
 
 	userID := middleware.GetUserIDFromRequest(r)
-	role := middleware.GetUserRoleFromRequest(r)
 
-	// Check ownership
-	if role != "staff" {
-		var ownerID int
-		err := database.DB.QueryRow("SELECT owner_id FROM pets WHERE id = $1", petID).Scan(&ownerID)
-		if err != nil {
-			utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
-			return
-		}
-		if ownerID != userID {
-			utils.RespondWithError(w, http.StatusForbidden, "Access denied")
-			return
-		}
+	before, err := loadPet(petID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+
+	// Only the primary owner (or staff) can delete
+	if !canAccessPet(r, petID, accessManage) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	// Soft delete the pet together with its appointments and records, stamping all of them
+	// with the same time so a restore brings back exactly what this delete removed
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete pet")
+		return
 	}
+	defer tx.Rollback()
 
-	// Delete pet
-	result, err := database.DB.Exec("DELETE FROM pets WHERE id = $1", petID)
+	result, err := tx.Exec(
+		"UPDATE pets SET deleted_at = NOW(), deleted_by = $1 WHERE id = $2 AND deleted_at IS NULL",
+		userID, petID,
+	)
 	if err != nil {
 		utils.LogMessage(config.LogError, "Failed to delete pet: "+err.Error())
 		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete pet")
@@ -211,6 +358,121 @@ func DeletePetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, table := range []string{"appointments", "medical_records"} {
+		if _, err := tx.Exec(
+			"UPDATE "+table+" SET deleted_at = NOW(), deleted_by = $1 WHERE pet_id = $2 AND deleted_at IS NULL",
+			userID, petID,
+		); err != nil {
+			utils.LogMessage(config.LogError, "Failed to delete pet "+table+": "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete pet")
+			return
+		}
+	}
+
+	if !recordAudit(w, r, tx, "Failed to delete pet", audit.ActionDelete, "pet", petID, before, nil) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit pet deletion: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete pet")
+		return
+	}
+
 	utils.LogMessage(config.LogInfo, fmt.Sprintf("Pet deleted: ID=%d", petID))
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Pet deleted successfully"})
-}
\ No newline at end of file
+}
+
+// loadPet fetches a pet by ID
+func loadPet(petID int) (models.Pet, error) {
+	return scanPet(database.DB.QueryRow("SELECT "+petColumns+" FROM pets WHERE id = $1 AND deleted_at IS NULL", petID))
+}
+
+// petColumns are the pets columns read by scanPet, in order
+const petColumns = `id, name, species, COALESCE(breed, ''), owner_id, COALESCE(medical_history, ''), date_of_birth,
+	sex, neutered, color, markings, COALESCE(microchip, ''), deceased, deceased_at`
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanPet reads petColumns (after any leading columns scanned into extra) and computes the pet's age
+func scanPet(row rowScanner, extra ...interface{}) (models.Pet, error) {
+	var pet models.Pet
+	dest := append(extra, &pet.ID, &pet.Name, &pet.Species, &pet.Breed, &pet.OwnerID, &pet.MedicalHistory, &pet.DateOfBirth,
+		&pet.Sex, &pet.Neutered, &pet.Color, &pet.Markings, &pet.Microchip, &pet.Deceased, &pet.DeceasedAt)
+	if err := row.Scan(dest...); err != nil {
+		return pet, err
+	}
+	setPetAge(&pet)
+	return pet, nil
+}
+
+// setPetAge fills in Age from the date of birth, stopping the clock at death
+func setPetAge(pet *models.Pet) {
+	if pet.DateOfBirth == nil {
+		pet.Age = nil
+		return
+	}
+	asOf := time.Now()
+	if pet.DeceasedAt != nil {
+		asOf = pet.DeceasedAt.Time
+	}
+	age := models.AgeBetween(pet.DateOfBirth.Time, asOf)
+	pet.Age = &age
+}
+
+// normalizePetProfile validates the optional profile fields and puts them in canonical form
+func normalizePetProfile(pet *models.Pet) error {
+	pet.Sex = strings.ToLower(strings.TrimSpace(pet.Sex))
+	if pet.Sex == "" {
+		pet.Sex = "unknown"
+	}
+	if !utils.ContainsString(models.PetSexes, pet.Sex) {
+		return errors.New("Invalid sex. Must be one of " + strings.Join(models.PetSexes, ", "))
+	}
+
+	// Chips are printed with spaces or dashes in various places; store just the code
+	pet.Microchip = strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(pet.Microchip))
+	if pet.Microchip != "" && !validMicrochip.MatchString(pet.Microchip) {
+		return errors.New("Invalid microchip (9 to 15 letters or digits)")
+	}
+
+	today := time.Now().UTC()
+	if pet.DateOfBirth != nil && pet.DateOfBirth.After(today) {
+		return errors.New("Date of birth cannot be in the future")
+	}
+	if pet.DeceasedAt != nil {
+		pet.Deceased = true
+		if pet.DeceasedAt.After(today) {
+			return errors.New("Date of death cannot be in the future")
+		}
+		if pet.DateOfBirth != nil && pet.DeceasedAt.Before(pet.DateOfBirth.Time) {
+			return errors.New("Date of death cannot be before date of birth")
+		}
+	} else if pet.Deceased {
+		pet.DeceasedAt = &models.Date{Time: time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)}
+	}
+
+	setPetAge(pet)
+	return nil
+}
+
+// copyDate returns a copy of d that does not share its storage
+func copyDate(d *models.Date) *models.Date {
+	if d == nil {
+		return nil
+	}
+	c := *d
+	return &c
+}
+
+// validMicrochip matches ISO 11784 15-digit codes and older 9-10 character chips
+var validMicrochip = regexp.MustCompile(`^[0-9A-Z]{9,15}$`)
+
+// isUniqueViolation reports whether err is a PostgreSQL unique constraint violation
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
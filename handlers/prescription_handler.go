@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/utils"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// prescriptionColumns are the prescriptions columns read by scanPrescription, in order
+const prescriptionColumns = "id, pet_id, appointment_id, drug, dose, instructions, allergy_override, COALESCE(prescribed_by, 0), prescribed_at"
+
+// scanPrescription reads prescriptionColumns (after any leading columns scanned into extra)
+func scanPrescription(row rowScanner, extra ...interface{}) (models.Prescription, error) {
+	var p models.Prescription
+	dest := append(extra, &p.ID, &p.PetID, &p.AppointmentID, &p.Drug, &p.Dose, &p.Instructions,
+		&p.AllergyOverride, &p.PrescribedBy, &p.PrescribedAt)
+	err := row.Scan(dest...)
+	return p, err
+}
+
+// CreatePrescriptionHandler prescribes a drug to a pet (staff only). The drug is checked against
+// the pet's drug allergies: a high-severity match is refused with 409 and the matches unless
+// override_reason explains why it is being given anyway, which is kept with the prescription and
+// audited. Every match is returned as allergy_warnings.
+func CreatePrescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+
+	var req models.CreatePrescriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	req.Drug = strings.TrimSpace(req.Drug)
+	req.OverrideReason = strings.TrimSpace(req.OverrideReason)
+	if req.Drug == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Drug is required")
+		return
+	}
+
+	pet, err := loadPet(petID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if pet.Deceased {
+		utils.RespondWithError(w, http.StatusConflict, "Cannot prescribe for a deceased pet")
+		return
+	}
+
+	if req.AppointmentID != nil {
+		apt, err := loadAppointment(*req.AppointmentID)
+		if err != nil || apt.PetID != petID {
+			utils.RespondWithError(w, http.StatusBadRequest, "Appointment not found for this pet")
+			return
+		}
+	}
+
+	conflicts, err := drugAllergyConflicts(petID, req.Drug)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to check drug allergies: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create prescription")
+		return
+	}
+	blocked := allergyBlocks(conflicts)
+	if blocked && req.OverrideReason == "" {
+		utils.LogMessage(config.LogWarn, fmt.Sprintf("Prescription refused for drug allergy: Pet=%d, Drug=%s", petID, req.Drug))
+		utils.RespondWithJSON(w, http.StatusConflict, map[string]interface{}{
+			"error":     "The pet has a high-severity allergy to this drug; pass override_reason to prescribe it anyway",
+			"conflicts": conflicts,
+		})
+		return
+	}
+	if !blocked {
+		// An override is only recorded when it overrode something
+		req.OverrideReason = ""
+	}
+
+	prescription := models.Prescription{
+		PetID:           petID,
+		AppointmentID:   req.AppointmentID,
+		Drug:            req.Drug,
+		Dose:            strings.TrimSpace(req.Dose),
+		Instructions:    req.Instructions,
+		AllergyOverride: req.OverrideReason,
+		PrescribedBy:    middleware.GetUserIDFromRequest(r),
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create prescription")
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO prescriptions (pet_id, appointment_id, drug, dose, instructions, allergy_override, prescribed_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, prescribed_at
+	`, petID, prescription.AppointmentID, prescription.Drug, prescription.Dose, prescription.Instructions,
+		prescription.AllergyOverride, prescription.PrescribedBy,
+	).Scan(&prescription.ID, &prescription.PrescribedAt)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create prescription: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create prescription")
+		return
+	}
+
+	// The matched allergies go into the audit entry so an override shows what it overrode
+	if len(conflicts) > 0 {
+		prescription.AllergyWarnings = conflicts
+	}
+	if !recordAudit(w, r, tx, "Failed to create prescription", audit.ActionCreate, "prescription", prescription.ID, nil, prescription) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit prescription: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create prescription")
+		return
+	}
+
+	if prescription.AllergyOverride != "" {
+		utils.LogMessage(config.LogWarn, fmt.Sprintf("Drug allergy overridden: Prescription=%d, Pet=%d, Drug=%s, By=%d",
+			prescription.ID, petID, prescription.Drug, prescription.PrescribedBy))
+	}
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Prescription created: ID=%d, Pet=%d", prescription.ID, petID))
+	utils.RespondWithJSON(w, http.StatusCreated, prescription)
+}
+
+// GetPrescriptionsHandler lists a pet's prescriptions, newest first.
+// Sort: prescribed_at, id; limit, cursor.
+func GetPrescriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+
+	if _, err := loadPet(petID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, petID, accessRead) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	lq, err := newListQuery(r, listOptions{
+		sortColumns: map[string]string{"prescribed_at": "prescribed_at", "id": "id"},
+		defaultSort: "-prescribed_at",
+		idColumn:    "id",
+	})
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	lq.filter("pet_id =", petID)
+
+	if !recordAccess(w, r, "Failed to fetch prescriptions", audit.ActionView, "prescriptions", petID) {
+		return
+	}
+
+	prescriptions := []models.Prescription{}
+	total, next, err := lq.run(prescriptionColumns, "prescriptions", func(rows *sql.Rows, sortKey *string) (int, error) {
+		p, err := scanPrescription(rows, sortKey)
+		if err != nil {
+			return 0, err
+		}
+		prescriptions = append(prescriptions, p)
+		return p.ID, nil
+	})
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch prescriptions: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch prescriptions")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, models.Page{Items: prescriptions, NextCursor: next, TotalCount: total})
+}
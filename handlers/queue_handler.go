@@ -0,0 +1,504 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/events"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// triageLevels are the queue priorities, most urgent first; an entry's triage_level is its index + 1
+var triageLevels = []string{"emergency", "urgent", "standard", "routine"}
+
+// queueAppointmentStatus is the status a checked-in appointment moves to when its queue entry reaches the key status
+var queueAppointmentStatus = map[string]string{"done": "completed", "left": "no_show"}
+
+// recentVisits is how many of the last day's finished visits the average visit length is taken from
+const recentVisits = 20
+
+// queueColumns are the columns read by scanQueueEntry, in order
+const queueColumns = `q.id, q.pet_id, p.name, q.appointment_id, q.triage_level, q.reason, q.status, q.room,
+	q.checked_in_by, q.checked_in_at, q.called_at, q.completed_at`
+
+// queueTables is the FROM clause for queueColumns
+const queueTables = "queue_entries q JOIN pets p ON q.pet_id = p.id"
+
+// scanQueueEntry reads a row selected with queueColumns
+func scanQueueEntry(row rowScanner) (models.QueueEntry, error) {
+	var e models.QueueEntry
+	var level int
+	err := row.Scan(&e.ID, &e.PetID, &e.PetName, &e.AppointmentID, &level, &e.Reason, &e.Status, &e.Room,
+		&e.CheckedInBy, &e.CheckedInAt, &e.CalledAt, &e.CompletedAt)
+	if err == nil && level >= 1 && level <= len(triageLevels) {
+		e.Priority = triageLevels[level-1]
+	}
+	return e, err
+}
+
+// triageLevel converts a priority name to its triage_level
+func triageLevel(priority string) (int, error) {
+	for i, p := range triageLevels {
+		if p == priority {
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid priority. Must be one of %s", strings.Join(triageLevels, ", "))
+}
+
+// CheckInHandler adds a patient to the queue (staff only). Booked patients are checked in by
+// appointment_id, which must be scheduled for today (clinic time) and is marked checked_in;
+// walk-ins by pet_id.
+func CheckInHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.CheckInRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if req.Priority == "" {
+		req.Priority = "standard"
+	}
+	level, err := triageLevel(req.Priority)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var appointment models.Appointment
+	if req.AppointmentID != nil {
+		appointment, err = loadAppointment(*req.AppointmentID)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusNotFound, "Appointment not found")
+			return
+		}
+		if appointment.Status != "scheduled" {
+			utils.RespondWithError(w, http.StatusConflict, "Appointment is "+appointment.Status)
+			return
+		}
+		if !sameClinicDay(config.ClinicTime(appointment.Date), time.Now()) {
+			utils.RespondWithError(w, http.StatusConflict, "Appointment isn't today")
+			return
+		}
+		req.PetID = appointment.PetID
+		if req.Reason == "" {
+			req.Reason = appointment.Reason
+		}
+	}
+	if req.PetID == 0 {
+		utils.RespondWithError(w, http.StatusBadRequest, "Appointment ID or pet ID is required")
+		return
+	}
+
+	pet, err := loadPet(req.PetID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if pet.Deceased {
+		utils.RespondWithError(w, http.StatusConflict, "Cannot check in a deceased pet")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to check in")
+		return
+	}
+	defer tx.Rollback()
+
+	var entryID int
+	err = tx.QueryRow(
+		"INSERT INTO queue_entries (pet_id, appointment_id, triage_level, reason, checked_in_by) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		req.PetID, req.AppointmentID, level, req.Reason, middleware.GetUserIDFromRequest(r),
+	).Scan(&entryID)
+	if isUniqueViolation(err) {
+		utils.RespondWithError(w, http.StatusConflict, "This pet is already in the queue")
+		return
+	}
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to check in: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to check in")
+		return
+	}
+
+	if req.AppointmentID != nil {
+		result, err := tx.Exec(
+			"UPDATE appointments SET status = 'checked_in' WHERE id = $1 AND deleted_at IS NULL AND status = 'scheduled' AND date::date = "+database.ClinicNow()+"::date",
+			appointment.ID,
+		)
+		if err != nil {
+			utils.LogMessage(config.LogError, "Failed to check in appointment: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to check in")
+			return
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			utils.RespondWithError(w, http.StatusConflict, "Appointment is no longer scheduled")
+			return
+		}
+
+		appointment.Status = "checked_in"
+		if err := events.Publish(tx, events.AppointmentCheckedIn, appointment.PetID, appointment); err != nil {
+			utils.LogMessage(config.LogError, "Failed to publish appointment event: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to check in")
+			return
+		}
+	}
+
+	entry, err := scanQueueEntry(tx.QueryRow("SELECT "+queueColumns+" FROM "+queueTables+" WHERE q.id = $1", entryID))
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to load queue entry: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to check in")
+		return
+	}
+	if err := events.Publish(tx, events.QueueUpdated, entry.PetID, entry); err != nil {
+		utils.LogMessage(config.LogError, "Failed to publish queue event: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to check in")
+		return
+	}
+	if !recordAudit(w, r, tx, "Failed to check in", audit.ActionCreate, "queue_entry", entryID, nil, entry) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit check-in: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to check in")
+		return
+	}
+
+	if queued, err := loadQueueEntry(entryID); err == nil {
+		entry = queued
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Patient checked in: Queue=%d, Pet=%d, Priority=%s", entryID, entry.PetID, entry.Priority))
+	utils.RespondWithJSON(w, http.StatusCreated, entry)
+}
+
+// GetQueueHandler lists the patients in rooms and then those waiting, in the order they will be
+// called, with estimated waits (staff only)
+func GetQueueHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := loadQueue()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch queue: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch queue")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, entries)
+}
+
+// GetQueueEntryHandler shows one queue entry, including its place in line and estimated wait.
+// Guardians of the pet can see it as well as staff.
+func GetQueueEntryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	entryID, _ := strconv.Atoi(vars["id"])
+
+	entry, err := loadQueueEntry(entryID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Queue entry not found")
+		return
+	}
+	if !canAccessPet(r, entry.PetID, accessRead) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, entry)
+}
+
+// TriageQueueEntryHandler changes a waiting patient's priority (staff only)
+func TriageQueueEntryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	entryID, _ := strconv.Atoi(vars["id"])
+
+	var req models.TriageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	level, err := triageLevel(req.Priority)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	after, err := changeQueueEntry(r, entryID, "waiting", "triage_level = $3", level)
+	if err == sql.ErrNoRows {
+		utils.RespondWithError(w, http.StatusConflict, "Patient isn't waiting")
+		return
+	}
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to triage patient: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to triage patient")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Patient triaged: Queue=%d, Priority=%s", entryID, after.Priority))
+	utils.RespondWithJSON(w, http.StatusOK, after)
+}
+
+// CallNextPatientHandler calls the first waiting patient (most urgent, then longest waiting)
+// into a room (staff only)
+func CallNextPatientHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.CallPatientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	req.Room = strings.TrimSpace(req.Room)
+	if req.Room == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Room is required")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to call patient")
+		return
+	}
+	defer tx.Rollback()
+
+	// Patients another room is calling right now are skipped, so each room gets a different one
+	var entryID int
+	err = tx.QueryRow(`
+		SELECT id FROM queue_entries WHERE status = 'waiting'
+		ORDER BY triage_level, checked_in_at, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`).Scan(&entryID)
+	if err == sql.ErrNoRows {
+		utils.RespondWithError(w, http.StatusNotFound, "No patients waiting")
+		return
+	}
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to find next patient: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to call patient")
+		return
+	}
+
+	after, err := updateQueueEntry(tx, r, entryID, "waiting", "status = 'in_room', room = $3, called_at = NOW()", req.Room)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to call patient: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to call patient")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit queue change: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to call patient")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Patient called: Queue=%d, Pet=%d, Room=%s", entryID, after.PetID, after.Room))
+	utils.RespondWithJSON(w, http.StatusOK, after)
+}
+
+// CompleteQueueEntryHandler marks a patient in a room as seen, completing their appointment if they had one (staff only)
+func CompleteQueueEntryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	entryID, _ := strconv.Atoi(vars["id"])
+
+	after, err := changeQueueEntry(r, entryID, "in_room", "status = 'done', completed_at = NOW()")
+	if err == sql.ErrNoRows {
+		utils.RespondWithError(w, http.StatusConflict, "Patient isn't in a room")
+		return
+	}
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to complete visit: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to complete visit")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Visit completed: Queue=%d, Pet=%d", entryID, after.PetID))
+	utils.RespondWithJSON(w, http.StatusOK, after)
+}
+
+// LeaveQueueHandler takes a waiting patient out of the queue, e.g. if they left without being seen,
+// marking their appointment (if any) no_show (staff only)
+func LeaveQueueHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	entryID, _ := strconv.Atoi(vars["id"])
+
+	after, err := changeQueueEntry(r, entryID, "waiting", "status = 'left', completed_at = NOW()")
+	if err == sql.ErrNoRows {
+		utils.RespondWithError(w, http.StatusConflict, "Patient isn't waiting")
+		return
+	}
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to remove patient from queue: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to remove patient from queue")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Patient left queue: Queue=%d, Pet=%d", entryID, after.PetID))
+	utils.RespondWithJSON(w, http.StatusOK, after)
+}
+
+// changeQueueEntry runs updateQueueEntry in its own transaction
+func changeQueueEntry(r *http.Request, entryID int, from, set string, args ...interface{}) (models.QueueEntry, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return models.QueueEntry{}, err
+	}
+	defer tx.Rollback()
+
+	after, err := updateQueueEntry(tx, r, entryID, from, set, args...)
+	if err != nil {
+		return models.QueueEntry{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return models.QueueEntry{}, err
+	}
+
+	// Re-read so a waiting entry comes back with its new place in line
+	if queued, err := loadQueueEntry(entryID); err == nil {
+		after = queued
+	}
+	return after, nil
+}
+
+// updateQueueEntry applies set to an entry whose status is from, moves its checked-in appointment
+// on per queueAppointmentStatus, publishes queue.updated and audits the change. In set, $3 onwards
+// are args. It returns sql.ErrNoRows if the entry isn't in that status.
+func updateQueueEntry(tx *sql.Tx, r *http.Request, entryID int, from, set string, args ...interface{}) (models.QueueEntry, error) {
+	before, err := scanQueueEntry(tx.QueryRow("SELECT "+queueColumns+" FROM "+queueTables+" WHERE q.id = $1 AND q.status = $2 FOR UPDATE OF q", entryID, from))
+	if err != nil {
+		return models.QueueEntry{}, err
+	}
+
+	if _, err := tx.Exec("UPDATE queue_entries SET "+set+" WHERE id = $1 AND status = $2", append([]interface{}{entryID, from}, args...)...); err != nil {
+		return models.QueueEntry{}, err
+	}
+
+	after, err := scanQueueEntry(tx.QueryRow("SELECT "+queueColumns+" FROM "+queueTables+" WHERE q.id = $1", entryID))
+	if err != nil {
+		return models.QueueEntry{}, err
+	}
+	if status, ok := queueAppointmentStatus[after.Status]; ok && after.AppointmentID != nil {
+		result, err := tx.Exec(
+			"UPDATE appointments SET status = $1 WHERE id = $2 AND deleted_at IS NULL AND status = 'checked_in'",
+			status, *after.AppointmentID,
+		)
+		if err != nil {
+			return models.QueueEntry{}, err
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+			if err := audit.Record(tx, r, audit.ActionUpdate, "appointment", *after.AppointmentID,
+				map[string]string{"status": "checked_in"}, map[string]string{"status": status}); err != nil {
+				return models.QueueEntry{}, err
+			}
+		}
+	}
+	if err := events.Publish(tx, events.QueueUpdated, after.PetID, after); err != nil {
+		return models.QueueEntry{}, err
+	}
+	if err := audit.Record(tx, r, audit.ActionUpdate, "queue_entry", entryID, before, after); err != nil {
+		return models.QueueEntry{}, err
+	}
+	return after, nil
+}
+
+// loadQueue returns the patients in rooms followed by those waiting, in calling order, with
+// each waiting patient's position and estimated wait. The estimate assumes config.ExamRooms
+// rooms each take the average length of the last day's recent visits per patient.
+func loadQueue() ([]models.QueueEntry, error) {
+	rows, err := database.DB.Query(`
+		SELECT ` + queueColumns + ` FROM ` + queueTables + `
+		WHERE q.status IN ('waiting', 'in_room')
+		ORDER BY q.status = 'waiting', q.triage_level, q.checked_in_at, q.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []models.QueueEntry{}
+	for rows.Next() {
+		entry, err := scanQueueEntry(rows)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	visit := averageVisit()
+	rooms := config.ExamRooms
+	if rooms < 1 {
+		rooms = 1
+	}
+
+	inRoom, ahead := 0, 0
+	for i := range entries {
+		if entries[i].Status == "in_room" {
+			inRoom++
+			continue
+		}
+		// Everyone ahead (in a room or waiting) has to be seen first, rooms at a time
+		rounds := (inRoom + ahead) / rooms
+		minutes := int(math.Round((time.Duration(rounds) * visit).Minutes()))
+		entries[i].Position = ahead + 1
+		entries[i].EstimatedWaitMinutes = &minutes
+		ahead++
+	}
+	return entries, nil
+}
+
+// loadQueueEntry fetches one queue entry, with its position and estimated wait while it is waiting
+func loadQueueEntry(entryID int) (models.QueueEntry, error) {
+	entry, err := scanQueueEntry(database.DB.QueryRow("SELECT "+queueColumns+" FROM "+queueTables+" WHERE q.id = $1", entryID))
+	if err != nil || entry.Status != "waiting" {
+		return entry, err
+	}
+
+	queue, err := loadQueue()
+	if err != nil {
+		return entry, nil
+	}
+	for _, queued := range queue {
+		if queued.ID == entryID {
+			return queued, nil
+		}
+	}
+	return entry, nil
+}
+
+// sameClinicDay reports whether a and b fall on the same calendar day at the clinic
+func sameClinicDay(a, b time.Time) bool {
+	ay, am, ad := a.In(config.ClinicLocation).Date()
+	by, bm, bd := b.In(config.ClinicLocation).Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// averageVisit is the average time from being called into a room to being done, over the last
+// day's recent visits, or config.AppointmentDuration when there are none yet
+func averageVisit() time.Duration {
+	var seconds float64
+	err := database.DB.QueryRow(`
+		SELECT COALESCE(EXTRACT(EPOCH FROM AVG(completed_at - called_at)), 0) FROM (
+			SELECT called_at, completed_at FROM queue_entries
+			WHERE status = 'done' AND called_at IS NOT NULL AND completed_at > NOW() - INTERVAL '1 day'
+			ORDER BY completed_at DESC
+			LIMIT $1
+		) recent
+	`, recentVisits).Scan(&seconds)
+	if err != nil || seconds <= 0 {
+		return config.AppointmentDuration
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
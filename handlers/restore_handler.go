@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/models"
+	"petclinic/utils"
+	"petclinic/waitlist"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RestorePetHandler restores a soft-deleted pet along with the appointments and records deleted with it (staff only)
+func RestorePetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to restore pet")
+		return
+	}
+	defer tx.Rollback()
+
+	var deletedAt time.Time
+	err = tx.QueryRow(
+		"UPDATE pets p SET deleted_at = NULL, deleted_by = NULL FROM pets old WHERE p.id = old.id AND p.id = $1 AND p.deleted_at IS NOT NULL RETURNING old.deleted_at",
+		petID,
+	).Scan(&deletedAt)
+	if isUniqueViolation(err) {
+		utils.RespondWithError(w, http.StatusConflict, "Pet's microchip is now registered to another pet")
+		return
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Deleted pet not found")
+		return
+	}
+
+	// Children deleted in the same operation share the pet's deleted_at timestamp
+	for _, table := range []string{"appointments", "medical_records"} {
+		if _, err := tx.Exec(
+			"UPDATE "+table+" SET deleted_at = NULL, deleted_by = NULL WHERE pet_id = $1 AND deleted_at = $2",
+			petID, deletedAt,
+		); err != nil {
+			utils.LogMessage(config.LogError, "Failed to restore pet "+table+": "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to restore pet")
+			return
+		}
+	}
+	if !recordAudit(w, r, tx, "Failed to restore pet", audit.ActionRestore, "pet", petID, nil, nil) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit pet restore: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to restore pet")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Pet restored: ID=%d", petID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Pet restored successfully"})
+}
+
+// RestoreAppointmentHandler restores a soft-deleted appointment (staff only)
+func RestoreAppointmentHandler(w http.ResponseWriter, r *http.Request) {
+	restorePetChild(w, r, "appointments", "appointment", "Appointment")
+}
+
+// RestoreMedicalRecordHandler restores a soft-deleted medical record (staff only)
+func RestoreMedicalRecordHandler(w http.ResponseWriter, r *http.Request) {
+	restorePetChild(w, r, "medical_records", "medical_record", "Medical record")
+}
+
+// restorePetChild restores a soft-deleted row that belongs to a pet, refusing while the pet itself is deleted
+func restorePetChild(w http.ResponseWriter, r *http.Request, table, resourceType, label string) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to restore "+resourceType)
+		return
+	}
+	defer tx.Rollback()
+
+	var petDeleted bool
+	err = tx.QueryRow(
+		"SELECT p.deleted_at IS NOT NULL FROM "+table+" c JOIN pets p ON c.pet_id = p.id WHERE c.id = $1 AND c.deleted_at IS NOT NULL",
+		id,
+	).Scan(&petDeleted)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Deleted "+resourceType+" not found")
+		return
+	}
+	if petDeleted {
+		utils.RespondWithError(w, http.StatusConflict, "Restore the pet first")
+		return
+	}
+
+	// A restored booking that is still active counts as a new booking: it is refused for a deceased
+	// pet and takes its slot back from the waitlist
+	if table == "appointments" {
+		var status string
+		var deceased bool
+		err := tx.QueryRow(
+			"SELECT a.status, p.deceased FROM appointments a JOIN pets p ON a.pet_id = p.id WHERE a.id = $1", id,
+		).Scan(&status, &deceased)
+		if err != nil {
+			utils.LogMessage(config.LogError, "Failed to load appointment: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to restore "+resourceType)
+			return
+		}
+		active := utils.ContainsString(models.ActiveAppointmentStatuses, status)
+		if active && deceased {
+			utils.RespondWithError(w, http.StatusConflict, "Cannot book an appointment for a deceased pet")
+			return
+		}
+		if active {
+			err := waitlist.ReclaimSlot(tx, id)
+			if err == waitlist.ErrSlotClaimed {
+				utils.RespondWithError(w, http.StatusConflict, "The slot has been booked from the waitlist")
+				return
+			}
+			if err != nil {
+				utils.LogMessage(config.LogError, "Failed to withdraw waitlist offer: "+err.Error())
+				utils.RespondWithError(w, http.StatusInternalServerError, "Failed to restore "+resourceType)
+				return
+			}
+		}
+	}
+
+	result, err := tx.Exec(
+		"UPDATE "+table+" SET deleted_at = NULL, deleted_by = NULL WHERE id = $1 AND deleted_at IS NOT NULL",
+		id,
+	)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to restore "+resourceType+": "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to restore "+resourceType)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondWithError(w, http.StatusNotFound, "Deleted "+resourceType+" not found")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to restore "+resourceType, audit.ActionRestore, resourceType, id, nil, nil) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit "+resourceType+" restore: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to restore "+resourceType)
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("%s restored: ID=%d", label, id))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": label + " restored successfully"})
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/utils"
+	"strconv"
+	"strings"
+)
+
+// SearchHandler runs a ranked full-text search over pets (name, species, breed, owner name,
+// medical history) and, for staff, owners (name, email, contact). Any word may match, and
+// results matching more of the words rank higher; the last word may be partial so results
+// narrow as the user types.
+// Params: q (required), type (pet or owner), limit (default 20, max 100).
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	tsQuery := buildPrefixQuery(q.Get("q"))
+	if tsQuery == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Search query is required")
+		return
+	}
+
+	resultType := q.Get("type")
+	if resultType != "" && resultType != "pet" && resultType != "owner" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid type (must be pet or owner)")
+		return
+	}
+
+	limit := 20
+	if v := q.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 100 {
+			limit = n
+		}
+	}
+
+	userID := middleware.GetUserIDFromRequest(r)
+	role := middleware.GetUserRoleFromRequest(r)
+
+	args := []interface{}{tsQuery}
+	var parts []string
+
+	if resultType != "owner" {
+		pets := `
+			SELECT 'pet' AS type, p.id, p.name, p.species || COALESCE(', ' || NULLIF(p.breed, ''), ''), p.owner_id, ts_rank(p.search_vector, query) AS rank
+			FROM pets p, to_tsquery('english', $1) query
+			WHERE p.search_vector @@ query AND p.deleted_at IS NULL`
+		if role != "staff" {
+			args = append(args, userID)
+			pets += " AND " + guardianPetsCondition("p.id", len(args))
+		}
+		parts = append(parts, pets)
+	}
+
+	// Owners can only find their own pets, so owner results are staff-only
+	if resultType != "pet" && role == "staff" {
+		parts = append(parts, `
+			SELECT 'owner' AS type, o.id, o.name, o.email, o.id, ts_rank(o.search_vector, query) AS rank
+			FROM owners o, to_tsquery('english', $1) query
+			WHERE o.search_vector @@ query`)
+	}
+
+	results := []models.SearchResult{}
+	if len(parts) == 0 {
+		utils.RespondWithJSON(w, http.StatusOK, results)
+		return
+	}
+
+	query := strings.Join(parts, " UNION ALL ") + fmt.Sprintf(" ORDER BY rank DESC, type, id LIMIT %d", limit)
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to search: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to search")
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result models.SearchResult
+		if err := rows.Scan(&result.Type, &result.ID, &result.Title, &result.Subtitle, &result.OwnerID, &result.Rank); err != nil {
+			continue
+		}
+		results = append(results, result)
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, results)
+}
+
+// buildPrefixQuery turns free text into a to_tsquery expression that ORs every word,
+// treating the last one as a prefix. tsquery operators in the input are dropped.
+func buildPrefixQuery(text string) string {
+	clean := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`&|!():*<>'"\`, r) {
+			return ' '
+		}
+		return r
+	}, text)
+
+	words := strings.Fields(clean)
+	if len(words) == 0 {
+		return ""
+	}
+	if len(words) > 10 {
+		words = words[:10]
+	}
+	words[len(words)-1] += ":*"
+	return strings.Join(words, " | ")
+}
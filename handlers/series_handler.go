@@ -0,0 +1,578 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/events"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/recurrence"
+	"petclinic/utils"
+	"petclinic/waitlist"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// wallClockLayout formats appointment dates, which are stored as wall-clock times without a zone
+const wallClockLayout = "2006-01-02 15:04:05"
+
+// seriesSlot is an occurrence of a series already booked in the appointments table
+type seriesSlot struct {
+	appointment models.Appointment
+	plain       bool // not deleted, not an exception and still scheduled, so series edits may change it
+}
+
+// CreateAppointmentSeriesHandler books an appointment for every occurrence of a recurrence rule.
+// If any occurrence overlaps one of the pet's appointments nothing is booked and the conflicts
+// are returned with 409, unless ?skip_conflicts=true, which books the rest.
+func CreateAppointmentSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserIDFromRequest(r)
+
+	var req models.AppointmentSeriesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if req.PetID == 0 || req.Start.IsZero() || req.RRule == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Pet ID, start and rrule are required")
+		return
+	}
+
+	rule, err := recurrence.Parse(req.RRule)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid rrule: "+err.Error())
+		return
+	}
+	times, err := rule.Occurrences(req.Start)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid rrule: "+err.Error())
+		return
+	}
+
+	pet, err := loadPet(req.PetID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+
+	if !canAccessPet(r, req.PetID, accessBook) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied - you can't book for this pet")
+		return
+	}
+
+	if pet.Deceased {
+		utils.RespondWithError(w, http.StatusConflict, "Cannot book an appointment for a deceased pet")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create appointment series")
+		return
+	}
+	defer tx.Rollback()
+
+	// Serialize series bookings for the pet so two can't claim the same slots
+	if _, err := tx.Exec("SELECT id FROM pets WHERE id = $1 FOR UPDATE", req.PetID); err != nil {
+		utils.LogMessage(config.LogError, "Failed to lock pet: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create appointment series")
+		return
+	}
+
+	conflicts, err := findAppointmentConflicts(tx, req.PetID, times)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to check appointment conflicts: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create appointment series")
+		return
+	}
+	if len(conflicts) > 0 && r.URL.Query().Get("skip_conflicts") != "true" {
+		respondWithConflicts(w, conflicts)
+		return
+	}
+
+	series := models.AppointmentSeries{
+		PetID:     req.PetID,
+		RRule:     rule.String(),
+		Start:     req.Start,
+		Reason:    req.Reason,
+		CreatedBy: &userID,
+		Skipped:   conflicts,
+	}
+	err = tx.QueryRow(
+		"INSERT INTO appointment_series (pet_id, rrule, dtstart, reason, created_by) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		series.PetID, series.RRule, series.Start, series.Reason, userID,
+	).Scan(&series.ID, &series.CreatedAt)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create appointment series: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create appointment series")
+		return
+	}
+
+	series.Appointments, err = bookSeriesOccurrences(tx, series, withoutConflicts(times, conflicts))
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to book series occurrences: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create appointment series")
+		return
+	}
+	if len(series.Appointments) == 0 {
+		utils.RespondWithError(w, http.StatusConflict, "Every occurrence conflicts with an existing appointment")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to create appointment series", audit.ActionCreate, "appointment_series", series.ID, nil, series) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit appointment series: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create appointment series")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Appointment series created: ID=%d, Pet=%d, Occurrences=%d, Skipped=%d",
+		series.ID, series.PetID, len(series.Appointments), len(conflicts)))
+	utils.RespondWithJSON(w, http.StatusCreated, series)
+}
+
+// GetAppointmentSeriesHandler returns a series with its appointments
+func GetAppointmentSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	seriesID, _ := strconv.Atoi(vars["id"])
+
+	series, err := loadAppointmentSeries(seriesID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Appointment series not found")
+		return
+	}
+	if !canAccessPet(r, series.PetID, accessRead) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, series)
+}
+
+// UpdateAppointmentSeriesHandler replaces a series' rule, start and reason. Only upcoming occurrences
+// change: ones the new rule no longer produces are removed, new ones are booked (conflicts are
+// handled as on create) and the rest take the new reason. Occurrences changed on their own are left alone.
+func UpdateAppointmentSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	seriesID, _ := strconv.Atoi(vars["id"])
+	userID := middleware.GetUserIDFromRequest(r)
+
+	var req models.AppointmentSeriesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if req.Start.IsZero() || req.RRule == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Start and rrule are required")
+		return
+	}
+
+	rule, err := recurrence.Parse(req.RRule)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid rrule: "+err.Error())
+		return
+	}
+	times, err := rule.Occurrences(req.Start)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid rrule: "+err.Error())
+		return
+	}
+
+	before, err := loadAppointmentSeries(seriesID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Appointment series not found")
+		return
+	}
+	if !canAccessPet(r, before.PetID, accessBook) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+	if before.CancelledAt != nil {
+		utils.RespondWithError(w, http.StatusConflict, "Appointment series has been cancelled")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment series")
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT id FROM pets WHERE id = $1 FOR UPDATE", before.PetID); err != nil {
+		utils.LogMessage(config.LogError, "Failed to lock pet: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment series")
+		return
+	}
+
+	slots, err := loadUpcomingSeriesSlots(tx, seriesID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to load series occurrences: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment series")
+		return
+	}
+
+	// Compare the new rule's upcoming occurrences with the slots already booked
+	now := time.Now()
+	wanted := map[string]bool{}
+	var added []time.Time
+	for _, t := range times {
+		if config.ClinicTime(t).Before(now) {
+			continue
+		}
+		key := t.Format(wallClockLayout)
+		wanted[key] = true
+		if _, ok := slots[key]; !ok {
+			added = append(added, t)
+		}
+	}
+
+	var kept, removed []int
+	for key, slot := range slots {
+		switch {
+		case !slot.plain:
+		case wanted[key]:
+			kept = append(kept, slot.appointment.ID)
+		default:
+			removed = append(removed, slot.appointment.ID)
+			if err := events.Publish(tx, events.AppointmentCancelled, slot.appointment.PetID, slot.appointment); err != nil {
+				utils.LogMessage(config.LogError, "Failed to publish appointment event: "+err.Error())
+				utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment series")
+				return
+			}
+		}
+	}
+
+	// Removed occurrences are detached so a later rule that produces the same slot books it again
+	if len(removed) > 0 {
+		if _, err := tx.Exec(
+			"UPDATE appointments SET deleted_at = NOW(), deleted_by = $1, series_id = NULL WHERE id = ANY($2)",
+			userID, pq.Array(removed),
+		); err != nil {
+			utils.LogMessage(config.LogError, "Failed to remove series occurrences: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment series")
+			return
+		}
+		// Their slots go to the waitlist like any cancelled booking
+		for _, id := range removed {
+			if err := waitlist.OfferSlot(tx, id); err != nil {
+				utils.LogMessage(config.LogError, "Failed to offer slot to waitlist: "+err.Error())
+				utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment series")
+				return
+			}
+		}
+	}
+	if len(kept) > 0 {
+		if _, err := tx.Exec("UPDATE appointments SET reason = $1 WHERE id = ANY($2)", req.Reason, pq.Array(kept)); err != nil {
+			utils.LogMessage(config.LogError, "Failed to update series occurrences: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment series")
+			return
+		}
+	}
+
+	conflicts, err := findAppointmentConflicts(tx, before.PetID, added)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to check appointment conflicts: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment series")
+		return
+	}
+	if len(conflicts) > 0 && r.URL.Query().Get("skip_conflicts") != "true" {
+		respondWithConflicts(w, conflicts)
+		return
+	}
+
+	series := before
+	series.RRule = rule.String()
+	series.Start = req.Start
+	series.Reason = req.Reason
+	if _, err := tx.Exec(
+		"UPDATE appointment_series SET rrule = $1, dtstart = $2, reason = $3 WHERE id = $4",
+		series.RRule, series.Start, series.Reason, seriesID,
+	); err != nil {
+		utils.LogMessage(config.LogError, "Failed to update appointment series: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment series")
+		return
+	}
+
+	booked, err := bookSeriesOccurrences(tx, series, withoutConflicts(added, conflicts))
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to book series occurrences: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment series")
+		return
+	}
+
+	series.Skipped = conflicts
+	if !recordAudit(w, r, tx, "Failed to update appointment series", audit.ActionUpdate, "appointment_series", seriesID, before, series) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit appointment series: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update appointment series")
+		return
+	}
+
+	series.Appointments, err = loadSeriesAppointments(seriesID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to load series appointments: "+err.Error())
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Appointment series updated: ID=%d, Added=%d, Removed=%d, Skipped=%d",
+		seriesID, len(booked), len(removed), len(conflicts)))
+	utils.RespondWithJSON(w, http.StatusOK, series)
+}
+
+// CancelAppointmentSeriesHandler ends a series and cancels its upcoming scheduled occurrences,
+// including ones changed on their own. Past occurrences are kept.
+func CancelAppointmentSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	seriesID, _ := strconv.Atoi(vars["id"])
+
+	before, err := loadAppointmentSeries(seriesID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Appointment series not found")
+		return
+	}
+	if !canAccessPet(r, before.PetID, accessBook) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to cancel appointment series")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE appointment_series SET cancelled_at = NOW() WHERE id = $1 AND cancelled_at IS NULL", seriesID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to cancel appointment series: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to cancel appointment series")
+		return
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondWithError(w, http.StatusConflict, "Appointment series has already been cancelled")
+		return
+	}
+
+	rows, err := tx.Query(`
+		UPDATE appointments SET status = 'cancelled'
+		WHERE series_id = $1 AND deleted_at IS NULL AND status = 'scheduled' AND date >= `+database.ClinicNow()+`
+		RETURNING id, pet_id, date, reason, vet, status, series_id, series_exception
+	`, seriesID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to cancel series occurrences: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to cancel appointment series")
+		return
+	}
+	var cancelled []models.Appointment
+	for rows.Next() {
+		var apt models.Appointment
+		if err := rows.Scan(&apt.ID, &apt.PetID, &apt.Date, &apt.Reason, &apt.Vet, &apt.Status, &apt.SeriesID, &apt.SeriesException); err != nil {
+			continue
+		}
+		cancelled = append(cancelled, apt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to cancel series occurrences: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to cancel appointment series")
+		return
+	}
+
+	for _, apt := range cancelled {
+		if err := events.Publish(tx, events.AppointmentCancelled, apt.PetID, apt); err != nil {
+			utils.LogMessage(config.LogError, "Failed to publish appointment event: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to cancel appointment series")
+			return
+		}
+		if err := waitlist.OfferSlot(tx, apt.ID); err != nil {
+			utils.LogMessage(config.LogError, "Failed to offer slot to waitlist: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to cancel appointment series")
+			return
+		}
+	}
+
+	if !recordAudit(w, r, tx, "Failed to cancel appointment series", audit.ActionDelete, "appointment_series", seriesID, before, nil) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit appointment series cancel: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to cancel appointment series")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Appointment series cancelled: ID=%d, Occurrences=%d", seriesID, len(cancelled)))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"message":   "Appointment series cancelled",
+		"cancelled": len(cancelled),
+	})
+}
+
+// findAppointmentConflicts returns, for each time, the pet's active appointments that would
+// overlap an appointment starting then (both lasting config.AppointmentDuration)
+func findAppointmentConflicts(tx *sql.Tx, petID int, times []time.Time) ([]models.AppointmentConflict, error) {
+	if len(times) == 0 {
+		return nil, nil
+	}
+
+	dates := make([]string, 0, len(times))
+	for _, t := range times {
+		dates = append(dates, t.Format(wallClockLayout))
+	}
+
+	rows, err := tx.Query(`
+		SELECT o.date, a.id, a.date
+		FROM unnest($2::timestamp[]) AS o(date)
+		JOIN appointments a ON a.pet_id = $1 AND a.deleted_at IS NULL AND a.status IS DISTINCT FROM 'cancelled'
+			AND a.date > o.date - $3 * INTERVAL '1 second' AND a.date < o.date + $3 * INTERVAL '1 second'
+		ORDER BY o.date, a.date
+	`, petID, pq.Array(dates), config.AppointmentDuration.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conflicts []models.AppointmentConflict
+	for rows.Next() {
+		var c models.AppointmentConflict
+		if err := rows.Scan(&c.Date, &c.AppointmentID, &c.ExistingDate); err != nil {
+			continue
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, rows.Err()
+}
+
+// withoutConflicts drops the times that have a conflict
+func withoutConflicts(times []time.Time, conflicts []models.AppointmentConflict) []time.Time {
+	taken := map[string]bool{}
+	for _, c := range conflicts {
+		taken[c.Date.Format(wallClockLayout)] = true
+	}
+
+	var free []time.Time
+	for _, t := range times {
+		if !taken[t.Format(wallClockLayout)] {
+			free = append(free, t)
+		}
+	}
+	return free
+}
+
+// respondWithConflicts rejects a series whose occurrences overlap existing appointments
+func respondWithConflicts(w http.ResponseWriter, conflicts []models.AppointmentConflict) {
+	utils.RespondWithJSON(w, http.StatusConflict, map[string]interface{}{
+		"error":     "Some occurrences overlap existing appointments; pass skip_conflicts=true to book the rest",
+		"conflicts": conflicts,
+	})
+}
+
+// bookSeriesOccurrences inserts an appointment for each time and publishes appointment.created for it
+func bookSeriesOccurrences(tx *sql.Tx, series models.AppointmentSeries, times []time.Time) ([]models.Appointment, error) {
+	appointments := []models.Appointment{}
+	for _, t := range times {
+		apt := models.Appointment{PetID: series.PetID, Date: t, Reason: series.Reason, Status: "scheduled", SeriesID: &series.ID}
+		err := tx.QueryRow(
+			"INSERT INTO appointments (pet_id, date, reason, status, series_id, series_date) VALUES ($1, $2, $3, $4, $5, $2) RETURNING id",
+			apt.PetID, apt.Date, apt.Reason, apt.Status, series.ID,
+		).Scan(&apt.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := events.Publish(tx, events.AppointmentCreated, apt.PetID, apt); err != nil {
+			return nil, err
+		}
+		appointments = append(appointments, apt)
+	}
+	return appointments, nil
+}
+
+// loadUpcomingSeriesSlots returns the series' slots from now on, keyed by their wall-clock date.
+// Deleted occurrences are included so series edits don't book them again.
+func loadUpcomingSeriesSlots(tx *sql.Tx, seriesID int) (map[string]seriesSlot, error) {
+	rows, err := tx.Query(`
+		SELECT id, pet_id, date, reason, vet, status, series_id, series_exception, series_date,
+			deleted_at IS NULL AND NOT series_exception AND status = 'scheduled'
+		FROM appointments
+		WHERE series_id = $1 AND series_date >= `+database.ClinicNow()+`
+		FOR UPDATE
+	`, seriesID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	slots := map[string]seriesSlot{}
+	for rows.Next() {
+		var slot seriesSlot
+		var seriesDate time.Time
+		apt := &slot.appointment
+		if err := rows.Scan(&apt.ID, &apt.PetID, &apt.Date, &apt.Reason, &apt.Vet, &apt.Status, &apt.SeriesID, &apt.SeriesException,
+			&seriesDate, &slot.plain); err != nil {
+			continue
+		}
+		slots[seriesDate.Format(wallClockLayout)] = slot
+	}
+	return slots, rows.Err()
+}
+
+// loadAppointmentSeries fetches a series and its appointments that have not been deleted
+func loadAppointmentSeries(seriesID int) (models.AppointmentSeries, error) {
+	var series models.AppointmentSeries
+	err := database.DB.QueryRow(`
+		SELECT id, pet_id, rrule, dtstart, COALESCE(reason, ''), created_by, created_at, cancelled_at
+		FROM appointment_series
+		WHERE id = $1
+	`, seriesID).Scan(&series.ID, &series.PetID, &series.RRule, &series.Start, &series.Reason,
+		&series.CreatedBy, &series.CreatedAt, &series.CancelledAt)
+	if err != nil {
+		return series, err
+	}
+
+	series.Appointments, err = loadSeriesAppointments(seriesID)
+	return series, err
+}
+
+// loadSeriesAppointments lists a series' appointments that have not been deleted, by date
+func loadSeriesAppointments(seriesID int) ([]models.Appointment, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, pet_id, date, reason, vet, status, series_id, series_exception
+		FROM appointments
+		WHERE series_id = $1 AND deleted_at IS NULL
+		ORDER BY date, id
+	`, seriesID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appointments := []models.Appointment{}
+	for rows.Next() {
+		var apt models.Appointment
+		if err := rows.Scan(&apt.ID, &apt.PetID, &apt.Date, &apt.Reason, &apt.Vet, &apt.Status, &apt.SeriesID, &apt.SeriesException); err != nil {
+			continue
+		}
+		appointments = append(appointments, apt)
+	}
+	return appointments, rows.Err()
+}
@@ -0,0 +1,465 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/outbox"
+	"petclinic/utils"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// transferColumns are the columns read by scanTransfer, in order. Pending transfers past
+// their expiry are reported as expired without needing a job to update them.
+const transferColumns = `t.id, t.pet_id, p.name, COALESCE(t.from_owner_id, 0), t.to_email, t.to_owner_id,
+	CASE WHEN t.status = 'pending' AND t.expires_at <= NOW() THEN 'expired' ELSE t.status END,
+	t.note, COALESCE(t.initiated_by, 0), t.expires_at, t.responded_at, t.created_at`
+
+// scanTransfer reads a row selected with transferColumns
+func scanTransfer(row rowScanner) (models.PetTransfer, error) {
+	var t models.PetTransfer
+	err := row.Scan(&t.ID, &t.PetID, &t.PetName, &t.FromOwnerID, &t.ToEmail, &t.ToOwnerID,
+		&t.Status, &t.Note, &t.InitiatedBy, &t.ExpiresAt, &t.RespondedAt, &t.CreatedAt)
+	return t, err
+}
+
+// CreatePetTransferHandler asks another account to take over as a pet's primary owner
+// (primary owner or staff). The pet moves only once the recipient accepts.
+func CreatePetTransferHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+
+	var req models.CreateTransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email == "" || !strings.Contains(req.Email, "@") {
+		utils.RespondWithError(w, http.StatusBadRequest, "A valid email is required")
+		return
+	}
+
+	pet, err := loadPet(petID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, petID, accessManage) {
+		utils.RespondWithError(w, http.StatusForbidden, "Only the primary owner can transfer a pet")
+		return
+	}
+
+	token, err := utils.GenerateToken(32)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create transfer")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create transfer")
+		return
+	}
+	defer tx.Rollback()
+
+	var ownerEmail string
+	if err := tx.QueryRow("SELECT email FROM owners WHERE id = $1", pet.OwnerID).Scan(&ownerEmail); err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch pet owner: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create transfer")
+		return
+	}
+	if strings.EqualFold(ownerEmail, req.Email) {
+		utils.RespondWithError(w, http.StatusBadRequest, "The pet already belongs to this person")
+		return
+	}
+
+	// Expired requests no longer block a new one
+	if _, err := tx.Exec(
+		"UPDATE pet_transfers SET status = 'expired' WHERE pet_id = $1 AND status = 'pending' AND expires_at <= NOW()",
+		petID,
+	); err != nil {
+		utils.LogMessage(config.LogError, "Failed to expire pet transfers: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create transfer")
+		return
+	}
+
+	transfer := models.PetTransfer{
+		PetID:       petID,
+		PetName:     pet.Name,
+		FromOwnerID: pet.OwnerID,
+		ToEmail:     req.Email,
+		Status:      "pending",
+		Note:        req.Note,
+		InitiatedBy: middleware.GetUserIDFromRequest(r),
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO pet_transfers (pet_id, from_owner_id, to_email, note, initiated_by, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW() + $7 * INTERVAL '1 second') RETURNING id, expires_at, created_at
+	`, petID, pet.OwnerID, req.Email, req.Note, transfer.InitiatedBy, utils.HashToken(token), config.PetTransferTTL.Seconds(),
+	).Scan(&transfer.ID, &transfer.ExpiresAt, &transfer.CreatedAt)
+	if isUniqueViolation(err) {
+		utils.RespondWithError(w, http.StatusConflict, "A transfer for this pet is already pending")
+		return
+	}
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create pet transfer: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create transfer")
+		return
+	}
+
+	link := fmt.Sprintf("%s/transfers/%d?token=%s", config.AppBaseURL, transfer.ID, url.QueryEscape(token))
+	body := fmt.Sprintf("You have been asked to become %s's owner at Pet Clinic.\n\n"+
+		"Sign in (or register with this email address), verify your email and review the request at the link below. It expires in %s.\n\n%s\n\n"+
+		"Accepting gives you %s's full history, including appointments and medical records.\n\n"+
+		"If you weren't expecting this, you can ignore this email.", pet.Name, config.PetTransferTTL, link, pet.Name)
+	if req.Note != "" {
+		body = fmt.Sprintf("%s\n\nMessage from the current owner:\n%s", body, req.Note)
+	}
+
+	if err := outbox.EnqueueEmail(tx, req.Email, "Transfer of "+pet.Name+" to you", body); err != nil {
+		utils.LogMessage(config.LogError, "Failed to queue transfer email: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create transfer")
+		return
+	}
+	if !recordAudit(w, r, tx, "Failed to create transfer", audit.ActionCreate, "pet_transfer", transfer.ID, nil, transfer) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit pet transfer: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create transfer")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Pet transfer requested: ID=%d, Pet=%d, From=%d, By=%d", transfer.ID, petID, pet.OwnerID, transfer.InitiatedBy))
+	utils.RespondWithJSON(w, http.StatusCreated, transfer)
+}
+
+// GetPetTransfersHandler lists a pet's transfer requests, newest first (primary owner or staff)
+func GetPetTransfersHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+
+	if _, err := loadPet(petID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, petID, accessManage) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	respondWithTransfers(w, "t.pet_id = $1", petID)
+}
+
+// GetIncomingTransfersHandler lists the pending transfers addressed to the caller's email
+func GetIncomingTransfersHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithTransfers(w, "LOWER(t.to_email) = LOWER($1) AND t.status = 'pending' AND t.expires_at > NOW()",
+		middleware.GetUserEmailFromRequest(r))
+}
+
+// respondWithTransfers writes the transfers matching condition as JSON
+func respondWithTransfers(w http.ResponseWriter, condition string, args ...interface{}) {
+	rows, err := database.DB.Query(`
+		SELECT `+transferColumns+`
+		FROM pet_transfers t JOIN pets p ON t.pet_id = p.id
+		WHERE p.deleted_at IS NULL AND `+condition+`
+		ORDER BY t.created_at DESC, t.id DESC`, args...)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch pet transfers: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch transfers")
+		return
+	}
+	defer rows.Close()
+
+	transfers := []models.PetTransfer{}
+	for rows.Next() {
+		t, err := scanTransfer(rows)
+		if err != nil {
+			utils.LogMessage(config.LogError, "Failed to read pet transfer: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch transfers")
+			return
+		}
+		transfers = append(transfers, t)
+	}
+	if err := rows.Err(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch pet transfers: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch transfers")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, transfers)
+}
+
+// transferToken reads the token from a transfer email out of the request body. Answering a
+// transfer also needs a verified email address, whatever REQUIRE_VERIFIED_EMAIL says, since
+// matching to_email alone would let anyone who registers that address take the pet.
+func transferToken(w http.ResponseWriter, r *http.Request, failMessage string) (string, bool) {
+	var req models.AcceptInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Token is required")
+		return "", false
+	}
+
+	var verified bool
+	err := database.DB.QueryRow("SELECT email_verified FROM owners WHERE id = $1", middleware.GetUserIDFromRequest(r)).Scan(&verified)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to check email verification: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, failMessage)
+		return "", false
+	}
+	if !verified {
+		utils.RespondWithError(w, http.StatusForbidden, "Please verify your email address first")
+		return "", false
+	}
+	return req.Token, true
+}
+
+// AcceptPetTransferHandler makes the caller the pet's primary owner. The caller needs the token
+// from the transfer email, sent to their own verified email address. The pet keeps its
+// appointments and records; everyone the previous owner shared it with loses access, and the
+// change is added to the chain of custody.
+func AcceptPetTransferHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	transferID, _ := strconv.Atoi(vars["id"])
+
+	token, ok := transferToken(w, r, "Failed to accept transfer")
+	if !ok {
+		return
+	}
+
+	userID := middleware.GetUserIDFromRequest(r)
+	email := middleware.GetUserEmailFromRequest(r)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to accept transfer")
+		return
+	}
+	defer tx.Rollback()
+
+	var petID, fromOwnerID int
+	err = tx.QueryRow(`
+		UPDATE pet_transfers SET status = 'accepted', to_owner_id = $1, responded_at = NOW()
+		WHERE id = $2 AND status = 'pending' AND expires_at > NOW() AND LOWER(to_email) = LOWER($3) AND token_hash = $4
+		RETURNING pet_id, COALESCE(from_owner_id, 0)
+	`, userID, transferID, email, utils.HashToken(token)).Scan(&petID, &fromOwnerID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Transfer not found or no longer pending")
+		return
+	}
+
+	// Lock the pet so a concurrent transfer or delete can't interleave
+	var currentOwnerID int
+	err = tx.QueryRow("SELECT owner_id FROM pets WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", petID).Scan(&currentOwnerID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if currentOwnerID != fromOwnerID {
+		utils.RespondWithError(w, http.StatusConflict, "The pet's owner has changed since the transfer was requested")
+		return
+	}
+
+	steps := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"UPDATE pets SET owner_id = $1 WHERE id = $2", []interface{}{userID, petID}},
+		// The new owner decides who else has access
+		{"DELETE FROM pet_guardians WHERE pet_id = $1", []interface{}{petID}},
+		{"UPDATE pet_guardian_invitations SET expires_at = NOW() WHERE pet_id = $1 AND accepted_at IS NULL AND expires_at > NOW()", []interface{}{petID}},
+		{"INSERT INTO pet_guardians (pet_id, owner_id, role, can_book, added_by) VALUES ($1, $2, 'primary', TRUE, $2)", []interface{}{petID, userID}},
+		{"UPDATE pet_ownership_history SET ended_at = NOW() WHERE pet_id = $1 AND ended_at IS NULL", []interface{}{petID}},
+		{"INSERT INTO pet_ownership_history (pet_id, owner_id, transfer_id, started_at) VALUES ($1, $2, $3, NOW())", []interface{}{petID, userID, transferID}},
+	}
+	for _, step := range steps {
+		if _, err := tx.Exec(step.query, step.args...); err != nil {
+			utils.LogMessage(config.LogError, "Failed to transfer pet: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to accept transfer")
+			return
+		}
+	}
+
+	if !recordAudit(w, r, tx, "Failed to accept transfer", audit.ActionUpdate, "pet_transfer", transferID,
+		map[string]string{"status": "pending"}, map[string]string{"status": "accepted"}) {
+		return
+	}
+	if !recordAudit(w, r, tx, "Failed to accept transfer", audit.ActionUpdate, "pet", petID,
+		map[string]int{"owner_id": fromOwnerID}, map[string]int{"owner_id": userID}) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit pet transfer: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to accept transfer")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Pet transferred: ID=%d, Pet=%d, From=%d, To=%d", transferID, petID, fromOwnerID, userID))
+
+	pet, err := loadPet(petID)
+	if err != nil {
+		utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Transfer accepted"})
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, pet)
+}
+
+// DeclinePetTransferHandler turns down a transfer addressed to the caller, using the token from the transfer email
+func DeclinePetTransferHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	transferID, _ := strconv.Atoi(vars["id"])
+
+	token, ok := transferToken(w, r, "Failed to decline transfer")
+	if !ok {
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to decline transfer")
+		return
+	}
+	defer tx.Rollback()
+
+	var petID int
+	err = tx.QueryRow(`
+		UPDATE pet_transfers SET status = 'declined', responded_at = NOW()
+		WHERE id = $1 AND status = 'pending' AND expires_at > NOW() AND LOWER(to_email) = LOWER($2) AND token_hash = $3
+		RETURNING pet_id
+	`, transferID, middleware.GetUserEmailFromRequest(r), utils.HashToken(token)).Scan(&petID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Transfer not found or no longer pending")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to decline transfer", audit.ActionUpdate, "pet_transfer", transferID,
+		map[string]string{"status": "pending"}, map[string]string{"status": "declined"}) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit transfer decline: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to decline transfer")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Pet transfer declined: ID=%d, Pet=%d", transferID, petID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Transfer declined"})
+}
+
+// CancelPetTransferHandler withdraws a pending transfer (primary owner or staff)
+func CancelPetTransferHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	transferID, _ := strconv.Atoi(vars["id"])
+
+	var petID int
+	err := database.DB.QueryRow("SELECT pet_id FROM pet_transfers WHERE id = $1 AND status = 'pending'", transferID).Scan(&petID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Transfer not found or no longer pending")
+		return
+	}
+	if !canAccessPet(r, petID, accessManage) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to cancel transfer")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE pet_transfers SET status = 'cancelled', responded_at = NOW() WHERE id = $1 AND status = 'pending'",
+		transferID,
+	)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to cancel pet transfer: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to cancel transfer")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondWithError(w, http.StatusNotFound, "Transfer not found or no longer pending")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to cancel transfer", audit.ActionUpdate, "pet_transfer", transferID,
+		map[string]string{"status": "pending"}, map[string]string{"status": "cancelled"}) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit transfer cancellation: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to cancel transfer")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Pet transfer cancelled: ID=%d, Pet=%d", transferID, petID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Transfer cancelled"})
+}
+
+// GetOwnershipHistoryHandler returns a pet's chain of custody, oldest owner first (primary owner or staff)
+func GetOwnershipHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+
+	if _, err := loadPet(petID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, petID, accessManage) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT COALESCE(h.owner_id, 0), COALESCE(o.name, ''), h.transfer_id, h.started_at, h.ended_at
+		FROM pet_ownership_history h
+		LEFT JOIN owners o ON h.owner_id = o.id
+		WHERE h.pet_id = $1
+		ORDER BY h.started_at, h.id
+	`, petID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch ownership history: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch ownership history")
+		return
+	}
+	defer rows.Close()
+
+	history := []models.OwnershipPeriod{}
+	for rows.Next() {
+		var period models.OwnershipPeriod
+		if err := rows.Scan(&period.OwnerID, &period.OwnerName, &period.TransferID, &period.StartedAt, &period.EndedAt); err != nil {
+			utils.LogMessage(config.LogError, "Failed to read ownership history: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch ownership history")
+			return
+		}
+		history = append(history, period)
+	}
+	if err := rows.Err(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch ownership history: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch ownership history")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, history)
+}
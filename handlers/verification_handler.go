@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/middleware"
+	"petclinic/outbox"
+	"petclinic/utils"
+	"time"
+)
+
+// emailVerificationPurpose tags signed verification payloads so they can't be reused for other links
+const emailVerificationPurpose = "verify-email"
+
+// emailVerificationClaims is the signed payload of a verification link. It is JSON encoded
+// because email addresses may contain any separator character.
+type emailVerificationClaims struct {
+	Purpose string `json:"p"`
+	OwnerID int    `json:"o"`
+	Email   string `json:"e"`
+	Expires int64  `json:"x"`
+}
+
+// sendVerificationEmail queues an email with a signed verification link to the given account.
+// Pass the transaction that creates the account so the email is only sent if it commits.
+func sendVerificationEmail(ex outbox.Execer, ownerID int, email string) error {
+	payload, err := json.Marshal(emailVerificationClaims{
+		Purpose: emailVerificationPurpose,
+		OwnerID: ownerID,
+		Email:   email,
+		Expires: time.Now().Add(config.EmailVerificationTTL).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	token := utils.SignPayload(config.LinkSigningSecret, string(payload))
+
+	link := config.AppBaseURL + "/api/verify-email?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Welcome to Pet Clinic!\n\n"+
+		"Please confirm your email address by opening the link below. It expires in %s.\n\n%s\n",
+		config.EmailVerificationTTL, link)
+
+	return outbox.EnqueueEmail(ex, email, "Verify your Pet Clinic email address", body)
+}
+
+// VerifyEmailHandler marks an account as verified using a signed link
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	var claims emailVerificationClaims
+	payload, ok := utils.VerifySignedPayload(config.LinkSigningSecret, token)
+	if !ok || json.Unmarshal([]byte(payload), &claims) != nil || claims.Purpose != emailVerificationPurpose {
+		utils.LogMessage(config.LogWarn, "Invalid email verification token")
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid verification link")
+		return
+	}
+
+	ownerID, email := claims.OwnerID, claims.Email
+	if time.Now().Unix() > claims.Expires {
+		utils.RespondWithError(w, http.StatusBadRequest, "Verification link has expired")
+		return
+	}
+
+	// Matching on email too means a link stops working if the address changes
+	result, err := database.DB.Exec(
+		"UPDATE owners SET email_verified = TRUE WHERE id = $1 AND email = $2",
+		ownerID, email,
+	)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to verify email: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Email verification failed")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid verification link")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Email verified: User=%d", ownerID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Email verified successfully"})
+}
+
+// ResendVerificationHandler sends a fresh verification link to the current user
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserIDFromRequest(r)
+
+	var email string
+	var verified bool
+	err := database.DB.QueryRow(
+		"SELECT email, email_verified FROM owners WHERE id = $1",
+		userID,
+	).Scan(&email, &verified)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	if verified {
+		utils.RespondWithError(w, http.StatusBadRequest, "Email is already verified")
+		return
+	}
+
+	if err := sendVerificationEmail(database.DB, userID, email); err != nil {
+		utils.LogMessage(config.LogError, "Failed to send verification email: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to send verification email")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Verification email sent"})
+}
@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// vitalMetric describes a tracked vital sign: its canonical storage unit, the other units it
+// accepts (as conversions to and from canonical), and the plausible range in canonical units
+type vitalMetric struct {
+	unit     string
+	units    map[string]unitConversion
+	min, max float64
+}
+
+// unitConversion converts between a unit and its metric's canonical unit
+type unitConversion struct {
+	toCanonical   func(float64) float64
+	fromCanonical func(float64) float64
+}
+
+const kgPerLb = 0.45359237
+
+// sameUnit is the conversion for a metric's canonical unit
+var sameUnit = unitConversion{
+	toCanonical:   func(v float64) float64 { return v },
+	fromCanonical: func(v float64) float64 { return v },
+}
+
+var vitalMetrics = map[string]vitalMetric{
+	"weight": {unit: "kg", min: 0.001, max: 2000, units: map[string]unitConversion{
+		"kg": sameUnit,
+		"lb": {
+			toCanonical:   func(v float64) float64 { return v * kgPerLb },
+			fromCanonical: func(v float64) float64 { return v / kgPerLb },
+		},
+	}},
+	"temperature": {unit: "c", min: 20, max: 50, units: map[string]unitConversion{
+		"c": sameUnit,
+		"f": {
+			toCanonical:   func(v float64) float64 { return (v - 32) * 5 / 9 },
+			fromCanonical: func(v float64) float64 { return v*9/5 + 32 },
+		},
+	}},
+	"heart_rate":           {unit: "bpm", min: 1, max: 1000, units: map[string]unitConversion{"bpm": sameUnit}},
+	"respiration":          {unit: "breaths/min", min: 1, max: 300, units: map[string]unitConversion{"breaths/min": sameUnit}},
+	"body_condition_score": {unit: "bcs", min: 1, max: 9, units: map[string]unitConversion{"bcs": sameUnit}},
+}
+
+// RecordVitalsHandler records one or more measurements for a pet (staff only)
+func RecordVitalsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+
+	var req models.RecordVitalsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if len(req.Measurements) == 0 {
+		utils.RespondWithError(w, http.StatusBadRequest, "At least one measurement is required")
+		return
+	}
+
+	if _, err := loadPet(petID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+
+	if req.AppointmentID != nil {
+		apt, err := loadAppointment(*req.AppointmentID)
+		if err != nil || apt.PetID != petID {
+			utils.RespondWithError(w, http.StatusBadRequest, "Appointment not found for this pet")
+			return
+		}
+	}
+
+	recordedAt := time.Now()
+	if req.RecordedAt != nil {
+		if req.RecordedAt.After(time.Now().Add(5 * time.Minute)) {
+			utils.RespondWithError(w, http.StatusBadRequest, "Recorded time cannot be in the future")
+			return
+		}
+		recordedAt = *req.RecordedAt
+	}
+
+	// Validate everything before writing anything
+	values := make([]float64, len(req.Measurements))
+	for i, m := range req.Measurements {
+		metric, ok := vitalMetrics[m.Metric]
+		if !ok {
+			utils.RespondWithError(w, http.StatusBadRequest, "Invalid metric: "+m.Metric+". Must be one of "+strings.Join(vitalMetricNames(), ", "))
+			return
+		}
+		unit := strings.ToLower(m.Unit)
+		if unit == "" {
+			unit = metric.unit
+		}
+		conv, ok := metric.units[unit]
+		if !ok {
+			utils.RespondWithError(w, http.StatusBadRequest, "Invalid unit for "+m.Metric+": "+m.Unit)
+			return
+		}
+		values[i] = conv.toCanonical(m.Value)
+		if values[i] < metric.min || values[i] > metric.max {
+			utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("%s value %g %s is out of range", m.Metric, m.Value, unit))
+			return
+		}
+	}
+
+	userID := middleware.GetUserIDFromRequest(r)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to record vitals")
+		return
+	}
+	defer tx.Rollback()
+
+	vitals := make([]models.VitalSign, 0, len(req.Measurements))
+	for i, m := range req.Measurements {
+		vital := models.VitalSign{
+			PetID:         petID,
+			AppointmentID: req.AppointmentID,
+			Metric:        m.Metric,
+			Unit:          vitalMetrics[m.Metric].unit,
+			Notes:         req.Notes,
+			RecordedBy:    userID,
+		}
+		err := tx.QueryRow(`
+			INSERT INTO pet_vitals (pet_id, appointment_id, metric, value, notes, recorded_by, recorded_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, value, recorded_at
+		`, petID, req.AppointmentID, m.Metric, values[i], req.Notes, userID, recordedAt,
+		).Scan(&vital.ID, &vital.Value, &vital.RecordedAt)
+		if err != nil {
+			utils.LogMessage(config.LogError, "Failed to record vitals: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to record vitals")
+			return
+		}
+		vitals = append(vitals, vital)
+		if !recordAudit(w, r, tx, "Failed to record vitals", audit.ActionCreate, "vital_sign", vital.ID, nil, vital) {
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit vitals: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to record vitals")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Vitals recorded: Pet=%d, Count=%d", petID, len(vitals)))
+	utils.RespondWithJSON(w, http.StatusCreated, vitals)
+}
+
+// GetVitalsHandler returns a pet's history for one metric (default weight), oldest first, plus the
+// change between the latest measurement and the one from the previous visit.
+// Params: metric, unit (e.g. lb or f), from, to (RFC 3339).
+func GetVitalsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	petID, _ := strconv.Atoi(vars["id"])
+	q := r.URL.Query()
+
+	if _, err := loadPet(petID); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, petID, accessRead) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	metricName := q.Get("metric")
+	if metricName == "" {
+		metricName = "weight"
+	}
+	metric, ok := vitalMetrics[metricName]
+	if !ok {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid metric. Must be one of "+strings.Join(vitalMetricNames(), ", "))
+		return
+	}
+	unit := strings.ToLower(q.Get("unit"))
+	if unit == "" {
+		unit = metric.unit
+	}
+	conv, ok := metric.units[unit]
+	if !ok {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid unit for "+metricName+": "+unit)
+		return
+	}
+
+	lq, err := newListQuery(r, listOptions{
+		sortColumns: map[string]string{"recorded_at": "recorded_at"},
+		defaultSort: "recorded_at",
+		idColumn:    "id",
+	})
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	lq.filter("pet_id =", petID)
+	lq.filter("metric =", metricName)
+	for param, expr := range map[string]string{"from": "recorded_at >=", "to": "recorded_at <"} {
+		if err := lq.filterTime(r, param, expr); err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if !recordAccess(w, r, "Failed to fetch vitals", audit.ActionView, "pet_vitals", petID) {
+		return
+	}
+
+	series := models.VitalSeries{PetID: petID, Metric: metricName, Unit: unit, Measurements: []models.VitalSign{}}
+	series.TotalCount, series.NextCursor, err = lq.run(vitalColumns, "pet_vitals", func(rows *sql.Rows, sortKey *string) (int, error) {
+		vital, err := scanVital(rows, conv, unit, sortKey)
+		if err != nil {
+			return 0, err
+		}
+		series.Measurements = append(series.Measurements, vital)
+		return vital.ID, nil
+	})
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch vitals: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch vitals")
+		return
+	}
+
+	series.ChangeSinceLastVisit, err = loadChangeSinceLastVisit(lq, conv, unit)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch vitals: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch vitals")
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, series)
+}
+
+// vitalColumns are the pet_vitals columns read by scanVital, in order
+const vitalColumns = "id, pet_id, appointment_id, metric, value, notes, COALESCE(recorded_by, 0), recorded_at"
+
+// scanVital reads vitalColumns (after any leading columns scanned into extra), converting the value to unit
+func scanVital(row rowScanner, conv unitConversion, unit string, extra ...interface{}) (models.VitalSign, error) {
+	var vital models.VitalSign
+	dest := append(extra, &vital.ID, &vital.PetID, &vital.AppointmentID, &vital.Metric, &vital.Value,
+		&vital.Notes, &vital.RecordedBy, &vital.RecordedAt)
+	if err := row.Scan(dest...); err != nil {
+		return vital, err
+	}
+	vital.Value = roundVital(conv.fromCanonical(vital.Value))
+	vital.Unit = unit
+	return vital, nil
+}
+
+// loadChangeSinceLastVisit walks the measurements matching lq's filters from the newest, whatever
+// page was requested, and stops at the first one from an earlier visit than the latest
+func loadChangeSinceLastVisit(lq *listQuery, conv unitConversion, unit string) (*models.VitalChange, error) {
+	rows, err := database.DB.Query(
+		"SELECT "+vitalColumns+" FROM pet_vitals WHERE "+strings.Join(lq.conditions, " AND ")+" ORDER BY recorded_at DESC, id DESC",
+		lq.args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var newestFirst []models.VitalSign
+	for rows.Next() {
+		vital, err := scanVital(rows, conv, unit)
+		if err != nil {
+			return nil, err
+		}
+		newestFirst = append(newestFirst, vital)
+		if !sameVisit(vital, newestFirst[0]) {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	measurements := make([]models.VitalSign, len(newestFirst))
+	for i, vital := range newestFirst {
+		measurements[len(newestFirst)-1-i] = vital
+	}
+	return changeSinceLastVisit(measurements), nil
+}
+
+// changeSinceLastVisit compares the latest measurement with the most recent one from an earlier
+// visit. Measurements belong to the same visit if they share an appointment or, without one, a day.
+func changeSinceLastVisit(measurements []models.VitalSign) *models.VitalChange {
+	if len(measurements) < 2 {
+		return nil
+	}
+	latest := measurements[len(measurements)-1]
+	for i := len(measurements) - 2; i >= 0; i-- {
+		prev := measurements[i]
+		if sameVisit(prev, latest) {
+			continue
+		}
+		change := &models.VitalChange{
+			Previous:           prev.Value,
+			PreviousRecordedAt: prev.RecordedAt,
+			Current:            latest.Value,
+			Delta:              roundVital(latest.Value - prev.Value),
+		}
+		if prev.Value != 0 {
+			change.Percent = math.Round((latest.Value-prev.Value)/prev.Value*1000) / 10
+		}
+		return change
+	}
+	return nil
+}
+
+// sameVisit reports whether two measurements were taken during the same visit
+func sameVisit(a, b models.VitalSign) bool {
+	if a.AppointmentID != nil && b.AppointmentID != nil {
+		return *a.AppointmentID == *b.AppointmentID
+	}
+	return a.RecordedAt.UTC().Format(models.DateLayout) == b.RecordedAt.UTC().Format(models.DateLayout)
+}
+
+// roundVital rounds to the precision vitals are stored with
+func roundVital(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// vitalMetricNames returns the supported metrics in alphabetical order
+func vitalMetricNames() []string {
+	names := make([]string, 0, len(vitalMetrics))
+	for name := range vitalMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
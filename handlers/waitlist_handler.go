@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/events"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/utils"
+	"petclinic/waitlist"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// waitlistColumns are the columns read by scanWaitlistEntry, in order
+const waitlistColumns = "id, pet_id, owner_id, earliest, latest, preferred_vet, reason, status, appointment_id, created_at"
+
+// scanWaitlistEntry reads a row selected with waitlistColumns
+func scanWaitlistEntry(row rowScanner) (models.WaitlistEntry, error) {
+	var e models.WaitlistEntry
+	err := row.Scan(&e.ID, &e.PetID, &e.OwnerID, &e.Earliest, &e.Latest, &e.PreferredVet, &e.Reason,
+		&e.Status, &e.AppointmentID, &e.CreatedAt)
+	return e, err
+}
+
+// JoinWaitlistHandler puts a pet on the waitlist for a slot between earliest and latest.
+// When a booking in that range is cancelled the caller may be emailed an offer to claim it.
+func JoinWaitlistHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateWaitlistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if req.PetID == 0 || req.Earliest.IsZero() || req.Latest.IsZero() {
+		utils.RespondWithError(w, http.StatusBadRequest, "Pet ID, earliest and latest are required")
+		return
+	}
+	if !req.Latest.After(req.Earliest) {
+		utils.RespondWithError(w, http.StatusBadRequest, "Latest must be after earliest")
+		return
+	}
+	if config.ClinicTime(req.Latest).Before(time.Now()) {
+		utils.RespondWithError(w, http.StatusBadRequest, "The date range has already passed")
+		return
+	}
+
+	pet, err := loadPet(req.PetID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, req.PetID, accessBook) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied - you can't book for this pet")
+		return
+	}
+	if pet.Deceased {
+		utils.RespondWithError(w, http.StatusConflict, "Cannot book an appointment for a deceased pet")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to join waitlist")
+		return
+	}
+	defer tx.Rollback()
+
+	entry, err := scanWaitlistEntry(tx.QueryRow(`
+		INSERT INTO waitlist_entries (pet_id, owner_id, earliest, latest, preferred_vet, reason)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+waitlistColumns,
+		req.PetID, middleware.GetUserIDFromRequest(r), req.Earliest, req.Latest, strings.TrimSpace(req.PreferredVet), req.Reason,
+	))
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to join waitlist: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to join waitlist")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to join waitlist", audit.ActionCreate, "waitlist_entry", entry.ID, nil, entry) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit waitlist entry: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to join waitlist")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Waitlist joined: ID=%d, Pet=%d", entry.ID, entry.PetID))
+	utils.RespondWithJSON(w, http.StatusCreated, entry)
+}
+
+// GetWaitlistHandler lists the caller's waitlist entries (staff see everyone's), oldest first.
+// Filters: pet_id, status; sort: created_at, earliest, id; limit, cursor.
+func GetWaitlistHandler(w http.ResponseWriter, r *http.Request) {
+	lq, err := newListQuery(r, listOptions{
+		sortColumns: map[string]string{"created_at": "created_at", "earliest": "earliest", "id": "id"},
+		defaultSort: "created_at",
+		idColumn:    "id",
+	})
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if middleware.GetUserRoleFromRequest(r) != "staff" {
+		lq.filter("owner_id =", middleware.GetUserIDFromRequest(r))
+	}
+	if err := lq.filterInt(r, "pet_id", "pet_id ="); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if v := r.URL.Query().Get("status"); v != "" {
+		lq.filter("status =", v)
+	}
+
+	entries := []models.WaitlistEntry{}
+	total, next, err := lq.run(waitlistColumns, "waitlist_entries", func(rows *sql.Rows, sortKey *string) (int, error) {
+		var e models.WaitlistEntry
+		if err := rows.Scan(sortKey, &e.ID, &e.PetID, &e.OwnerID, &e.Earliest, &e.Latest, &e.PreferredVet, &e.Reason,
+			&e.Status, &e.AppointmentID, &e.CreatedAt); err != nil {
+			return 0, err
+		}
+		entries = append(entries, e)
+		return e.ID, nil
+	})
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch waitlist: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch waitlist")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, models.Page{Items: entries, NextCursor: next, TotalCount: total})
+}
+
+// LeaveWaitlistHandler takes an entry off the waitlist (its owner or staff). A slot currently
+// offered to the entry passes to the next one in line.
+func LeaveWaitlistHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	entryID, _ := strconv.Atoi(vars["id"])
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to leave waitlist")
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := scanWaitlistEntry(tx.QueryRow("SELECT "+waitlistColumns+" FROM waitlist_entries WHERE id = $1 FOR UPDATE", entryID))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Waitlist entry not found")
+		return
+	}
+	if before.OwnerID != middleware.GetUserIDFromRequest(r) && middleware.GetUserRoleFromRequest(r) != "staff" {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+	if before.Status != "waiting" {
+		utils.RespondWithError(w, http.StatusConflict, "Waitlist entry is already "+before.Status)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE waitlist_entries SET status = 'cancelled' WHERE id = $1", entryID); err != nil {
+		utils.LogMessage(config.LogError, "Failed to leave waitlist: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to leave waitlist")
+		return
+	}
+
+	var slotID int
+	err = tx.QueryRow(
+		"UPDATE waitlist_offers SET status = 'withdrawn', responded_at = NOW() WHERE entry_id = $1 AND status = 'pending' RETURNING slot_appointment_id",
+		entryID,
+	).Scan(&slotID)
+	if err != nil && err != sql.ErrNoRows {
+		utils.LogMessage(config.LogError, "Failed to withdraw waitlist offer: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to leave waitlist")
+		return
+	}
+	if err == nil {
+		if err := waitlist.OfferSlot(tx, slotID); err != nil {
+			utils.LogMessage(config.LogError, "Failed to offer slot: "+err.Error())
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to leave waitlist")
+			return
+		}
+	}
+
+	if !recordAudit(w, r, tx, "Failed to leave waitlist", audit.ActionDelete, "waitlist_entry", entryID, before, nil) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit waitlist change: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to leave waitlist")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Waitlist left: ID=%d", entryID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Removed from the waitlist"})
+}
+
+// ClaimWaitlistOfferHandler books an offered slot using the token from the offer email.
+// Only the owner who joined the waitlist can claim it, and only before the offer expires, while the
+// slot is still ahead and its original booking is still cancelled.
+func ClaimWaitlistOfferHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.WaitlistOfferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to claim slot")
+		return
+	}
+	defer tx.Rollback()
+
+	var offerID int
+	var entry models.WaitlistEntry
+	var slotDate time.Time
+	var vet string
+	err = tx.QueryRow(`
+		SELECT wo.id, wo.slot_date, a.vet, e.id, e.pet_id, e.owner_id, e.reason
+		FROM waitlist_offers wo
+		JOIN waitlist_entries e ON wo.entry_id = e.id
+		JOIN appointments a ON wo.slot_appointment_id = a.id
+		WHERE wo.token_hash = $1 AND wo.status = 'pending' AND wo.expires_at > NOW() AND e.status = 'waiting'
+		AND wo.slot_date > `+database.ClinicNow()+` AND (a.status = 'cancelled' OR a.deleted_at IS NOT NULL)
+		FOR UPDATE OF wo, e
+	`, utils.HashToken(req.Token)).Scan(&offerID, &slotDate, &vet, &entry.ID, &entry.PetID, &entry.OwnerID, &entry.Reason)
+	if err != nil || entry.OwnerID != middleware.GetUserIDFromRequest(r) {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid or expired offer")
+		return
+	}
+
+	pet, err := loadPet(entry.PetID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Pet not found")
+		return
+	}
+	if !canAccessPet(r, entry.PetID, accessBook) {
+		utils.RespondWithError(w, http.StatusForbidden, "Access denied - you can't book for this pet")
+		return
+	}
+	if pet.Deceased {
+		utils.RespondWithError(w, http.StatusConflict, "Cannot book an appointment for a deceased pet")
+		return
+	}
+
+	conflicts, err := findAppointmentConflicts(tx, entry.PetID, []time.Time{slotDate})
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to check appointment conflicts: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to claim slot")
+		return
+	}
+	if len(conflicts) > 0 {
+		utils.RespondWithError(w, http.StatusConflict, "The pet already has an appointment at this time")
+		return
+	}
+
+	appointment := models.Appointment{PetID: entry.PetID, Date: slotDate, Reason: entry.Reason, Vet: vet, Status: "scheduled"}
+	err = tx.QueryRow(
+		"INSERT INTO appointments (pet_id, date, reason, vet, status) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		appointment.PetID, appointment.Date, appointment.Reason, appointment.Vet, appointment.Status,
+	).Scan(&appointment.ID)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create appointment: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to claim slot")
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE waitlist_offers SET status = 'claimed', responded_at = NOW() WHERE id = $1", offerID); err != nil {
+		utils.LogMessage(config.LogError, "Failed to claim waitlist offer: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to claim slot")
+		return
+	}
+	if _, err := tx.Exec("UPDATE waitlist_entries SET status = 'booked', appointment_id = $1 WHERE id = $2", appointment.ID, entry.ID); err != nil {
+		utils.LogMessage(config.LogError, "Failed to update waitlist entry: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to claim slot")
+		return
+	}
+
+	if err := events.Publish(tx, events.AppointmentCreated, appointment.PetID, appointment); err != nil {
+		utils.LogMessage(config.LogError, "Failed to publish appointment event: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to claim slot")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to claim slot", audit.ActionCreate, "appointment", appointment.ID, nil, appointment) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit waitlist claim: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to claim slot")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Waitlist slot claimed: Offer=%d, Entry=%d, Appointment=%d", offerID, entry.ID, appointment.ID))
+	utils.RespondWithJSON(w, http.StatusCreated, appointment)
+}
+
+// DeclineWaitlistOfferHandler turns down an offered slot, which passes to the next entry in line.
+// The entry stays on the waitlist for later slots.
+func DeclineWaitlistOfferHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.WaitlistOfferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to decline offer")
+		return
+	}
+	defer tx.Rollback()
+
+	var offerID, slotID int
+	err = tx.QueryRow(`
+		UPDATE waitlist_offers wo SET status = 'declined', responded_at = NOW()
+		FROM waitlist_entries e
+		WHERE wo.entry_id = e.id AND wo.token_hash = $1 AND wo.status = 'pending' AND e.owner_id = $2
+		RETURNING wo.id, wo.slot_appointment_id
+	`, utils.HashToken(req.Token), middleware.GetUserIDFromRequest(r)).Scan(&offerID, &slotID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid or expired offer")
+		return
+	}
+
+	if err := waitlist.OfferSlot(tx, slotID); err != nil {
+		utils.LogMessage(config.LogError, "Failed to offer slot: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to decline offer")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit waitlist decline: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to decline offer")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Waitlist offer declined: Offer=%d", offerID))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Offer declined; you're still on the waitlist"})
+}
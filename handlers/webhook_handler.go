@@ -0,0 +1,413 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/events"
+	"petclinic/middleware"
+	"petclinic/models"
+	"petclinic/utils"
+	"petclinic/webhooks"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// webhookColumns are the webhook_subscriptions columns read by scanWebhook, in order (the secret is never read back)
+const webhookColumns = "id, url, event_types, description, active, COALESCE(created_by, 0), created_at"
+
+// webhookDeliveryColumns are the webhook_deliveries columns read by scanWebhookDelivery, in order
+const webhookDeliveryColumns = "id, subscription_id, event_id, event_type, payload, status, attempts, response_status, last_error, replay_of, created_at, delivered_at"
+
+// scanWebhook reads a row selected with webhookColumns (after any leading columns scanned into extra)
+func scanWebhook(row rowScanner, extra ...interface{}) (models.WebhookSubscription, error) {
+	var s models.WebhookSubscription
+	dest := append(extra, &s.ID, &s.URL, pq.Array(&s.EventTypes), &s.Description, &s.Active, &s.CreatedBy, &s.CreatedAt)
+	err := row.Scan(dest...)
+	return s, err
+}
+
+// scanWebhookDelivery reads a row selected with webhookDeliveryColumns
+func scanWebhookDelivery(row rowScanner) (models.WebhookDelivery, error) {
+	var d models.WebhookDelivery
+	var payload []byte
+	err := row.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts,
+		&d.ResponseStatus, &d.LastError, &d.ReplayOf, &d.CreatedAt, &d.DeliveredAt)
+	d.Payload = payload
+	return d, err
+}
+
+// validateWebhook checks a subscription's URL and event types. Plain http is only allowed in development.
+func validateWebhook(s *models.WebhookSubscription) string {
+	u, err := url.Parse(s.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && config.IsDevelopment())) {
+		return "A valid https URL is required"
+	}
+	// Deliveries check each address again when dialing; this just rejects bad URLs up front
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil || len(ips) == 0 {
+		return "The webhook URL's host could not be resolved"
+	}
+	for _, ip := range ips {
+		if !webhooks.PublicIP(ip) {
+			return "The webhook URL must not point to an internal address"
+		}
+	}
+	if len(s.EventTypes) == 0 {
+		return "At least one event type is required"
+	}
+	for _, t := range s.EventTypes {
+		if !utils.ContainsString(events.Types, t) {
+			return "Invalid event type: " + t + ". Must be one of " + strings.Join(events.Types, ", ")
+		}
+	}
+	return ""
+}
+
+// CreateWebhookHandler subscribes a URL to event types (staff only). The response includes
+// the signing secret, which is not shown again.
+func CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var sub models.WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if msg := validateWebhook(&sub); msg != "" {
+		utils.RespondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	secret, err := utils.GenerateToken(32)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create webhook")
+		return
+	}
+
+	sub.Secret = "whsec_" + secret
+	sub.Active = true
+	sub.CreatedBy = middleware.GetUserIDFromRequest(r)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create webhook")
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO webhook_subscriptions (url, event_types, secret, description, created_by)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at
+	`, sub.URL, pq.Array(sub.EventTypes), sub.Secret, sub.Description, sub.CreatedBy,
+	).Scan(&sub.ID, &sub.CreatedAt)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to create webhook: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create webhook")
+		return
+	}
+
+	logged := sub
+	logged.Secret = ""
+	if !recordAudit(w, r, tx, "Failed to create webhook", audit.ActionCreate, "webhook", sub.ID, nil, logged) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit webhook: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create webhook")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Webhook created: ID=%d, Events=%s", sub.ID, strings.Join(sub.EventTypes, ",")))
+	utils.RespondWithJSON(w, http.StatusCreated, sub)
+}
+
+// GetWebhooksHandler lists webhook subscriptions (staff only)
+func GetWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	lq, err := newListQuery(r, listOptions{
+		sortColumns: map[string]string{"id": "id", "created_at": "created_at", "url": "url"},
+		defaultSort: "id",
+		idColumn:    "id",
+	})
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if v := r.URL.Query().Get("active"); v != "" {
+		active, err := strconv.ParseBool(v)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, "Invalid active (use true or false)")
+			return
+		}
+		lq.filter("active =", active)
+	}
+
+	subs := []models.WebhookSubscription{}
+	total, next, err := lq.run(webhookColumns, "webhook_subscriptions", func(rows *sql.Rows, sortKey *string) (int, error) {
+		sub, err := scanWebhook(rows, sortKey)
+		if err != nil {
+			return 0, err
+		}
+		subs = append(subs, sub)
+		return sub.ID, nil
+	})
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch webhooks: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch webhooks")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, models.Page{Items: subs, NextCursor: next, TotalCount: total})
+}
+
+// GetWebhookHandler retrieves a webhook subscription (staff only)
+func GetWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	sub, err := scanWebhook(database.DB.QueryRow("SELECT "+webhookColumns+" FROM webhook_subscriptions WHERE id = $1", id))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, sub)
+}
+
+// UpdateWebhookHandler changes a subscription's URL, event types, description or active flag (staff only).
+// Fields missing from the body keep their current values.
+func UpdateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update webhook")
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := scanWebhook(tx.QueryRow("SELECT "+webhookColumns+" FROM webhook_subscriptions WHERE id = $1 FOR UPDATE", id))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	// Decode over a copy of the subscription so omitted fields are left as they are. The event
+	// types are copied because the decoder reuses a slice's backing array.
+	sub := before
+	sub.EventTypes = append([]string(nil), before.EventTypes...)
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if msg := validateWebhook(&sub); msg != "" {
+		utils.RespondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	_, err = tx.Exec(
+		"UPDATE webhook_subscriptions SET url = $1, event_types = $2, description = $3, active = $4 WHERE id = $5",
+		sub.URL, pq.Array(sub.EventTypes), sub.Description, sub.Active, id,
+	)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to update webhook: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update webhook")
+		return
+	}
+
+	sub.ID, sub.Secret, sub.CreatedBy, sub.CreatedAt = id, "", before.CreatedBy, before.CreatedAt
+	if !recordAudit(w, r, tx, "Failed to update webhook", audit.ActionUpdate, "webhook", id, before, sub) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit webhook update: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update webhook")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Webhook updated: ID=%d", id))
+	utils.RespondWithJSON(w, http.StatusOK, sub)
+}
+
+// DeleteWebhookHandler removes a subscription and its delivery log (staff only)
+func DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete webhook")
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := scanWebhook(tx.QueryRow("SELECT "+webhookColumns+" FROM webhook_subscriptions WHERE id = $1 FOR UPDATE", id))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM webhook_subscriptions WHERE id = $1", id); err != nil {
+		utils.LogMessage(config.LogError, "Failed to delete webhook: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete webhook")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to delete webhook", audit.ActionDelete, "webhook", id, before, nil) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit webhook deletion: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete webhook")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Webhook deleted: ID=%d", id))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Webhook deleted successfully"})
+}
+
+// RotateWebhookSecretHandler replaces a subscription's signing secret and returns the new one (staff only)
+func RotateWebhookSecretHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	secret, err := utils.GenerateToken(32)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to rotate secret")
+		return
+	}
+	secret = "whsec_" + secret
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to rotate secret")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE webhook_subscriptions SET secret = $1 WHERE id = $2", secret, id)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to rotate webhook secret: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to rotate secret")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondWithError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	if !recordAudit(w, r, tx, "Failed to rotate secret", audit.ActionUpdate, "webhook", id,
+		map[string]string{"secret": "old"}, map[string]string{"secret": "rotated"}) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit webhook secret: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to rotate secret")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Webhook secret rotated: ID=%d", id))
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"secret": secret})
+}
+
+// GetWebhookDeliveriesHandler lists a subscription's deliveries, newest first (staff only).
+// Filters: status, event_type; limit, cursor.
+func GetWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	q := r.URL.Query()
+
+	lq, err := newListQuery(r, listOptions{
+		sortColumns: map[string]string{"id": "id"},
+		defaultSort: "-id",
+		idColumn:    "id",
+	})
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lq.filter("subscription_id =", id)
+	if v := q.Get("status"); v != "" {
+		lq.filter("status =", v)
+	}
+	if v := q.Get("event_type"); v != "" {
+		lq.filter("event_type =", v)
+	}
+
+	deliveries := []models.WebhookDelivery{}
+	total, next, err := lq.run(webhookDeliveryColumns, "webhook_deliveries", func(rows *sql.Rows, sortKey *string) (int, error) {
+		var d models.WebhookDelivery
+		var payload []byte
+		if err := rows.Scan(sortKey, &d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts,
+			&d.ResponseStatus, &d.LastError, &d.ReplayOf, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return 0, err
+		}
+		d.Payload = payload
+		deliveries = append(deliveries, d)
+		return d.ID, nil
+	})
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to fetch webhook deliveries: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to fetch deliveries")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, models.Page{Items: deliveries, NextCursor: next, TotalCount: total})
+}
+
+// ReplayWebhookDeliveryHandler sends a past delivery's payload again as a new delivery (staff only)
+func ReplayWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	deliveryID, _ := strconv.Atoi(vars["delivery_id"])
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to replay delivery")
+		return
+	}
+	defer tx.Rollback()
+
+	replay, err := scanWebhookDelivery(tx.QueryRow(`
+		INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, payload, replay_of)
+		SELECT subscription_id, event_id, event_type, payload, id FROM webhook_deliveries WHERE id = $1 AND subscription_id = $2
+		RETURNING `+webhookDeliveryColumns, deliveryID, id))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Delivery not found")
+		return
+	}
+
+	if err := webhooks.EnqueueDelivery(tx, replay.ID); err != nil {
+		utils.LogMessage(config.LogError, "Failed to queue webhook replay: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to replay delivery")
+		return
+	}
+	if !recordAudit(w, r, tx, "Failed to replay delivery", audit.ActionCreate, "webhook_delivery", replay.ID, nil, map[string]int{"replay_of": deliveryID}) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit webhook replay: "+err.Error())
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to replay delivery")
+		return
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Webhook delivery replayed: Webhook=%d, Delivery=%d, Replay=%d", id, deliveryID, replay.ID))
+	utils.RespondWithJSON(w, http.StatusAccepted, replay)
+}
@@ -0,0 +1,130 @@
+package ical
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentType is the media type of iCalendar files
+const ContentType = "text/calendar; charset=utf-8"
+
+// Methods for Calendar.Method (RFC 5546): PUBLISH for feeds and downloads, CANCEL to withdraw an event
+const (
+	MethodPublish = "PUBLISH"
+	MethodCancel  = "CANCEL"
+)
+
+// Event statuses
+const (
+	StatusConfirmed = "CONFIRMED"
+	StatusCancelled = "CANCELLED"
+)
+
+// timeLayout is the UTC date-time form used for every timestamp
+const timeLayout = "20060102T150405Z"
+
+// maxLineOctets is the longest content line allowed before folding
+const maxLineOctets = 75
+
+// Event is a VEVENT. UID must stay the same across updates, and Sequence must
+// increase whenever the start, end, summary or status changes.
+type Event struct {
+	UID          string
+	Sequence     int
+	Start        time.Time
+	End          time.Time
+	Summary      string
+	Description  string
+	Location     string
+	Status       string
+	LastModified time.Time
+}
+
+// Calendar is a VCALENDAR
+type Calendar struct {
+	Name   string
+	Method string
+	Events []Event
+}
+
+// Render returns the calendar as an RFC 5545 document
+func (c Calendar) Render() string {
+	var b strings.Builder
+	line := func(name, value string) {
+		writeFolded(&b, name+":"+value)
+	}
+
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//Pet Clinic//Appointments//EN")
+	line("CALSCALE", "GREGORIAN")
+	if c.Method != "" {
+		line("METHOD", c.Method)
+	}
+	if c.Name != "" {
+		line("X-WR-CALNAME", Escape(c.Name))
+	}
+
+	stamp := time.Now().UTC().Format(timeLayout)
+	for _, e := range c.Events {
+		line("BEGIN", "VEVENT")
+		line("UID", Escape(e.UID))
+		line("DTSTAMP", stamp)
+		line("SEQUENCE", strconv.Itoa(e.Sequence))
+		line("DTSTART", e.Start.UTC().Format(timeLayout))
+		line("DTEND", e.End.UTC().Format(timeLayout))
+		line("SUMMARY", Escape(e.Summary))
+		if e.Description != "" {
+			line("DESCRIPTION", Escape(e.Description))
+		}
+		if e.Location != "" {
+			line("LOCATION", Escape(e.Location))
+		}
+		if e.Status != "" {
+			line("STATUS", e.Status)
+		}
+		if !e.LastModified.IsZero() {
+			line("LAST-MODIFIED", e.LastModified.UTC().Format(timeLayout))
+		}
+		line("END", "VEVENT")
+	}
+
+	line("END", "VCALENDAR")
+	return b.String()
+}
+
+// Escape escapes a TEXT value (backslashes, semicolons, commas and newlines)
+func Escape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", "",
+	).Replace(s)
+}
+
+// writeFolded writes a content line, folding it at 75 octets without splitting UTF-8 characters
+func writeFolded(b *strings.Builder, line string) {
+	limit := maxLineOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !isRuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// Continuation lines start with a space, which counts toward their length
+		limit = maxLineOctets - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// isRuneStart reports whether c begins a UTF-8 encoded character
+func isRuneStart(c byte) bool {
+	return c&0xC0 != 0x80
+}
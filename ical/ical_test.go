@@ -0,0 +1,108 @@
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Rex", "Rex"},
+		{`C:\pets`, `C:\\pets`},
+		{"Rex; vaccination, booster", `Rex\; vaccination\, booster`},
+		{"line one\nline two", `line one\nline two`},
+		{"line one\r\nline two", `line one\nline two`},
+		{"stray\rreturn", "strayreturn"},
+	}
+
+	for _, tt := range tests {
+		if got := Escape(tt.in); got != tt.want {
+			t.Errorf("Escape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWriteFolded(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"short", "SUMMARY:Rex"},
+		{"exactly 75 octets", "SUMMARY:" + strings.Repeat("a", 67)},
+		{"76 octets", "SUMMARY:" + strings.Repeat("a", 68)},
+		{"several folds", "DESCRIPTION:" + strings.Repeat("abcdefghij", 30)},
+		{"multi-byte characters", "SUMMARY:" + strings.Repeat("é", 40) + strings.Repeat("猫", 30)},
+	}
+
+	for _, tt := range tests {
+		var b strings.Builder
+		writeFolded(&b, tt.line)
+		out := b.String()
+
+		if !strings.HasSuffix(out, "\r\n") {
+			t.Errorf("%s: output does not end with CRLF: %q", tt.name, out)
+			continue
+		}
+		physical := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+		for i, p := range physical {
+			if len(p) > maxLineOctets {
+				t.Errorf("%s: line %d is %d octets, want at most %d", tt.name, i, len(p), maxLineOctets)
+			}
+			if i > 0 && !strings.HasPrefix(p, " ") {
+				t.Errorf("%s: continuation line %d does not start with a space: %q", tt.name, i, p)
+			}
+			if !isRuneStart(strings.TrimPrefix(p, " ")[0]) {
+				t.Errorf("%s: line %d starts inside a UTF-8 character", tt.name, i)
+			}
+		}
+
+		// Unfolding (removing each CRLF followed by a space) must give back the original line
+		if got := strings.ReplaceAll(strings.TrimSuffix(out, "\r\n"), "\r\n ", ""); got != tt.line {
+			t.Errorf("%s: unfolded = %q, want %q", tt.name, got, tt.line)
+		}
+		if len(tt.line) <= maxLineOctets && len(physical) != 1 {
+			t.Errorf("%s: a %d-octet line was folded", tt.name, len(tt.line))
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	start := time.Date(2026, 3, 14, 9, 30, 0, 0, time.FixedZone("CET", 3600))
+	out := Calendar{
+		Name:   "Pet Clinic",
+		Method: MethodCancel,
+		Events: []Event{{
+			UID:         "appointment-7@clinic.example",
+			Sequence:    2,
+			Start:       start,
+			End:         start.Add(30 * time.Minute),
+			Summary:     "Rex: vaccination, booster",
+			Description: "Bring the card;\nfasting not needed",
+			Status:      StatusCancelled,
+		}},
+	}.Render()
+
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"METHOD:CANCEL\r\n",
+		"X-WR-CALNAME:Pet Clinic\r\n",
+		"UID:appointment-7@clinic.example\r\n",
+		"SEQUENCE:2\r\n",
+		"DTSTART:20260314T083000Z\r\n",
+		"DTEND:20260314T090000Z\r\n",
+		`SUMMARY:Rex: vaccination\, booster` + "\r\n",
+		`DESCRIPTION:Bring the card\;\nfasting not needed` + "\r\n",
+		"STATUS:CANCELLED\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("rendered calendar is missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "LOCATION:") || strings.Contains(out, "LAST-MODIFIED:") {
+		t.Errorf("empty optional properties were rendered:\n%s", out)
+	}
+}
@@ -0,0 +1,138 @@
+package jobs
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"petclinic/audit"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/utils"
+	"time"
+)
+
+// StartPurgeJob periodically hard-deletes soft-deleted rows older than config.SoftDeleteRetention
+func StartPurgeJob() {
+	if config.SoftDeleteRetention <= 0 || config.PurgeInterval <= 0 {
+		utils.LogMessage(config.LogInfo, "Soft-delete purge job disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.PurgeInterval)
+		defer ticker.Stop()
+		for {
+			PurgeDeleted()
+			<-ticker.C
+		}
+	}()
+}
+
+// purgeTarget is a soft-deletable table; fileColumn names a column holding a file to remove
+// along with the row ("NULL" when there is none)
+type purgeTarget struct {
+	table        string
+	resourceType string
+	fileColumn   string
+}
+
+// Children go first so pets are never purged out from under them
+var purgeTargets = []purgeTarget{
+	{"medical_records", "medical_record", "file_path"},
+	{"appointments", "appointment", "NULL"},
+	{"pets", "pet", "NULL"},
+}
+
+// PurgeDeleted removes medical records (and their files), appointments and pets whose
+// retention period has passed, recording each purged row in the audit log. The rows are
+// deleted in one transaction and files are only removed once it commits.
+// Delivered outbox messages and event log entries past their retention are removed as well.
+func PurgeDeleted() {
+	retention := config.SoftDeleteRetention.Seconds()
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	purged := map[string]int64{}
+	var files []string
+	for _, target := range purgeTargets {
+		ids, paths, err := purgeTable(tx, target, retention)
+		if err != nil {
+			utils.LogMessage(config.LogError, "Failed to purge "+target.table+": "+err.Error())
+			return
+		}
+		for _, id := range ids {
+			if err := audit.Write(tx, audit.System, audit.ActionDelete, target.resourceType, id,
+				nil, map[string]bool{"purged": true}); err != nil {
+				utils.LogMessage(config.LogError, "Failed to write audit entry for purge: "+err.Error())
+				return
+			}
+		}
+		purged[target.table] = int64(len(ids))
+		files = append(files, paths...)
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit purge: "+err.Error())
+		return
+	}
+
+	for _, filePath := range files {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			utils.LogMessage(config.LogError, "Failed to remove purged file "+filePath+": "+err.Error())
+		}
+	}
+
+	if config.OutboxRetention > 0 {
+		if _, err := database.DB.Exec(
+			"DELETE FROM outbox WHERE status = 'delivered' AND delivered_at < NOW() - $1 * INTERVAL '1 second'",
+			config.OutboxRetention.Seconds(),
+		); err != nil {
+			utils.LogMessage(config.LogError, "Failed to purge delivered outbox messages: "+err.Error())
+		}
+	}
+	if config.EventLogRetention > 0 {
+		if _, err := database.DB.Exec(
+			"DELETE FROM event_log WHERE created_at < NOW() - $1 * INTERVAL '1 second'",
+			config.EventLogRetention.Seconds(),
+		); err != nil {
+			utils.LogMessage(config.LogError, "Failed to purge event log: "+err.Error())
+		}
+	}
+
+	if purged["medical_records"]+purged["appointments"]+purged["pets"] > 0 {
+		utils.LogMessage(config.LogInfo, fmt.Sprintf("Purged soft-deleted rows: pets=%d, appointments=%d, medical_records=%d",
+			purged["pets"], purged["appointments"], purged["medical_records"]))
+	}
+}
+
+// purgeTable deletes target's rows past retention and returns their IDs and files
+func purgeTable(tx *sql.Tx, target purgeTarget, retention float64) ([]int, []string, error) {
+	rows, err := tx.Query(
+		"DELETE FROM "+target.table+" WHERE deleted_at < NOW() - $1 * INTERVAL '1 second' RETURNING id, "+target.fileColumn,
+		retention,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	var files []string
+	for rows.Next() {
+		var id int
+		var filePath sql.NullString
+		if err := rows.Scan(&id, &filePath); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		if filePath.Valid {
+			files = append(files, filePath.String)
+		}
+	}
+	return ids, files, rows.Err()
+}
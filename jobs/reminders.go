@@ -0,0 +1,200 @@
+package jobs
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/notifier"
+	"petclinic/outbox"
+	"petclinic/utils"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// KindReminder is the outbox message kind for sending one appointment reminder
+const KindReminder = "appointment.reminder"
+
+// reminderMessage is the outbox payload of a KindReminder message
+type reminderMessage struct {
+	ReminderID int `json:"reminder_id"`
+}
+
+// dueReminder is an appointment whose next reminder should go out now
+type dueReminder struct {
+	appointmentID   int
+	appointmentDate time.Time
+	offsetSeconds   int64
+}
+
+// StartReminderJob periodically queues appointment reminders at each of config.ReminderOffsets.
+// The outbox handler is registered even when the job is disabled so queued reminders still go out.
+func StartReminderJob() {
+	outbox.Register(KindReminder, deliverReminder)
+
+	if len(config.ReminderOffsets) == 0 || config.ReminderInterval <= 0 {
+		utils.LogMessage(config.LogInfo, "Appointment reminder job disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.ReminderInterval)
+		defer ticker.Stop()
+		for {
+			SendDueReminders()
+			<-ticker.C
+		}
+	}()
+}
+
+// SendDueReminders queues every reminder that has come due for upcoming scheduled appointments.
+// If several offsets are due at once (e.g. an appointment booked an hour ahead) only the closest
+// is sent, and an offset is skipped once a closer one has gone out. Rescheduled appointments get
+// fresh reminders because delivery state is kept per appointment time.
+func SendDueReminders() {
+	offsets := make([]int64, 0, len(config.ReminderOffsets))
+	for _, d := range config.ReminderOffsets {
+		offsets = append(offsets, int64(d.Seconds()))
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT DISTINCT ON (a.id) a.id, a.date, offs.seconds
+		FROM appointments a
+		JOIN pets p ON a.pet_id = p.id
+		CROSS JOIN unnest($1::bigint[]) AS offs(seconds)
+		WHERE a.deleted_at IS NULL AND p.deleted_at IS NULL AND NOT p.deceased
+		AND a.status = 'scheduled'
+		AND a.date > `+database.ClinicNow()+` AND a.date - offs.seconds * INTERVAL '1 second' <= `+database.ClinicNow()+`
+		AND NOT EXISTS (
+			SELECT 1 FROM appointment_reminders ar
+			WHERE ar.appointment_id = a.id AND ar.appointment_date = a.date AND ar.offset_seconds <= offs.seconds
+		)
+		ORDER BY a.id, offs.seconds
+	`, pq.Array(offsets))
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to find due reminders: "+err.Error())
+		return
+	}
+
+	var due []dueReminder
+	for rows.Next() {
+		var d dueReminder
+		if err := rows.Scan(&d.appointmentID, &d.appointmentDate, &d.offsetSeconds); err != nil {
+			rows.Close()
+			utils.LogMessage(config.LogError, "Failed to read due reminders: "+err.Error())
+			return
+		}
+		due = append(due, d)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to read due reminders: "+err.Error())
+		return
+	}
+
+	queued := 0
+	for _, d := range due {
+		ok, err := queueReminder(d)
+		if err != nil {
+			utils.LogMessage(config.LogError, fmt.Sprintf("Failed to queue reminder: Appointment=%d: %s", d.appointmentID, err.Error()))
+			continue
+		}
+		if ok {
+			queued++
+		}
+	}
+	if queued > 0 {
+		utils.LogMessage(config.LogInfo, fmt.Sprintf("Appointment reminders queued: %d", queued))
+	}
+}
+
+// queueReminder records the reminder and enqueues its delivery in one transaction, reporting
+// false if another pass or instance already claimed it. Retries are left to the outbox.
+func queueReminder(d dueReminder) (bool, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var reminderID int
+	err = tx.QueryRow(`
+		INSERT INTO appointment_reminders (appointment_id, appointment_date, offset_seconds, channel, attempts)
+		VALUES ($1, $2, $3, $4, 0)
+		ON CONFLICT (appointment_id, appointment_date, offset_seconds) DO NOTHING
+		RETURNING id
+	`, d.appointmentID, d.appointmentDate, d.offsetSeconds, config.NotifierType).Scan(&reminderID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := outbox.Enqueue(tx, KindReminder, reminderMessage{ReminderID: reminderID}); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// deliverReminder is the outbox handler for KindReminder. The message is written from the current
+// appointment, and skipped if the appointment was cancelled, deleted or moved since it was queued.
+func deliverReminder(payload json.RawMessage) error {
+	var msg reminderMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+
+	var reminderDate, appointmentDate time.Time
+	var current bool
+	var reason, petName, ownerName, email, phone string
+	err := database.DB.QueryRow(`
+		SELECT ar.appointment_date, a.date, a.status = 'scheduled' AND a.deleted_at IS NULL AND p.deleted_at IS NULL AND NOT p.deceased,
+			COALESCE(a.reason, ''), p.name, o.name, o.email, COALESCE(o.contact, '')
+		FROM appointment_reminders ar
+		JOIN appointments a ON ar.appointment_id = a.id
+		JOIN pets p ON a.pet_id = p.id
+		JOIN owners o ON p.owner_id = o.id
+		WHERE ar.id = $1
+	`, msg.ReminderID).Scan(&reminderDate, &appointmentDate, &current, &reason, &petName, &ownerName, &email, &phone)
+	if err == sql.ErrNoRows {
+		// The appointment (and its reminders) was purged
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !current || !appointmentDate.Equal(reminderDate) {
+		_, err := database.DB.Exec("UPDATE appointment_reminders SET status = 'skipped' WHERE id = $1", msg.ReminderID)
+		return err
+	}
+
+	subject := fmt.Sprintf("Reminder: %s's appointment on %s", petName, appointmentDate.Format("Mon 2 Jan"))
+	body := fmt.Sprintf("Hi %s,\n\nThis is a reminder that %s has an appointment at Pet Clinic on %s.",
+		ownerName, petName, appointmentDate.Format("Monday 2 January at 15:04"))
+	if reason = strings.TrimSpace(reason); reason != "" {
+		body += "\nReason: " + reason
+	}
+	body += "\n\nIf you can't make it, please cancel or reschedule so the slot can go to someone else."
+
+	sendErr := notifier.Notify(notifier.Message{Email: email, Phone: phone, Subject: subject, Body: body})
+	if sendErr != nil {
+		_, err = database.DB.Exec(
+			"UPDATE appointment_reminders SET status = 'failed', attempts = attempts + 1, last_error = $1 WHERE id = $2",
+			sendErr.Error(), msg.ReminderID,
+		)
+	} else {
+		_, err = database.DB.Exec(
+			"UPDATE appointment_reminders SET status = 'sent', attempts = attempts + 1, last_error = '', sent_at = NOW() WHERE id = $1",
+			msg.ReminderID,
+		)
+	}
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to record reminder delivery: "+err.Error())
+	}
+	return sendErr
+}
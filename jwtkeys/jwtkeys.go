@@ -0,0 +1,225 @@
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"petclinic/config"
+	"petclinic/utils"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is a verification key, optionally with its private half for signing
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Public  crypto.PublicKey
+	Private crypto.PrivateKey // nil for retired keys kept only for verification
+}
+
+var (
+	// keys holds every key that may verify tokens, by kid
+	keys = map[string]*Key{}
+
+	// active is the key new tokens are signed with
+	active *Key
+)
+
+// ValidMethods lists the algorithms accepted when parsing tokens
+var ValidMethods = []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+
+// InitKeys loads signing and verification keys from config.JWTKeysDir.
+//
+// Each "<kid>.pem" file holds an RSA or Ed25519 key in PEM form. Private keys can
+// sign and verify; public-only keys are retired keys kept so tokens signed before
+// a rotation stay valid until they expire. The active key is config.JWTActiveKeyID,
+// or the private key with the greatest kid if unset. In development a key is
+// generated when the directory is empty.
+func InitKeys() error {
+	keys = map[string]*Key{}
+	active = nil
+
+	files, err := filepath.Glob(filepath.Join(config.JWTKeysDir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		if !config.IsDevelopment() {
+			return fmt.Errorf("no JWT signing keys found in %s", config.JWTKeysDir)
+		}
+		path, err := generateKey(config.JWTKeysDir, config.JWTAlgorithm)
+		if err != nil {
+			return fmt.Errorf("failed to generate development JWT key: %w", err)
+		}
+		utils.LogMessage(config.LogWarn, "Generated development JWT signing key: "+path)
+		files = []string{path}
+	}
+
+	for _, file := range files {
+		key, err := loadKey(file)
+		if err != nil {
+			return fmt.Errorf("failed to load JWT key %s: %w", file, err)
+		}
+		keys[key.ID] = key
+	}
+
+	if config.JWTActiveKeyID != "" {
+		active = keys[config.JWTActiveKeyID]
+		if active == nil || active.Private == nil {
+			return fmt.Errorf("active JWT key %q not found or has no private key", config.JWTActiveKeyID)
+		}
+	} else {
+		ids := make([]string, 0, len(keys))
+		for id, key := range keys {
+			if key.Private != nil {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("no JWT private key available for signing in %s", config.JWTKeysDir)
+		}
+		sort.Strings(ids)
+		active = keys[ids[len(ids)-1]]
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("JWT keys loaded: %d (signing with kid=%s, alg=%s)", len(keys), active.ID, active.Method.Alg()))
+	return nil
+}
+
+// Sign signs claims with the active key and sets the kid header
+func Sign(claims jwt.Claims) (string, error) {
+	if active == nil {
+		return "", fmt.Errorf("JWT keys not initialized")
+	}
+	token := jwt.NewWithClaims(active.Method, claims)
+	token.Header["kid"] = active.ID
+	return token.SignedString(active.Private)
+}
+
+// Keyfunc resolves the verification key for a token from its kid header
+func Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("algorithm %s does not match key %q", token.Method.Alg(), kid)
+	}
+	return key.Public, nil
+}
+
+// JWKS returns the public verification keys as a JSON Web Key Set (RFC 7517)
+func JWKS() map[string]interface{} {
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	set := []map[string]string{}
+	for _, id := range ids {
+		key := keys[id]
+		jwk := map[string]string{
+			"kid": key.ID,
+			"use": "sig",
+			"alg": key.Method.Alg(),
+		}
+		switch pub := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		set = append(set, jwk)
+	}
+	return map[string]interface{}{"keys": set}
+}
+
+// loadKey reads a PEM-encoded private or public key; the kid is the file name without extension
+func loadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+
+	key := &Key{ID: strings.TrimSuffix(filepath.Base(path), ".pem")}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodEdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	return key, nil
+}
+
+// generateKey creates a new private key file in dir and returns its path
+func generateKey(dir, algorithm string) (string, error) {
+	var private crypto.PrivateKey
+	var err error
+	switch algorithm {
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "dev-"+time.Now().UTC().Format("20060102150405")+".pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return path, os.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,138 @@
+package lockout
+
+import (
+	"fmt"
+	"petclinic/config"
+	"petclinic/utils"
+	"strings"
+	"time"
+)
+
+// Attempt is the failed-login state tracked for a single key (account or IP)
+type Attempt struct {
+	Failures     int
+	BlockedUntil time.Time
+}
+
+// Store persists failed-login attempts
+type Store interface {
+	// Reserve atomically checks key and, unless it is blocked, counts an attempt as a
+	// failure before its outcome is known (restarting the count if the previous failure
+	// is older than the failure window) and blocks key for backoff(failures). It returns
+	// the state before and after the call; a blocked key is left unchanged.
+	Reserve(key string, backoff func(failures int) time.Duration) (prev, reserved Attempt, err error)
+	// Release undoes a reservation after a successful attempt, restoring the previous
+	// block unless key was blocked again since
+	Release(key string, prev, reserved Attempt) error
+	// Reset clears all state for key
+	Reset(key string) error
+}
+
+// Policy decides how long a key is blocked after consecutive failures
+type Policy struct {
+	FreeAttempts    int
+	MaxFailures     int
+	BaseDelay       time.Duration
+	LockoutDuration time.Duration
+}
+
+// BlockDuration returns the exponential backoff for the given failure count,
+// or the full lockout once MaxFailures is reached
+func (p Policy) BlockDuration(failures int) time.Duration {
+	if failures >= p.MaxFailures {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.LockoutDuration; i++ {
+		delay *= 2
+	}
+	if delay > p.LockoutDuration {
+		delay = p.LockoutDuration
+	}
+	return delay
+}
+
+var (
+	// Current is the attempt store selected by InitStore
+	Current Store
+
+	// AccountPolicy applies to failures for a single email address
+	AccountPolicy Policy
+
+	// IPPolicy applies to failures from a single client IP, across all accounts
+	IPPolicy Policy
+)
+
+// InitStore selects the attempt store and policies from configuration
+func InitStore() {
+	switch config.LoginAttemptStore {
+	case "memory":
+		Current = NewMemoryStore(config.LoginFailureWindow)
+	default:
+		Current = NewPostgresStore(config.LoginFailureWindow)
+	}
+
+	AccountPolicy = Policy{
+		FreeAttempts:    config.LoginFreeAttempts,
+		MaxFailures:     config.LoginMaxFailures,
+		BaseDelay:       config.LoginBackoffBase,
+		LockoutDuration: config.LoginLockoutDuration,
+	}
+	IPPolicy = Policy{
+		FreeAttempts:    config.LoginMaxIPFailures / 2,
+		MaxFailures:     config.LoginMaxIPFailures,
+		BaseDelay:       config.LoginBackoffBase,
+		LockoutDuration: config.LoginLockoutDuration,
+	}
+
+	utils.LogMessage(config.LogInfo, "Login attempt store initialized: "+config.LoginAttemptStore)
+}
+
+// AccountKey returns the store key for an email address
+func AccountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// IPKey returns the store key for a client IP
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Reservation is an attempt already counted as a failure against a key. Charging the
+// attempt before the password is checked means concurrent requests can't all slip
+// through before the first failure is recorded.
+type Reservation struct {
+	key      string
+	prev     Attempt
+	reserved Attempt
+}
+
+// Reserve counts an attempt against key under the given policy. If key is blocked,
+// nothing is reserved and the remaining wait is returned instead.
+func Reserve(key string, policy Policy) (*Reservation, time.Duration, error) {
+	prev, reserved, err := Current.Reserve(key, policy.BlockDuration)
+	if err != nil {
+		return nil, 0, err
+	}
+	if wait := time.Until(prev.BlockedUntil); wait > 0 {
+		return nil, wait, nil
+	}
+	if reserved.Failures >= policy.MaxFailures && prev.Failures < policy.MaxFailures {
+		utils.LogMessage(config.LogWarn, fmt.Sprintf("Locked out %s after %d failed logins", key, reserved.Failures))
+	}
+	return &Reservation{key: key, prev: prev, reserved: reserved}, 0, nil
+}
+
+// Release gives back a reserved attempt that turned out to succeed
+func (r *Reservation) Release() error {
+	return Current.Release(r.key, r.prev, r.reserved)
+}
+
+// Reset clears failed attempts for key (after a successful login or an admin unlock)
+func Reset(key string) error {
+	return Current.Reset(key)
+}
@@ -0,0 +1,98 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps attempts in process memory; state is lost on restart and not shared between instances
+type MemoryStore struct {
+	mu        sync.Mutex
+	window    time.Duration
+	attempts  map[string]*memoryAttempt
+	lastSweep time.Time
+}
+
+type memoryAttempt struct {
+	Attempt
+	lastFailure time.Time
+}
+
+// NewMemoryStore creates an in-memory store with the given failure window
+func NewMemoryStore(window time.Duration) *MemoryStore {
+	return &MemoryStore{
+		window:   window,
+		attempts: make(map[string]*memoryAttempt),
+	}
+}
+
+// Reserve checks key and counts an attempt against it unless it is blocked
+func (s *MemoryStore) Reserve(key string, backoff func(failures int) time.Duration) (Attempt, Attempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.evictExpired(now)
+
+	a, ok := s.attempts[key]
+	if !ok {
+		a = &memoryAttempt{}
+		s.attempts[key] = a
+	}
+	prev := a.Attempt
+	if now.Before(a.BlockedUntil) {
+		return prev, prev, nil
+	}
+
+	if now.Sub(a.lastFailure) > s.window {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.lastFailure = now
+	if block := backoff(a.Failures); block > 0 {
+		a.BlockedUntil = now.Add(block)
+	}
+	return prev, a.Attempt, nil
+}
+
+// Release undoes a reservation for key
+func (s *MemoryStore) Release(key string, prev, reserved Attempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attempts[key]
+	if !ok {
+		return nil
+	}
+	if a.Failures > 0 {
+		a.Failures--
+	}
+	if a.BlockedUntil.Equal(reserved.BlockedUntil) {
+		a.BlockedUntil = prev.BlockedUntil
+	}
+	return nil
+}
+
+// Reset clears all state for key
+func (s *MemoryStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+// evictExpired drops keys whose failures have aged out of the window and that are no
+// longer blocked, at most once a minute. Callers must hold s.mu.
+func (s *MemoryStore) evictExpired(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for key, a := range s.attempts {
+		if now.Sub(a.lastFailure) > s.window && !now.Before(a.BlockedUntil) {
+			delete(s.attempts, key)
+		}
+	}
+}
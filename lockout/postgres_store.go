@@ -0,0 +1,98 @@
+package lockout
+
+import (
+	"database/sql"
+	"petclinic/database"
+	"time"
+)
+
+// PostgresStore keeps attempts in the login_attempts table so they survive restarts and are shared between instances
+type PostgresStore struct {
+	window time.Duration
+}
+
+// NewPostgresStore creates a Postgres-backed store with the given failure window
+func NewPostgresStore(window time.Duration) *PostgresStore {
+	return &PostgresStore{window: window}
+}
+
+// Reserve checks key and counts an attempt against it unless it is blocked.
+// The row is locked for the duration so concurrent logins are serialized.
+func (s *PostgresStore) Reserve(key string, backoff func(failures int) time.Duration) (Attempt, Attempt, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return Attempt{}, Attempt{}, err
+	}
+	defer tx.Rollback()
+
+	// Make sure there is a row to lock
+	if _, err := tx.Exec(`
+		INSERT INTO login_attempts (key, failures, last_failure_at)
+		VALUES ($1, 0, NOW())
+		ON CONFLICT (key) DO NOTHING
+	`, key); err != nil {
+		return Attempt{}, Attempt{}, err
+	}
+
+	var prev Attempt
+	var blockedUntil sql.NullTime
+	var expired bool
+	err = tx.QueryRow(`
+		SELECT failures, blocked_until, last_failure_at < NOW() - $2 * INTERVAL '1 second'
+		FROM login_attempts WHERE key = $1
+		FOR UPDATE
+	`, key, s.window.Seconds()).Scan(&prev.Failures, &blockedUntil, &expired)
+	if err != nil {
+		return Attempt{}, Attempt{}, err
+	}
+	prev.BlockedUntil = blockedUntil.Time
+	if time.Now().Before(prev.BlockedUntil) {
+		return prev, prev, nil
+	}
+
+	reserved := Attempt{Failures: prev.Failures + 1, BlockedUntil: prev.BlockedUntil}
+	if expired {
+		reserved.Failures = 1
+	}
+	if block := backoff(reserved.Failures); block > 0 {
+		reserved.BlockedUntil = time.Now().Add(block)
+	}
+
+	// Read back blocked_until so Release compares against the stored (microsecond) value
+	err = tx.QueryRow(`
+		UPDATE login_attempts SET failures = $2, blocked_until = $3, last_failure_at = NOW()
+		WHERE key = $1
+		RETURNING blocked_until
+	`, key, reserved.Failures, nullTime(reserved.BlockedUntil)).Scan(&blockedUntil)
+	if err != nil {
+		return Attempt{}, Attempt{}, err
+	}
+	reserved.BlockedUntil = blockedUntil.Time
+
+	if err := tx.Commit(); err != nil {
+		return Attempt{}, Attempt{}, err
+	}
+	return prev, reserved, nil
+}
+
+// Release undoes a reservation for key
+func (s *PostgresStore) Release(key string, prev, reserved Attempt) error {
+	_, err := database.DB.Exec(`
+		UPDATE login_attempts SET
+			failures = GREATEST(failures - 1, 0),
+			blocked_until = CASE WHEN blocked_until IS NOT DISTINCT FROM $2 THEN $3 ELSE blocked_until END
+		WHERE key = $1
+	`, key, nullTime(reserved.BlockedUntil), nullTime(prev.BlockedUntil))
+	return err
+}
+
+// Reset clears all state for key
+func (s *PostgresStore) Reset(key string) error {
+	_, err := database.DB.Exec("DELETE FROM login_attempts WHERE key = $1", key)
+	return err
+}
+
+// nullTime maps the zero time to NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
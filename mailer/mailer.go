@@ -0,0 +1,96 @@
+package mailer
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"petclinic/config"
+	"petclinic/utils"
+	"strings"
+	"time"
+)
+
+// Mailer delivers plain-text emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// Current is the mailer used by handlers, selected by InitMailer
+var Current Mailer
+
+// InitMailer selects the mailer implementation from configuration
+func InitMailer() {
+	switch config.MailerType {
+	case "smtp":
+		Current = &SMTPMailer{
+			Host:     config.SMTPHost,
+			Port:     config.SMTPPort,
+			Username: config.SMTPUser,
+			Password: config.SMTPPassword,
+			From:     config.MailFrom,
+		}
+	default:
+		Current = &LogMailer{Dir: config.MailLogDir}
+	}
+	utils.LogMessage(config.LogInfo, "Mailer initialized: "+config.MailerType)
+}
+
+// Send delivers an email through the configured mailer
+func Send(to, subject, body string) error {
+	if Current == nil {
+		return fmt.Errorf("mailer not initialized")
+	}
+	return Current.Send(to, subject, body)
+}
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send delivers an email via SMTP
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	// Strip line breaks so user-supplied values cannot inject headers
+	header := strings.NewReplacer("\r", "", "\n", "")
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + header.Replace(to) + "\r\n" +
+		"Subject: " + header.Replace(subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=\"utf-8\"\r\n" +
+		"\r\n" + body
+
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, []byte(msg))
+}
+
+// LogMailer writes emails to files and the log instead of sending them (development only)
+type LogMailer struct {
+	Dir string
+}
+
+// Send writes the email to a file in Dir and logs that it was sent. The body is never logged
+// because it may carry one-time links (password resets, verification).
+func (m *LogMailer) Send(to, subject, body string) error {
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Mail to %s: %s", to, subject))
+
+	if m.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(m.Dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	safeTo := strings.NewReplacer("@", "_at_", "/", "_", "\\", "_").Replace(to)
+	filename := fmt.Sprintf("%d_%s.eml", time.Now().UnixNano(), safeTo)
+	content := "To: " + to + "\nSubject: " + subject + "\n\n" + body + "\n"
+	return os.WriteFile(filepath.Join(m.Dir, filename), []byte(content), 0600)
+}
@@ -5,9 +5,18 @@ import (
 	"net/http"
 	"petclinic/config"
 	"petclinic/database"
+	"petclinic/events"
 	"petclinic/handlers"
+	"petclinic/jobs"
+	"petclinic/jwtkeys"
+	"petclinic/lockout"
+	"petclinic/mailer"
 	"petclinic/middleware"
+	"petclinic/notifier"
+	"petclinic/outbox"
 	"petclinic/utils"
+	"petclinic/waitlist"
+	"petclinic/webhooks"
 
 	"github.com/gorilla/mux"
 )
@@ -15,6 +24,9 @@ import (
 func main() {
 	// Load configuration from .env file
 	config.LoadConfig()
+	if err := config.Validate(); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
 
 	// Initialize database
 	if err := database.InitDB(); err != nil {
@@ -22,17 +34,66 @@ func main() {
 	}
 	defer database.Close()
 
+	// Load JWT signing and verification keys
+	if err := jwtkeys.InitKeys(); err != nil {
+		log.Fatal("JWT key initialization failed: ", err)
+	}
+
+	// Initialize mailer and the notifier used for reminders
+	mailer.InitMailer()
+	notifier.InitNotifier()
+
+	// Initialize login attempt tracking
+	lockout.InitStore()
+
+	// Start purging soft-deleted rows past their retention period
+	jobs.StartPurgeJob()
+
+	// Start sending appointment reminders
+	jobs.StartReminderJob()
+
+	// Start passing expired waitlist offers on to the next in line
+	waitlist.StartOfferJob()
+
+	// Start delivering queued emails, events and webhooks
+	webhooks.Init()
+	outbox.StartDispatcher()
+
+	// Relay events committed by any instance to live streams
+	events.StartListener()
+
 	utils.LogMessage(config.LogInfo, "Pet Clinic Management System starting...")
 
 	// Create router
 	router := mux.NewRouter()
 
 	// Apply global middleware
+	router.Use(middleware.StripIdentityHeadersMiddleware)
+	router.Use(middleware.RequestIDMiddleware)
 	router.Use(middleware.LoggingMiddleware)
 
 	// Public routes (no authentication required)
 	router.HandleFunc("/api/register", handlers.RegisterHandler).Methods("POST")
 	router.HandleFunc("/api/login", handlers.LoginHandler).Methods("POST")
+	router.HandleFunc("/api/password/forgot", handlers.ForgotPasswordHandler).Methods("POST")
+	router.HandleFunc("/api/password/reset", handlers.ResetPasswordHandler).Methods("POST")
+	router.HandleFunc("/api/verify-email", handlers.VerifyEmailHandler).Methods("GET")
+	router.HandleFunc("/api/login/mfa", handlers.VerifyMFAHandler).Methods("POST")
+	router.HandleFunc("/api/oidc/login", handlers.OIDCLoginHandler).Methods("GET")
+	router.HandleFunc("/api/oidc/callback", handlers.OIDCCallbackHandler).Methods("GET")
+
+	// Calendar feeds are authenticated by the secret token in their URL
+	router.HandleFunc("/api/calendar/feed/{token}.ics", handlers.CalendarFeedHandler).Methods("GET")
+
+	// Two-factor enrollment also accepts the restricted token issued when enrollment is required at login
+	router.Handle("/api/mfa/enroll", middleware.MFAEnrollmentMiddleware(http.HandlerFunc(handlers.EnrollMFAHandler))).Methods("POST")
+	router.Handle("/api/mfa/confirm", middleware.MFAEnrollmentMiddleware(http.HandlerFunc(handlers.ConfirmMFAHandler))).Methods("POST")
+
+	// Public keys for verifying tokens issued by this service
+	router.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		utils.RespondWithJSON(w, http.StatusOK, jwtkeys.JWKS())
+	}).Methods("GET")
 
 	// Health check endpoint
 	router.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
@@ -46,25 +107,102 @@ func main() {
 	api := router.PathPrefix("/api").Subrouter()
 	api.Use(middleware.AuthMiddleware)
 
+	// Account routes
+	api.HandleFunc("/verify-email/resend", handlers.ResendVerificationHandler).Methods("POST")
+	api.HandleFunc("/mfa/disable", handlers.DisableMFAHandler).Methods("POST")
+	api.HandleFunc("/mfa/recovery-codes", handlers.RegenerateRecoveryCodesHandler).Methods("POST")
+	api.HandleFunc("/oidc/link", handlers.LinkOIDCHandler).Methods("POST")
+
+	// API key routes
+	api.HandleFunc("/api-keys", handlers.CreateAPIKeyHandler).Methods("POST")
+	api.HandleFunc("/api-keys", handlers.GetAPIKeysHandler).Methods("GET")
+	api.HandleFunc("/api-keys/{id}", handlers.RevokeAPIKeyHandler).Methods("DELETE")
+
+	// Admin routes (staff only)
+	api.Handle("/audit-log", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.GetAuditLogHandler))).Methods("GET")
+	api.Handle("/audit-log/verify", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.VerifyAuditLogHandler))).Methods("GET")
+	api.Handle("/admin/owners/{id}/unlock", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.UnlockAccountHandler))).Methods("POST")
+	api.Handle("/admin/outbox", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.GetOutboxHandler))).Methods("GET")
+	api.Handle("/admin/outbox/{id}/retry", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.RetryOutboxMessageHandler))).Methods("POST")
+	api.Handle("/webhooks", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.GetWebhooksHandler))).Methods("GET")
+	api.Handle("/webhooks", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.CreateWebhookHandler))).Methods("POST")
+	api.Handle("/webhooks/{id}", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.GetWebhookHandler))).Methods("GET")
+	api.Handle("/webhooks/{id}", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.UpdateWebhookHandler))).Methods("PUT")
+	api.Handle("/webhooks/{id}", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.DeleteWebhookHandler))).Methods("DELETE")
+	api.Handle("/webhooks/{id}/rotate-secret", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.RotateWebhookSecretHandler))).Methods("POST")
+	api.Handle("/webhooks/{id}/deliveries", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.GetWebhookDeliveriesHandler))).Methods("GET")
+	api.Handle("/webhooks/{id}/deliveries/{delivery_id}/replay", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.ReplayWebhookDeliveryHandler))).Methods("POST")
+
+	// Search
+	api.HandleFunc("/search", handlers.SearchHandler).Methods("GET")
+	api.HandleFunc("/events", handlers.EventStreamHandler).Methods("GET")
+
 	// Pet routes
 	api.HandleFunc("/pets", handlers.CreatePetHandler).Methods("POST")
 	api.HandleFunc("/pets", handlers.GetPetsHandler).Methods("GET")
+	api.HandleFunc("/pets/by-microchip/{chip}", handlers.GetPetByMicrochipHandler).Methods("GET")
 	api.HandleFunc("/pets/{id}", handlers.GetPetByIDHandler).Methods("GET")
 	api.HandleFunc("/pets/{id}", handlers.UpdatePetHandler).Methods("PUT")
 	api.HandleFunc("/pets/{id}", handlers.DeletePetHandler).Methods("DELETE")
+	api.Handle("/pets/{id}/vitals", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.RecordVitalsHandler))).Methods("POST")
+	api.HandleFunc("/pets/{id}/vitals", handlers.GetVitalsHandler).Methods("GET")
+	api.HandleFunc("/pets/{id}/alerts", handlers.CreatePetAlertHandler).Methods("POST")
+	api.HandleFunc("/pets/{id}/alerts", handlers.GetPetAlertsHandler).Methods("GET")
+	api.Handle("/pets/{id}/alerts/{alert_id}", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.DeletePetAlertHandler))).Methods("DELETE")
+	api.Handle("/pets/{id}/allergy-check", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.CheckDrugAllergyHandler))).Methods("POST")
+	api.Handle("/pets/{id}/prescriptions", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.CreatePrescriptionHandler))).Methods("POST")
+	api.HandleFunc("/pets/{id}/prescriptions", handlers.GetPrescriptionsHandler).Methods("GET")
+	api.HandleFunc("/pets/{id}/guardians", handlers.GetPetGuardiansHandler).Methods("GET")
+	api.HandleFunc("/pets/{id}/guardians", handlers.InviteGuardianHandler).Methods("POST")
+	api.HandleFunc("/pets/{id}/guardians/{owner_id}", handlers.RemoveGuardianHandler).Methods("DELETE")
+	api.HandleFunc("/guardian-invitations/accept", handlers.AcceptGuardianInvitationHandler).Methods("POST")
+	api.HandleFunc("/pets/{id}/transfers", handlers.GetPetTransfersHandler).Methods("GET")
+	api.HandleFunc("/pets/{id}/transfers", handlers.CreatePetTransferHandler).Methods("POST")
+	api.HandleFunc("/pets/{id}/ownership-history", handlers.GetOwnershipHistoryHandler).Methods("GET")
+	api.Handle("/transfers", middleware.VerifiedEmailMiddleware(http.HandlerFunc(handlers.GetIncomingTransfersHandler))).Methods("GET")
+	api.HandleFunc("/transfers/{id}/accept", handlers.AcceptPetTransferHandler).Methods("POST")
+	api.HandleFunc("/transfers/{id}/decline", handlers.DeclinePetTransferHandler).Methods("POST")
+	api.HandleFunc("/transfers/{id}/cancel", handlers.CancelPetTransferHandler).Methods("POST")
+	api.Handle("/pets/{id}/restore", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.RestorePetHandler))).Methods("POST")
 
 	// Appointment routes
-	api.HandleFunc("/appointments", handlers.CreateAppointmentHandler).Methods("POST")
+	api.Handle("/appointments", middleware.VerifiedEmailMiddleware(http.HandlerFunc(handlers.CreateAppointmentHandler))).Methods("POST")
 	api.HandleFunc("/appointments", handlers.GetAppointmentsHandler).Methods("GET")
+	api.Handle("/appointments/series", middleware.VerifiedEmailMiddleware(http.HandlerFunc(handlers.CreateAppointmentSeriesHandler))).Methods("POST")
+	api.HandleFunc("/appointments/series/{id}", handlers.GetAppointmentSeriesHandler).Methods("GET")
+	api.HandleFunc("/appointments/series/{id}", handlers.UpdateAppointmentSeriesHandler).Methods("PUT")
+	api.HandleFunc("/appointments/series/{id}", handlers.CancelAppointmentSeriesHandler).Methods("DELETE")
 	api.HandleFunc("/appointments/{id}", handlers.GetAppointmentByIDHandler).Methods("GET")
 	api.HandleFunc("/appointments/{id}", handlers.UpdateAppointmentHandler).Methods("PUT")
 	api.HandleFunc("/appointments/{id}", handlers.DeleteAppointmentHandler).Methods("DELETE")
+	api.Handle("/appointments/{id}/restore", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.RestoreAppointmentHandler))).Methods("POST")
+	api.Handle("/appointments/{id}/reminders", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.GetAppointmentRemindersHandler))).Methods("GET")
+	api.HandleFunc("/appointments/{id}/ics", handlers.AppointmentICSHandler).Methods("GET")
+	api.HandleFunc("/calendar/feed", handlers.CreateCalendarFeedHandler).Methods("POST")
+	api.HandleFunc("/calendar/feed", handlers.DeleteCalendarFeedHandler).Methods("DELETE")
+
+	// Waitlist routes
+	api.HandleFunc("/waitlist", handlers.GetWaitlistHandler).Methods("GET")
+	api.Handle("/waitlist", middleware.VerifiedEmailMiddleware(http.HandlerFunc(handlers.JoinWaitlistHandler))).Methods("POST")
+	api.HandleFunc("/waitlist/{id}", handlers.LeaveWaitlistHandler).Methods("DELETE")
+	api.HandleFunc("/waitlist/offers/claim", handlers.ClaimWaitlistOfferHandler).Methods("POST")
+	api.HandleFunc("/waitlist/offers/decline", handlers.DeclineWaitlistOfferHandler).Methods("POST")
+
+	// Walk-in queue routes
+	api.Handle("/queue", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.GetQueueHandler))).Methods("GET")
+	api.Handle("/queue", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.CheckInHandler))).Methods("POST")
+	api.Handle("/queue/call-next", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.CallNextPatientHandler))).Methods("POST")
+	api.HandleFunc("/queue/{id}", handlers.GetQueueEntryHandler).Methods("GET")
+	api.Handle("/queue/{id}", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.LeaveQueueHandler))).Methods("DELETE")
+	api.Handle("/queue/{id}/triage", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.TriageQueueEntryHandler))).Methods("PUT")
+	api.Handle("/queue/{id}/complete", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.CompleteQueueEntryHandler))).Methods("POST")
 
 	// Medical records routes
-	api.HandleFunc("/medical-records", handlers.UploadMedicalRecordHandler).Methods("POST")
+	api.Handle("/medical-records", middleware.VerifiedEmailMiddleware(http.HandlerFunc(handlers.UploadMedicalRecordHandler))).Methods("POST")
 	api.HandleFunc("/medical-records/pet/{pet_id}", handlers.GetMedicalRecordsHandler).Methods("GET")
 	api.HandleFunc("/medical-records/{id}/download", handlers.DownloadMedicalRecordHandler).Methods("GET")
 	api.HandleFunc("/medical-records/{id}", handlers.DeleteMedicalRecordHandler).Methods("DELETE")
+	api.Handle("/medical-records/{id}/restore", middleware.StaffOnlyMiddleware(http.HandlerFunc(handlers.RestoreMedicalRecordHandler))).Methods("POST")
 
 	// Start server
 	utils.LogMessage(config.LogInfo, "Server listening on "+config.ServerPort)
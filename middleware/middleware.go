@@ -2,11 +2,13 @@ package middleware
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"petclinic/config"
+	"petclinic/database"
+	"petclinic/jwtkeys"
 	"petclinic/models"
 	"petclinic/utils"
-	"strconv"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -15,14 +17,51 @@ import (
 // LoggingMiddleware logs all incoming requests
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		utils.LogMessage(config.LogInfo, fmt.Sprintf("%s %s from %s", r.Method, r.URL.Path, r.RemoteAddr))
+		utils.LogMessage(config.LogInfo, fmt.Sprintf("%s %s from %s [%s]", r.Method, r.URL.Path, r.RemoteAddr, GetRequestID(r)))
 		next.ServeHTTP(w, r)
 	})
 }
 
-// AuthMiddleware validates JWT tokens and adds user info to request headers
+// AuthMiddleware validates JWT tokens or scoped API keys and stores the caller's Principal in the request context
 func AuthMiddleware(next http.Handler) http.Handler {
+	return authenticate(next, "")
+}
+
+// MFAEnrollmentMiddleware accepts regular access tokens as well as the restricted
+// enrollment token issued at login to users who must set up two-factor authentication
+func MFAEnrollmentMiddleware(next http.Handler) http.Handler {
+	return authenticate(next, "", models.PurposeMFAEnroll)
+}
+
+// authenticate validates the Bearer token, only accepting tokens whose purpose is listed
+func authenticate(next http.Handler, purposes ...string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// API keys are limited to the resources their scopes grant (see requiredScope)
+		if apiKey := extractAPIKey(r); apiKey != "" {
+			identity, err := authenticateAPIKey(apiKey)
+			if err != nil {
+				utils.LogMessage(config.LogWarn, "Invalid API key: "+err.Error())
+				utils.RespondWithError(w, http.StatusUnauthorized, "Invalid API key")
+				return
+			}
+
+			scope := requiredScope(r)
+			if scope == "" || !utils.ContainsString(identity.Scopes, scope) {
+				utils.LogMessage(config.LogWarn, fmt.Sprintf("API key for user %d lacks scope %q for %s", identity.UserID, scope, r.URL.Path))
+				utils.RespondWithError(w, http.StatusForbidden, "API key is not allowed to access this resource")
+				return
+			}
+
+			next.ServeHTTP(w, WithPrincipal(r, &Principal{
+				UserID:     identity.UserID,
+				Role:       identity.Role,
+				Email:      identity.Email,
+				AuthMethod: AuthMethodAPIKey,
+				Scopes:     identity.Scopes,
+			}))
+			return
+		}
+
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
 			utils.LogMessage(config.LogWarn, "Missing authorization header")
@@ -31,32 +70,60 @@ func AuthMiddleware(next http.Handler) http.Handler {
 		}
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		claims := &models.Claims{}
-
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(config.JWTSecret), nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := ParseToken(tokenString)
+		if err != nil {
 			utils.LogMessage(config.LogWarn, "Invalid token: "+err.Error())
 			utils.RespondWithError(w, http.StatusUnauthorized, "Invalid token")
 			return
 		}
 
-		// Add user info to request headers for downstream handlers
-		r.Header.Set("X-User-ID", strconv.Itoa(claims.UserID))
-		r.Header.Set("X-User-Role", claims.Role)
-		r.Header.Set("X-User-Email", claims.Email)
+		allowed := false
+		for _, purpose := range purposes {
+			if claims.Purpose == purpose {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			utils.LogMessage(config.LogWarn, fmt.Sprintf("Token with purpose %q rejected for %s", claims.Purpose, r.URL.Path))
+			utils.RespondWithError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
 
-		next.ServeHTTP(w, r)
+		// Make the authenticated identity available to downstream handlers
+		next.ServeHTTP(w, WithPrincipal(r, &Principal{
+			UserID:     claims.UserID,
+			Role:       claims.Role,
+			Email:      claims.Email,
+			AuthMethod: AuthMethodJWT,
+		}))
 	})
 }
 
+// ParseToken verifies a JWT's signature and expiry and checks it has not been revoked
+func ParseToken(tokenString string) (*models.Claims, error) {
+	claims := &models.Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, jwtkeys.Keyfunc, jwt.WithValidMethods(jwtkeys.ValidMethods))
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("token is not valid")
+	}
+
+	// Reject tokens issued before the user's sessions were invalidated (e.g. password reset)
+	var tokenVersion int
+	err = database.DB.QueryRow("SELECT token_version FROM owners WHERE id = $1", claims.UserID).Scan(&tokenVersion)
+	if err != nil || tokenVersion != claims.TokenVersion {
+		return nil, fmt.Errorf("token revoked for user %d", claims.UserID)
+	}
+	return claims, nil
+}
+
 // StaffOnlyMiddleware restricts access to staff members only
 func StaffOnlyMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		role := r.Header.Get("X-User-Role")
-		if role != "staff" {
+		if GetUserRoleFromRequest(r) != "staff" {
 			utils.LogMessage(config.LogWarn, "Unauthorized staff access attempt")
 			utils.RespondWithError(w, http.StatusForbidden, "Staff access only")
 			return
@@ -65,13 +132,30 @@ func StaffOnlyMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// GetUserIDFromRequest extracts user ID from request headers
-func GetUserIDFromRequest(r *http.Request) int {
-	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
-	return userID
+// VerifiedEmailMiddleware blocks owners with unverified email addresses when REQUIRE_VERIFIED_EMAIL is enabled
+func VerifiedEmailMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config.RequireVerifiedEmail || GetUserRoleFromRequest(r) == "staff" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var verified bool
+		err := database.DB.QueryRow("SELECT email_verified FROM owners WHERE id = $1", GetUserIDFromRequest(r)).Scan(&verified)
+		if err != nil || !verified {
+			utils.LogMessage(config.LogWarn, fmt.Sprintf("Unverified user %d blocked from %s", GetUserIDFromRequest(r), r.URL.Path))
+			utils.RespondWithError(w, http.StatusForbidden, "Please verify your email address first")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
-// GetUserRoleFromRequest extracts user role from request headers
-func GetUserRoleFromRequest(r *http.Request) string {
-	return r.Header.Get("X-User-Role")
-}
\ No newline at end of file
+// GetClientIP returns the IP address of the client that sent the request
+func GetClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
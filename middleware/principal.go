@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Authentication methods recorded on a Principal
+const (
+	AuthMethodJWT    = "jwt"
+	AuthMethodAPIKey = "api_key"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserID     int
+	Role       string
+	Email      string
+	AuthMethod string
+	Scopes     []string // only set for API keys
+}
+
+// IsStaff reports whether the caller is a clinic staff member
+func (p *Principal) IsStaff() bool {
+	return p.Role == "staff"
+}
+
+// principalKey is the context key for the Principal; unexported so only this package can set it
+type principalKey struct{}
+
+// WithPrincipal returns a copy of r carrying the given principal in its context
+func WithPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// GetPrincipal returns the authenticated caller, if the request passed through AuthMiddleware
+func GetPrincipal(r *http.Request) (*Principal, bool) {
+	p, ok := r.Context().Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// GetUserIDFromRequest returns the authenticated user's ID (0 if unauthenticated)
+func GetUserIDFromRequest(r *http.Request) int {
+	if p, ok := GetPrincipal(r); ok {
+		return p.UserID
+	}
+	return 0
+}
+
+// GetUserRoleFromRequest returns the authenticated user's role ("" if unauthenticated)
+func GetUserRoleFromRequest(r *http.Request) string {
+	if p, ok := GetPrincipal(r); ok {
+		return p.Role
+	}
+	return ""
+}
+
+// GetUserEmailFromRequest returns the authenticated user's email ("" if unauthenticated)
+func GetUserEmailFromRequest(r *http.Request) string {
+	if p, ok := GetPrincipal(r); ok {
+		return p.Email
+	}
+	return ""
+}
+
+// StripIdentityHeadersMiddleware removes client-supplied X-User-* headers at the edge.
+// Identity now travels in the request context, but stripping keeps stale clients or
+// proxies from injecting values that anything downstream might still trust.
+func StripIdentityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name := range r.Header {
+			if strings.HasPrefix(http.CanonicalHeaderKey(name), "X-User-") {
+				r.Header.Del(name)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
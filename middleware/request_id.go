@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"petclinic/utils"
+	"regexp"
+)
+
+// requestIDKey is the context key for the request ID
+type requestIDKey struct{}
+
+// validRequestID limits client-supplied request IDs to a safe, bounded format
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestIDMiddleware assigns every request an ID (reusing a well-formed X-Request-ID from the client)
+// and echoes it in the response so logs and audit entries can be correlated
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id, _ = utils.GenerateToken(12)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// GetRequestID returns the ID assigned by RequestIDMiddleware ("" if none)
+func GetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -17,21 +20,415 @@ type Owner struct {
 
 // Pet represents a pet in the clinic
 type Pet struct {
-	ID             int    `json:"id"`
-	Name           string `json:"name"`
-	Species        string `json:"species"`
-	Breed          string `json:"breed"`
-	OwnerID        int    `json:"owner_id"`
-	MedicalHistory string `json:"medical_history"`
+	ID             int        `json:"id"`
+	Name           string     `json:"name"`
+	Species        string     `json:"species"`
+	Breed          string     `json:"breed"`
+	OwnerID        int        `json:"owner_id"`
+	MedicalHistory string     `json:"medical_history"`
+	DateOfBirth    *Date      `json:"date_of_birth"`
+	Age            *Age       `json:"age,omitempty"` // computed from DateOfBirth, up to DeceasedAt for deceased pets
+	Sex            string     `json:"sex"`           // "male", "female" or "unknown"
+	Neutered       bool       `json:"neutered"`
+	Color          string     `json:"color"`
+	Markings       string     `json:"markings"`
+	Microchip      string     `json:"microchip,omitempty"`
+	Deceased       bool       `json:"deceased"`
+	DeceasedAt     *Date      `json:"deceased_at"`
+	Alerts         []PetAlert `json:"alerts"` // empty when the pet has none; null only where alerts aren't loaded
+}
+
+// Pet sexes
+var PetSexes = []string{"male", "female", "unknown"}
+
+// Age is a pet's age in whole years and remaining months
+type Age struct {
+	Years  int `json:"years"`
+	Months int `json:"months"`
+}
+
+// AgeBetween returns the age of something born on birth as of the given day
+func AgeBetween(birth, asOf time.Time) Age {
+	months := (asOf.Year()-birth.Year())*12 + int(asOf.Month()-birth.Month())
+	if asOf.Day() < birth.Day() {
+		months--
+	}
+	if months < 0 {
+		months = 0
+	}
+	return Age{Years: months / 12, Months: months % 12}
+}
+
+// Date is a calendar date encoded as "YYYY-MM-DD" in JSON and as DATE in the database
+type Date struct {
+	time.Time
+}
+
+// DateLayout is the JSON format of Date
+const DateLayout = "2006-01-02"
+
+// MarshalJSON encodes the date as "YYYY-MM-DD"
+func (d Date) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + d.Format(DateLayout) + `"`), nil
+}
+
+// UnmarshalJSON decodes "YYYY-MM-DD"
+func (d *Date) UnmarshalJSON(data []byte) error {
+	t, err := time.Parse(`"`+DateLayout+`"`, string(data))
+	if err != nil {
+		return err
+	}
+	d.Time = t
+	return nil
+}
+
+// Value stores the date as a DATE
+func (d Date) Value() (driver.Value, error) {
+	return d.Format(DateLayout), nil
+}
+
+// Scan reads a DATE column
+func (d *Date) Scan(src interface{}) error {
+	t, ok := src.(time.Time)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into Date", src)
+	}
+	d.Time = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return nil
+}
+
+// VitalSign is a single measurement of one metric
+type VitalSign struct {
+	ID            int       `json:"id"`
+	PetID         int       `json:"pet_id"`
+	AppointmentID *int      `json:"appointment_id"`
+	Metric        string    `json:"metric"`
+	Value         float64   `json:"value"`
+	Unit          string    `json:"unit"`
+	Notes         string    `json:"notes"`
+	RecordedBy    int       `json:"recorded_by"`
+	RecordedAt    time.Time `json:"recorded_at"`
+}
+
+// VitalMeasurement is one value in a RecordVitalsRequest; Unit defaults to the metric's canonical unit
+type VitalMeasurement struct {
+	Metric string  `json:"metric"`
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit"`
+}
+
+// RecordVitalsRequest records measurements taken together, e.g. during one visit
+type RecordVitalsRequest struct {
+	AppointmentID *int               `json:"appointment_id"`
+	RecordedAt    *time.Time         `json:"recorded_at"`
+	Notes         string             `json:"notes"`
+	Measurements  []VitalMeasurement `json:"measurements"`
+}
+
+// VitalChange compares the latest measurement with the one from the previous visit
+type VitalChange struct {
+	Previous           float64   `json:"previous"`
+	PreviousRecordedAt time.Time `json:"previous_recorded_at"`
+	Current            float64   `json:"current"`
+	Delta              float64   `json:"delta"`
+	Percent            float64   `json:"percent"`
+}
+
+// VitalSeries is a pet's history for one metric
+type VitalSeries struct {
+	PetID                int          `json:"pet_id"`
+	Metric               string       `json:"metric"`
+	Unit                 string       `json:"unit"`
+	Measurements         []VitalSign  `json:"measurements"`
+	NextCursor           string       `json:"next_cursor,omitempty"`
+	TotalCount           int          `json:"total_count"`
+	ChangeSinceLastVisit *VitalChange `json:"change_since_last_visit"`
+}
+
+// PetAlert is an allergy or warning staff should see before handling a pet
+type PetAlert struct {
+	ID           int       `json:"id"`
+	PetID        int       `json:"pet_id"`
+	Type         string    `json:"type"`                    // "allergy", "behavior" or "medical"
+	AllergenType string    `json:"allergen_type,omitempty"` // allergies only: "drug", "food" or "environmental"
+	Substance    string    `json:"substance,omitempty"`     // allergies only, e.g. "penicillin"
+	Description  string    `json:"description"`
+	Severity     string    `json:"severity"` // "low", "moderate" or "high"
+	CreatedBy    int       `json:"created_by"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Alert types, allergen types and severities (most severe last)
+var (
+	AlertTypes      = []string{"allergy", "behavior", "medical"}
+	AllergenTypes   = []string{"drug", "food", "environmental"}
+	AlertSeverities = []string{"low", "moderate", "high"}
+)
+
+// AllergyCheckRequest asks whether a drug conflicts with a pet's recorded drug allergies
+type AllergyCheckRequest struct {
+	Drug string `json:"drug"`
+}
+
+// Prescription is a drug prescribed to a pet
+type Prescription struct {
+	ID              int        `json:"id"`
+	PetID           int        `json:"pet_id"`
+	AppointmentID   *int       `json:"appointment_id"`
+	Drug            string     `json:"drug"`
+	Dose            string     `json:"dose"`
+	Instructions    string     `json:"instructions"`
+	AllergyOverride string     `json:"allergy_override,omitempty"` // why a high-severity allergy match was prescribed anyway
+	PrescribedBy    int        `json:"prescribed_by"`
+	PrescribedAt    time.Time  `json:"prescribed_at"`
+	AllergyWarnings []PetAlert `json:"allergy_warnings,omitempty"` // drug allergies matched when prescribing
+}
+
+// CreatePrescriptionRequest prescribes a drug. OverrideReason is required to prescribe despite a
+// high-severity drug allergy match.
+type CreatePrescriptionRequest struct {
+	AppointmentID  *int   `json:"appointment_id"`
+	Drug           string `json:"drug"`
+	Dose           string `json:"dose"`
+	Instructions   string `json:"instructions"`
+	OverrideReason string `json:"override_reason"`
+}
+
+// PetGuardian is a person with access to a pet
+type PetGuardian struct {
+	PetID     int       `json:"pet_id"`
+	OwnerID   int       `json:"owner_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`     // "primary", "co_owner" or "caretaker"
+	CanBook   bool      `json:"can_book"` // caretakers only; owners can always book
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Guardian roles that can be granted by invitation (each pet has exactly one "primary")
+var GuardianInviteRoles = []string{"co_owner", "caretaker"}
+
+// GuardianInvitation is a pending invitation to become a pet's guardian
+type GuardianInvitation struct {
+	ID        int       `json:"id"`
+	PetID     int       `json:"pet_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CanBook   bool      `json:"can_book"`
+	InvitedBy int       `json:"invited_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AcceptInvitationRequest carries the token from a guardian invitation or pet transfer email
+type AcceptInvitationRequest struct {
+	Token string `json:"token"`
+}
+
+// PetTransfer is a request to hand a pet over to a new primary owner
+type PetTransfer struct {
+	ID          int        `json:"id"`
+	PetID       int        `json:"pet_id"`
+	PetName     string     `json:"pet_name"`
+	FromOwnerID int        `json:"from_owner_id"`
+	ToEmail     string     `json:"to_email"`
+	ToOwnerID   *int       `json:"to_owner_id"`
+	Status      string     `json:"status"` // "pending", "accepted", "declined", "cancelled" or "expired"
+	Note        string     `json:"note"`
+	InitiatedBy int        `json:"initiated_by"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	RespondedAt *time.Time `json:"responded_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// CreateTransferRequest starts a pet transfer to the account with the given email
+type CreateTransferRequest struct {
+	Email string `json:"email"`
+	Note  string `json:"note"`
+}
+
+// OwnershipPeriod is one entry in a pet's chain of custody
+type OwnershipPeriod struct {
+	OwnerID    int        `json:"owner_id"`
+	OwnerName  string     `json:"owner_name"`
+	TransferID *int       `json:"transfer_id"`
+	StartedAt  time.Time  `json:"started_at"`
+	EndedAt    *time.Time `json:"ended_at"`
+}
+
+// AppointmentReminder is the delivery state of one reminder for an appointment
+type AppointmentReminder struct {
+	AppointmentID   int        `json:"appointment_id"`
+	AppointmentDate time.Time  `json:"appointment_date"`
+	Offset          string     `json:"offset"` // how long before the appointment, e.g. "48h0m0s"
+	Channel         string     `json:"channel"`
+	Status          string     `json:"status"` // "sending" (queued), "sent", "failed" (retrying) or "skipped"
+	Attempts        int        `json:"attempts"`
+	LastError       string     `json:"last_error,omitempty"`
+	SentAt          *time.Time `json:"sent_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// WebhookSubscription sends the chosen event types to a URL. Secret is only returned when the
+// subscription is created; receivers use it to check the X-PetClinic-Signature header.
+type WebhookSubscription struct {
+	ID          int       `json:"id"`
+	URL         string    `json:"url"`
+	EventTypes  []string  `json:"event_types"`
+	Secret      string    `json:"secret,omitempty"`
+	Description string    `json:"description"`
+	Active      bool      `json:"active"`
+	CreatedBy   int       `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event sent (or being sent) to a subscription
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	SubscriptionID int             `json:"subscription_id"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"` // "pending", "delivered", "failed" or "skipped"
+	Attempts       int             `json:"attempts"`
+	ResponseStatus *int            `json:"response_status"`
+	LastError      string          `json:"last_error,omitempty"`
+	ReplayOf       *int            `json:"replay_of,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+}
+
+// Page is one page of a list endpoint's results
+type Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	TotalCount int         `json:"total_count"`
+}
+
+// SearchResult is a single ranked hit from GET /api/search
+type SearchResult struct {
+	Type     string  `json:"type"` // "pet" or "owner"
+	ID       int     `json:"id"`
+	Title    string  `json:"title"`
+	Subtitle string  `json:"subtitle"`
+	OwnerID  int     `json:"owner_id"`
+	Rank     float64 `json:"rank"`
 }
 
 // Appointment represents a clinic appointment
 type Appointment struct {
-	ID     int       `json:"id"`
+	ID     int        `json:"id"`
+	PetID  int        `json:"pet_id"`
+	Date   time.Time  `json:"date"`
+	Reason string     `json:"reason"`
+	Vet    string     `json:"vet"` // the vet seeing the pet, if assigned; matched against waitlist preferences
+	Status string     `json:"status"`
+	Alerts []PetAlert `json:"alerts"` // the pet's alerts when showing an appointment (empty if none); null elsewhere
+
+	SeriesID        *int `json:"series_id,omitempty"`        // set when the appointment is an occurrence of a series
+	SeriesException bool `json:"series_exception,omitempty"` // the occurrence was changed on its own
+}
+
+// Appointment statuses. Owners can only book (scheduled) and cancel; the others are set by staff
+// and the walk-in queue. Scheduled and checked_in appointments are active.
+var (
+	AppointmentStatuses       = []string{"scheduled", "checked_in", "completed", "no_show", "cancelled"}
+	OwnerAppointmentStatuses  = []string{"scheduled", "cancelled"}
+	ActiveAppointmentStatuses = []string{"scheduled", "checked_in"}
+)
+
+// AppointmentSeries books an appointment for every occurrence of a recurrence rule
+type AppointmentSeries struct {
+	ID           int                   `json:"id"`
+	PetID        int                   `json:"pet_id"`
+	RRule        string                `json:"rrule"` // e.g. "FREQ=WEEKLY;COUNT=6"
+	Start        time.Time             `json:"start"` // the first occurrence
+	Reason       string                `json:"reason"`
+	CreatedBy    *int                  `json:"created_by"`
+	CreatedAt    time.Time             `json:"created_at"`
+	CancelledAt  *time.Time            `json:"cancelled_at"`
+	Appointments []Appointment         `json:"appointments"`
+	Skipped      []AppointmentConflict `json:"skipped,omitempty"` // occurrences left out with ?skip_conflicts=true
+}
+
+// AppointmentSeriesRequest creates a series or, on update, replaces its rule, start and reason
+type AppointmentSeriesRequest struct {
 	PetID  int       `json:"pet_id"`
-	Date   time.Time `json:"date"`
+	RRule  string    `json:"rrule"`
+	Start  time.Time `json:"start"`
 	Reason string    `json:"reason"`
-	Status string    `json:"status"`
+}
+
+// WaitlistEntry asks for an appointment for a pet within a date range, should a booked slot be cancelled
+type WaitlistEntry struct {
+	ID            int       `json:"id"`
+	PetID         int       `json:"pet_id"`
+	OwnerID       int       `json:"owner_id"`
+	Earliest      time.Time `json:"earliest"`
+	Latest        time.Time `json:"latest"`
+	PreferredVet  string    `json:"preferred_vet"` // only slots with this vet are offered (case-insensitive); empty for any vet
+	Reason        string    `json:"reason"`
+	Status        string    `json:"status"` // "waiting", "booked", "cancelled" or "expired"
+	AppointmentID *int      `json:"appointment_id"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// CreateWaitlistRequest joins the waitlist for a pet
+type CreateWaitlistRequest struct {
+	PetID        int       `json:"pet_id"`
+	Earliest     time.Time `json:"earliest"`
+	Latest       time.Time `json:"latest"`
+	PreferredVet string    `json:"preferred_vet"`
+	Reason       string    `json:"reason"`
+}
+
+// WaitlistOfferRequest carries the token from a slot offer email
+type WaitlistOfferRequest struct {
+	Token string `json:"token"`
+}
+
+// QueueEntry is a patient checked in at the clinic, with or without an appointment
+type QueueEntry struct {
+	ID            int        `json:"id"`
+	PetID         int        `json:"pet_id"`
+	PetName       string     `json:"pet_name"`
+	AppointmentID *int       `json:"appointment_id"`
+	Priority      string     `json:"priority"` // "emergency", "urgent", "standard" or "routine"
+	Reason        string     `json:"reason"`
+	Status        string     `json:"status"` // "waiting", "in_room", "done" or "left"
+	Room          string     `json:"room,omitempty"`
+	CheckedInBy   *int       `json:"checked_in_by"`
+	CheckedInAt   time.Time  `json:"checked_in_at"`
+	CalledAt      *time.Time `json:"called_at"`
+	CompletedAt   *time.Time `json:"completed_at"`
+
+	// Set while waiting: place in line (1 is next) and a rough estimate of the wait
+	Position             int  `json:"position,omitempty"`
+	EstimatedWaitMinutes *int `json:"estimated_wait_minutes,omitempty"`
+}
+
+// CheckInRequest adds a patient to the queue: either a booked appointment or a walk-in pet
+type CheckInRequest struct {
+	AppointmentID *int   `json:"appointment_id"`
+	PetID         int    `json:"pet_id"`
+	Priority      string `json:"priority"` // defaults to "standard"
+	Reason        string `json:"reason"`
+}
+
+// TriageRequest changes a waiting patient's priority
+type TriageRequest struct {
+	Priority string `json:"priority"`
+}
+
+// CallPatientRequest names the room a called patient should go to
+type CallPatientRequest struct {
+	Room string `json:"room"`
+}
+
+// AppointmentConflict is an occurrence that overlaps one of the pet's existing appointments
+type AppointmentConflict struct {
+	Date          time.Time `json:"date"`
+	AppointmentID int       `json:"appointment_id"`
+	ExistingDate  time.Time `json:"existing_date"`
 }
 
 // MedicalRecord represents uploaded medical documents
@@ -58,10 +455,68 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+// ForgotPasswordRequest represents a password reset request
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordRequest represents a password reset using an emailed token
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// MFAVerifyRequest completes a two-step login with a TOTP or recovery code
+type MFAVerifyRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MFACodeRequest carries a TOTP code for enrollment and management
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+// APIKey represents a long-lived credential for machine integrations
+type APIKey struct {
+	ID         int        `json:"id"`
+	OwnerID    int        `json:"owner_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CreateAPIKeyRequest represents a request to create an API key
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// APIKeyScopes lists the scopes an API key can be granted; "<resource>:write" does not imply read
+var APIKeyScopes = []string{
+	"pets:read", "pets:write",
+	"appointments:read", "appointments:write",
+	"records:read", "records:write",
+}
+
+// Token purposes for restricted, short-lived tokens issued during login
+const (
+	PurposeMFAChallenge = "mfa_challenge"
+	PurposeMFAEnroll    = "mfa_enroll"
+)
+
 // Claims represents JWT token claims
 type Claims struct {
-	UserID int    `json:"user_id"`
-	Email  string `json:"email"`
-	Role   string `json:"role"`
+	UserID       int    `json:"user_id"`
+	Email        string `json:"email"`
+	Role         string `json:"role"`
+	TokenVersion int    `json:"token_version"`
+	Purpose      string `json:"purpose,omitempty"` // empty for regular access tokens
 	jwt.RegisteredClaims
-}
\ No newline at end of file
+}
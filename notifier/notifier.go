@@ -0,0 +1,122 @@
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"petclinic/config"
+	"petclinic/mailer"
+	"petclinic/utils"
+	"time"
+)
+
+// ErrNoAddress means the recipient has no address for the notifier's channel
+var ErrNoAddress = errors.New("recipient has no address for this channel")
+
+// Message is a notification for one person; each channel uses the address it needs
+type Message struct {
+	Email   string
+	Phone   string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers short notifications to clients
+type Notifier interface {
+	Notify(msg Message) error
+}
+
+// Current is the notifier used by background jobs, selected by InitNotifier
+var Current Notifier
+
+// InitNotifier selects the notifier implementation from configuration
+func InitNotifier() {
+	switch config.NotifierType {
+	case "sms":
+		Current = &SMSNotifier{
+			URL:    config.SMSGatewayURL,
+			Token:  config.SMSGatewayToken,
+			From:   config.SMSFrom,
+			Client: &http.Client{Timeout: 10 * time.Second},
+		}
+	case "log":
+		Current = &LogNotifier{}
+	default:
+		Current = &EmailNotifier{}
+	}
+	utils.LogMessage(config.LogInfo, "Notifier initialized: "+config.NotifierType)
+}
+
+// Notify delivers a notification through the configured notifier
+func Notify(msg Message) error {
+	if Current == nil {
+		return fmt.Errorf("notifier not initialized")
+	}
+	return Current.Notify(msg)
+}
+
+// EmailNotifier sends notifications as emails through the configured mailer
+type EmailNotifier struct{}
+
+// Notify emails the message
+func (n *EmailNotifier) Notify(msg Message) error {
+	if msg.Email == "" {
+		return ErrNoAddress
+	}
+	return mailer.Send(msg.Email, msg.Subject, msg.Body)
+}
+
+// SMSNotifier sends text messages through an HTTP SMS gateway. The gateway receives a JSON
+// POST of {"to", "from", "message"} with the token as a Bearer credential.
+type SMSNotifier struct {
+	URL    string
+	Token  string
+	From   string
+	Client *http.Client
+}
+
+// Notify texts the message body to the recipient's phone number
+func (n *SMSNotifier) Notify(msg Message) error {
+	if msg.Phone == "" {
+		return ErrNoAddress
+	}
+	if n.URL == "" {
+		return fmt.Errorf("SMS gateway URL not configured")
+	}
+
+	payload, err := json.Marshal(map[string]string{"to": msg.Phone, "from": n.From, "message": msg.Body})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("SMS gateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+// LogNotifier writes notifications to the log instead of sending them (development only)
+type LogNotifier struct{}
+
+// Notify logs the message
+func (n *LogNotifier) Notify(msg Message) error {
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Notification to %s / %s: %s\n%s", msg.Email, msg.Phone, msg.Subject, msg.Body))
+	return nil
+}
@@ -0,0 +1,290 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"petclinic/config"
+	"petclinic/utils"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Provider is an OpenID Connect identity provider discovered from its issuer URL
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey
+}
+
+// Identity is the verified subset of ID token claims the clinic uses
+type Identity struct {
+	Subject string
+	Email   string
+	Name    string
+	Groups  []string
+	// MFA is true when the IdP reports a second factor in the amr claim
+	MFA bool
+}
+
+// mfaMethods are the RFC 8176 authentication method references that count as a second factor
+var mfaMethods = []string{"mfa", "otp", "hwk", "swk", "sc"}
+
+var (
+	current   *Provider
+	currentMu sync.Mutex
+
+	httpClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Enabled reports whether single sign-on is configured
+func Enabled() bool {
+	return config.OIDCIssuerURL != ""
+}
+
+// GetProvider returns the configured provider, running discovery on first use
+func GetProvider() (*Provider, error) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+
+	if current != nil {
+		return current, nil
+	}
+	if !Enabled() {
+		return nil, fmt.Errorf("single sign-on is not configured")
+	}
+
+	p, err := discover(config.OIDCIssuerURL)
+	if err != nil {
+		return nil, err
+	}
+	current = p
+	utils.LogMessage(config.LogInfo, "OIDC provider discovered: "+p.Issuer)
+	return current, nil
+}
+
+// discover loads the provider metadata from the issuer's well-known endpoint
+func discover(issuer string) (*Provider, error) {
+	resp, err := httpClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery failed: status %d", resp.StatusCode)
+	}
+
+	p := &Provider{}
+	if err := json.NewDecoder(resp.Body).Decode(p); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("OIDC issuer mismatch: expected %s, got %s", issuer, p.Issuer)
+	}
+	return p, nil
+}
+
+// AuthCodeURL builds the authorization request URL with state, nonce and a PKCE S256 challenge
+func (p *Provider) AuthCodeURL(state, nonce, codeChallenge string) string {
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", config.OIDCClientID)
+	params.Set("redirect_uri", config.OIDCRedirectURL)
+	params.Set("scope", strings.Join(config.OIDCScopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", codeChallenge)
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthorizationEndpoint + sep + params.Encode()
+}
+
+// Exchange redeems an authorization code and returns the raw ID token
+func (p *Provider) Exchange(code, codeVerifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", config.OIDCRedirectURL)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(config.OIDCClientID), url.QueryEscape(config.OIDCClientSecret))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token response invalid: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("token request rejected: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// VerifyIDToken checks the ID token's signature, issuer, audience, expiry and nonce
+func (p *Provider) VerifyIDToken(raw, nonce string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, p.keyfunc,
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(config.OIDCClientID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return nil, fmt.Errorf("ID token nonce mismatch")
+	}
+
+	identity := &Identity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	if identity.Subject == "" || identity.Email == "" {
+		return nil, fmt.Errorf("ID token is missing sub or email")
+	}
+
+	// A missing email_verified claim counts as unverified
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		return nil, fmt.Errorf("IdP email address is not verified")
+	}
+
+	if amr, ok := claims["amr"].([]interface{}); ok {
+		for _, method := range amr {
+			if s, ok := method.(string); ok && utils.ContainsString(mfaMethods, s) {
+				identity.MFA = true
+			}
+		}
+	}
+
+	switch groups := claims[config.OIDCGroupsClaim].(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, s)
+			}
+		}
+	case string:
+		identity.Groups = strings.Fields(groups)
+	}
+	return identity, nil
+}
+
+// keyfunc finds the IdP signing key for a token, refreshing the JWKS once if the kid is unknown
+func (p *Provider) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if err := p.refreshKeys(); err != nil {
+		return nil, err
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown IdP signing key %q", kid)
+}
+
+// refreshKeys downloads the provider's JSON Web Key Set
+func (p *Provider) refreshKeys() error {
+	resp, err := httpClient.Get(p.JWKSURI)
+	if err != nil {
+		return fmt.Errorf("JWKS request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("JWKS response invalid: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case k.Kty == "OKP" && k.Crv == "Ed25519":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			keys[k.Kid] = ed25519.PublicKey(x)
+		}
+	}
+	p.keys = keys
+	return nil
+}
+
+// MapRole returns the clinic role granted by the user's IdP groups, or "" if none
+func MapRole(groups []string) string {
+	for _, g := range groups {
+		if role, ok := config.OIDCGroupRoles[g]; ok {
+			return role
+		}
+	}
+	return ""
+}
@@ -0,0 +1,247 @@
+package outbox
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/mailer"
+	"petclinic/utils"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// KindEmail is the message kind for emails; its payload is an Email
+const KindEmail = "email"
+
+// batchSize is how many messages the dispatcher claims at once
+const batchSize = 50
+
+// claimLease is how long a claimed message is hidden from other dispatchers. If the process
+// dies mid-delivery the message becomes due again once the lease runs out.
+const claimLease = 5 * time.Minute
+
+// Message is a row in the outbox
+type Message struct {
+	ID            int64           `json:"id"`
+	Kind          string          `json:"kind"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"` // "pending", "delivered" or "dead"
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	LastError     string          `json:"last_error"`
+	CreatedAt     time.Time       `json:"created_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at"`
+}
+
+// Email is the payload of a KindEmail message
+type Email struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Handler delivers one message of a kind. Returning an error schedules a retry.
+type Handler func(payload json.RawMessage) error
+
+// Execer is satisfied by both *sql.DB and *sql.Tx, so messages can be enqueued
+// in the same transaction as the change they describe
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = map[string]Handler{KindEmail: deliverEmail}
+
+	// scrubbed lists kinds whose payload may hold one-time links. It is redacted once the message
+	// is delivered or dead-lettered and whenever it is shown, and such messages can't be retried.
+	scrubbed = map[string]bool{KindEmail: true}
+)
+
+// Register sets the handler for a message kind
+func Register(kind string, h Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[kind] = h
+}
+
+// Enqueue adds a message to the outbox. Pass the transaction that makes the domain change
+// so the message is stored if and only if the change commits.
+func Enqueue(ex Execer, kind string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec("INSERT INTO outbox (kind, payload) VALUES ($1, $2)", kind, string(data))
+	return err
+}
+
+// Redact returns the message's payload with anything that may hold a one-time link removed:
+// emails keep only their recipient and subject. Other kinds are returned unchanged.
+func Redact(m Message) json.RawMessage {
+	if !scrubbed[m.Kind] {
+		return m.Payload
+	}
+	var email Email
+	if m.Kind == KindEmail && json.Unmarshal(m.Payload, &email) == nil {
+		if data, err := json.Marshal(map[string]string{"to": email.To, "subject": email.Subject}); err == nil {
+			return data
+		}
+	}
+	return json.RawMessage("{}")
+}
+
+// EnqueueEmail adds an email to the outbox
+func EnqueueEmail(ex Execer, to, subject, body string) error {
+	return Enqueue(ex, KindEmail, Email{To: to, Subject: subject, Body: body})
+}
+
+// StartDispatcher delivers outbox messages in the background every config.OutboxPollInterval
+func StartDispatcher() {
+	if config.OutboxPollInterval <= 0 {
+		utils.LogMessage(config.LogInfo, "Outbox dispatcher disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.OutboxPollInterval)
+		defer ticker.Stop()
+		for {
+			// Keep going while there is a backlog
+			for Dispatch() == batchSize {
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Dispatch claims and delivers a batch of due messages, returning how many were claimed.
+// Claiming uses SKIP LOCKED so several instances can dispatch side by side.
+func Dispatch() int {
+	rows, err := database.DB.Query(`
+		UPDATE outbox SET attempts = attempts + 1, next_attempt_at = NOW() + $1 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, kind, payload, attempts
+	`, claimLease.Seconds(), batchSize)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to claim outbox messages: "+err.Error())
+		return 0
+	}
+
+	var claimed []Message
+	for rows.Next() {
+		var m Message
+		var payload []byte
+		if err := rows.Scan(&m.ID, &m.Kind, &payload, &m.Attempts); err != nil {
+			continue
+		}
+		m.Payload = payload
+		claimed = append(claimed, m)
+	}
+	rows.Close()
+
+	// Deliver in the order messages were written
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i].ID < claimed[j].ID })
+	for _, m := range claimed {
+		deliver(m)
+	}
+	return len(claimed)
+}
+
+// deliver runs the message's handler and records the outcome
+func deliver(m Message) {
+	err := runHandler(m)
+	payload := string(Redact(m))
+	if err == nil {
+		if _, err := database.DB.Exec(
+			"UPDATE outbox SET status = 'delivered', delivered_at = NOW(), last_error = '', payload = $1 WHERE id = $2",
+			payload, m.ID,
+		); err != nil {
+			utils.LogMessage(config.LogError, "Failed to mark outbox message delivered: "+err.Error())
+		}
+		return
+	}
+
+	if m.Attempts >= config.OutboxMaxAttempts {
+		utils.LogMessage(config.LogError, fmt.Sprintf("Outbox message dead-lettered: ID=%d, Kind=%s, Attempts=%d: %s", m.ID, m.Kind, m.Attempts, err.Error()))
+		_, err = database.DB.Exec("UPDATE outbox SET status = 'dead', last_error = $1, payload = $2 WHERE id = $3", err.Error(), payload, m.ID)
+	} else {
+		delay := Backoff(m.Attempts)
+		utils.LogMessage(config.LogWarn, fmt.Sprintf("Outbox delivery failed: ID=%d, Kind=%s, Attempt=%d, Retry in %s: %s", m.ID, m.Kind, m.Attempts, delay, err.Error()))
+		_, err = database.DB.Exec(
+			"UPDATE outbox SET last_error = $1, next_attempt_at = NOW() + $2 * INTERVAL '1 second' WHERE id = $3",
+			err.Error(), delay.Seconds(), m.ID,
+		)
+	}
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to record outbox failure: "+err.Error())
+	}
+}
+
+// runHandler calls the handler for the message's kind, turning a panic into an error
+func runHandler(m Message) (err error) {
+	handlersMu.RLock()
+	h, ok := handlers[m.Kind]
+	handlersMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no handler registered for kind %q", m.Kind)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("handler panicked: %v", p)
+		}
+	}()
+	return h(m.Payload)
+}
+
+// Backoff returns the delay before retrying after the given number of attempts:
+// config.OutboxRetryBase doubled for each earlier attempt, capped at config.OutboxRetryMax
+func Backoff(attempts int) time.Duration {
+	delay := config.OutboxRetryBase
+	for i := 1; i < attempts && delay < config.OutboxRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > config.OutboxRetryMax {
+		delay = config.OutboxRetryMax
+	}
+	return delay
+}
+
+// Retry makes a dead-lettered message pending again with a fresh set of attempts.
+// It reports false if there is no dead message with that ID, or if its payload was redacted.
+func Retry(ex Execer, id int64) (bool, error) {
+	var kinds []string
+	for kind := range scrubbed {
+		kinds = append(kinds, kind)
+	}
+	result, err := ex.Exec(
+		"UPDATE outbox SET status = 'pending', attempts = 0, next_attempt_at = NOW() WHERE id = $1 AND status = 'dead' AND kind <> ALL($2)",
+		id, pq.Array(kinds),
+	)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+// deliverEmail sends a KindEmail message through the configured mailer
+func deliverEmail(payload json.RawMessage) error {
+	var email Email
+	if err := json.Unmarshal(payload, &email); err != nil {
+		return err
+	}
+	return mailer.Send(email.To, email.Subject, email.Body)
+}
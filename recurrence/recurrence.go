@@ -0,0 +1,153 @@
+package recurrence
+
+import (
+	"fmt"
+	"petclinic/config"
+	"petclinic/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxOccurrences caps how many occurrences one rule may generate
+const MaxOccurrences = 100
+
+// maxSteps bounds the search for occurrences when monthly rules skip short months
+const maxSteps = 12 * MaxOccurrences
+
+// Frequencies supported in FREQ
+var Frequencies = []string{"DAILY", "WEEKLY", "MONTHLY"}
+
+// Rule is the supported subset of an RFC 5545 RRULE: FREQ (DAILY, WEEKLY or MONTHLY), INTERVAL,
+// and COUNT or UNTIL. One of COUNT and UNTIL is required so a series always ends.
+type Rule struct {
+	Freq     string
+	Interval int
+	Count    int
+	Until    time.Time
+}
+
+// Parse reads a rule such as "FREQ=WEEKLY;INTERVAL=2;COUNT=6". A leading "RRULE:" is allowed.
+func Parse(s string) (Rule, error) {
+	rule := Rule{Interval: 1}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return rule, fmt.Errorf("rule is empty")
+	}
+
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return rule, fmt.Errorf("invalid rule part %q", part)
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToUpper(strings.TrimSpace(key)) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(value)
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return rule, fmt.Errorf("INTERVAL must be a positive number")
+			}
+			rule.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return rule, fmt.Errorf("COUNT must be a positive number")
+			}
+			rule.Count = n
+		case "UNTIL":
+			until, err := parseUntil(value)
+			if err != nil {
+				return rule, err
+			}
+			rule.Until = until
+		default:
+			return rule, fmt.Errorf("unsupported rule part %s (supported: FREQ, INTERVAL, COUNT, UNTIL)", key)
+		}
+	}
+
+	if !utils.ContainsString(Frequencies, rule.Freq) {
+		return rule, fmt.Errorf("FREQ must be one of %s", strings.Join(Frequencies, ", "))
+	}
+	if rule.Count == 0 && rule.Until.IsZero() {
+		return rule, fmt.Errorf("COUNT or UNTIL is required")
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return rule, fmt.Errorf("COUNT and UNTIL can't both be set")
+	}
+	if rule.Count > MaxOccurrences {
+		return rule, fmt.Errorf("COUNT can be at most %d", MaxOccurrences)
+	}
+	return rule, nil
+}
+
+// String formats the rule as an RRULE value
+func (r Rule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Occurrences returns every start time the rule generates from start, which is the first.
+// Monthly occurrences keep start's day of the month and skip months without it (as RFC 5545 does).
+// It fails if an UNTIL rule would generate more than MaxOccurrences.
+func (r Rule) Occurrences(start time.Time) ([]time.Time, error) {
+	var times []time.Time
+	for i := 0; ; i++ {
+		var t time.Time
+		switch r.Freq {
+		case "DAILY":
+			t = start.AddDate(0, 0, i*r.Interval)
+		case "WEEKLY":
+			t = start.AddDate(0, 0, 7*i*r.Interval)
+		case "MONTHLY":
+			t = start.AddDate(0, i*r.Interval, 0)
+		}
+
+		// Occurrence times are clinic wall-clock times, whatever zone they carry; UNTIL is an instant
+		if !r.Until.IsZero() && config.ClinicTime(t).After(r.Until) {
+			break
+		}
+		if i > maxSteps {
+			return nil, fmt.Errorf("rule generates too few occurrences to reach its COUNT")
+		}
+		// AddDate overflows into the next month when the day doesn't exist (e.g. 31 April); skip those
+		if r.Freq == "MONTHLY" && t.Day() != start.Day() {
+			continue
+		}
+
+		times = append(times, t)
+		if r.Count > 0 && len(times) == r.Count {
+			break
+		}
+		if len(times) > MaxOccurrences {
+			return nil, fmt.Errorf("rule generates more than %d occurrences", MaxOccurrences)
+		}
+	}
+	return times, nil
+}
+
+// parseUntil accepts the RFC 5545 forms 20261231 and 20261231T170000Z as well as RFC 3339.
+// A date alone includes that whole day on the clinic's wall clock.
+func parseUntil(value string) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("20060102", value, config.ClinicLocation); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Second), nil
+	}
+	return time.Time{}, fmt.Errorf("UNTIL must look like 20261231 or 20261231T170000Z")
+}
@@ -0,0 +1,163 @@
+package recurrence
+
+import (
+	"petclinic/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clinicZone is the clinic time zone used by these tests
+const clinicZone = "America/New_York"
+
+func setClinicLocation(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(clinicZone)
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+	prev := config.ClinicLocation
+	config.ClinicLocation = loc
+	t.Cleanup(func() { config.ClinicLocation = prev })
+	return loc
+}
+
+// wallClock builds an occurrence start the way handlers receive it: clinic wall-clock fields
+// in whatever zone the client sent (UTC here)
+func wallClock(year int, month time.Month, day, hour int) time.Time {
+	return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+}
+
+func formatAll(times []time.Time) string {
+	s := make([]string, len(times))
+	for i, t := range times {
+		s[i] = t.Format("2006-01-02 15:04")
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestOccurrencesCount(t *testing.T) {
+	setClinicLocation(t)
+
+	tests := []struct {
+		rule string
+		want string
+	}{
+		{"FREQ=DAILY;COUNT=3", "2026-03-01 10:00, 2026-03-02 10:00, 2026-03-03 10:00"},
+		{"FREQ=WEEKLY;INTERVAL=2;COUNT=3", "2026-03-01 10:00, 2026-03-15 10:00, 2026-03-29 10:00"},
+		{"RRULE:FREQ=MONTHLY;COUNT=2", "2026-03-01 10:00, 2026-04-01 10:00"},
+	}
+
+	for _, tt := range tests {
+		rule, err := Parse(tt.rule)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.rule, err)
+		}
+		times, err := rule.Occurrences(wallClock(2026, time.March, 1, 10))
+		if err != nil {
+			t.Fatalf("%s: Occurrences: %v", tt.rule, err)
+		}
+		if got := formatAll(times); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestOccurrencesMonthlySkipsShortMonths(t *testing.T) {
+	setClinicLocation(t)
+
+	rule, err := Parse("FREQ=MONTHLY;COUNT=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	times, err := rule.Occurrences(wallClock(2026, time.January, 31, 9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2026-01-31 09:00, 2026-03-31 09:00, 2026-05-31 09:00, 2026-07-31 09:00"
+	if got := formatAll(times); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestOccurrencesUntilDateIsClinicDay(t *testing.T) {
+	loc := setClinicLocation(t)
+
+	// 23:00 on the 5th is still the 5th at the clinic, though already the 6th in UTC
+	rule, err := Parse("FREQ=DAILY;UNTIL=20260305")
+	if err != nil {
+		t.Fatal(err)
+	}
+	times, err := rule.Occurrences(time.Date(2026, time.March, 3, 23, 0, 0, 0, loc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2026-03-03 23:00, 2026-03-04 23:00, 2026-03-05 23:00"
+	if got := formatAll(times); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestOccurrencesUntilUTC(t *testing.T) {
+	setClinicLocation(t)
+
+	// 15:00 UTC on the 4th is 10:00 at the clinic (EST), so the 10:00 occurrence that day is included
+	rule, err := Parse("FREQ=DAILY;UNTIL=20260304T150000Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	times, err := rule.Occurrences(wallClock(2026, time.March, 3, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := formatAll(times), "2026-03-03 10:00, 2026-03-04 10:00"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestOccurrencesUntilCap(t *testing.T) {
+	setClinicLocation(t)
+
+	rule, err := Parse("FREQ=DAILY;UNTIL=20300101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rule.Occurrences(wallClock(2026, time.March, 1, 10)); err == nil {
+		t.Errorf("expected an error for a rule generating more than %d occurrences", MaxOccurrences)
+	}
+
+	// Exactly MaxOccurrences is allowed
+	start := wallClock(2026, time.March, 1, 10)
+	last := start.AddDate(0, 0, MaxOccurrences-1)
+	rule, err = Parse("FREQ=DAILY;UNTIL=" + last.Format("20060102"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	times, err := rule.Occurrences(start)
+	if err != nil {
+		t.Fatalf("Occurrences: %v", err)
+	}
+	if len(times) != MaxOccurrences {
+		t.Errorf("got %d occurrences, want %d", len(times), MaxOccurrences)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	setClinicLocation(t)
+
+	for _, s := range []string{
+		"",
+		"FREQ=YEARLY;COUNT=2",
+		"FREQ=DAILY",
+		"FREQ=DAILY;COUNT=2;UNTIL=20261231",
+		"FREQ=DAILY;COUNT=0",
+		"FREQ=DAILY;INTERVAL=0;COUNT=2",
+		"FREQ=DAILY;COUNT=101",
+		"FREQ=DAILY;BYDAY=MO;COUNT=2",
+		"FREQ=DAILY;UNTIL=31-12-2026",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", s)
+		}
+	}
+}
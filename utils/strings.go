@@ -0,0 +1,11 @@
+package utils
+
+// ContainsString reports whether list contains s
+func ContainsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
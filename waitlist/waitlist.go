@@ -0,0 +1,177 @@
+package waitlist
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/outbox"
+	"petclinic/utils"
+	"time"
+)
+
+// ErrSlotClaimed is returned by ReclaimSlot when a waitlist entry has already booked the slot
+var ErrSlotClaimed = errors.New("the slot has been claimed from the waitlist")
+
+// StartOfferJob periodically passes expired offers on to the next entry in line
+func StartOfferJob() {
+	if config.WaitlistInterval <= 0 {
+		utils.LogMessage(config.LogInfo, "Waitlist offer job disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.WaitlistInterval)
+		defer ticker.Stop()
+		for {
+			ExpireOffers()
+			<-ticker.C
+		}
+	}()
+}
+
+// OfferSlot offers a cancelled appointment's slot to the oldest waiting entry whose date range
+// includes it, that hasn't been offered it before and that asked for no vet or the slot's vet.
+// Entries already holding an offer wait their turn. It does nothing if the slot has passed, is already offered or claimed, or nobody
+// wants it. Pass the transaction that frees the slot so the offer email is sent only if it commits.
+func OfferSlot(tx *sql.Tx, slotAppointmentID int) error {
+	var entryID int
+	var slotDate time.Time
+	var petName, email string
+	err := tx.QueryRow(`
+		SELECT e.id, a.date, p.name, o.email
+		FROM appointments a
+		JOIN waitlist_entries e ON e.status = 'waiting' AND a.date BETWEEN e.earliest AND e.latest AND e.pet_id <> a.pet_id
+			AND (e.preferred_vet = '' OR LOWER(e.preferred_vet) = LOWER(a.vet))
+		JOIN pets p ON e.pet_id = p.id AND p.deleted_at IS NULL AND NOT p.deceased
+		JOIN owners o ON e.owner_id = o.id
+		WHERE a.id = $1 AND a.date > `+database.ClinicNow()+` AND (a.status = 'cancelled' OR a.deleted_at IS NOT NULL)
+		AND NOT EXISTS (
+			SELECT 1 FROM waitlist_offers wo
+			WHERE wo.slot_appointment_id = a.id AND (wo.entry_id = e.id OR wo.status IN ('pending', 'claimed'))
+		)
+		AND NOT EXISTS (SELECT 1 FROM waitlist_offers wo WHERE wo.entry_id = e.id AND wo.status = 'pending')
+		ORDER BY e.created_at, e.id
+		LIMIT 1
+		FOR UPDATE OF e SKIP LOCKED
+	`, slotAppointmentID).Scan(&entryID, &slotDate, &petName, &email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := utils.GenerateToken(32)
+	if err != nil {
+		return err
+	}
+
+	var offerID int
+	err = tx.QueryRow(`
+		INSERT INTO waitlist_offers (entry_id, slot_appointment_id, slot_date, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, NOW() + $5 * INTERVAL '1 second')
+		ON CONFLICT DO NOTHING
+		RETURNING id
+	`, entryID, slotAppointmentID, slotDate, utils.HashToken(token), config.WaitlistOfferTTL.Seconds()).Scan(&offerID)
+	if err == sql.ErrNoRows {
+		// Another transaction offered the slot first
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	link := config.AppBaseURL + "/waitlist/claim?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Good news: a slot has opened up for %s at %s on %s.\n\n"+
+		"Sign in and open the link below to book it. The offer expires in %s, after which it goes to the next person on the waitlist.\n\n%s\n\n"+
+		"If you don't want it, you can decline from the same page and keep your place on the waitlist.",
+		petName, config.ClinicName, slotDate.Format("Monday 2 January at 15:04"), config.WaitlistOfferTTL, link)
+	if err := outbox.EnqueueEmail(tx, email, "A slot has opened up for "+petName, body); err != nil {
+		return err
+	}
+
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Waitlist slot offered: Offer=%d, Entry=%d, Slot=%d", offerID, entryID, slotAppointmentID))
+	return nil
+}
+
+// ReclaimSlot withdraws the pending offer for a cancelled appointment's slot so the appointment
+// can be booked again, returning ErrSlotClaimed if the slot has already gone to a waitlist entry.
+// Call it before reinstating the appointment, in the same transaction.
+func ReclaimSlot(tx *sql.Tx, slotAppointmentID int) error {
+	// Locking the offer makes a concurrent claim either finish first or find the offer withdrawn
+	var offerID int
+	var status string
+	err := tx.QueryRow(`
+		SELECT id, status FROM waitlist_offers
+		WHERE slot_appointment_id = $1 AND status IN ('pending', 'claimed')
+		FOR UPDATE
+	`, slotAppointmentID).Scan(&offerID, &status)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if status == "claimed" {
+		return ErrSlotClaimed
+	}
+
+	if _, err := tx.Exec("UPDATE waitlist_offers SET status = 'withdrawn', responded_at = NOW() WHERE id = $1", offerID); err != nil {
+		return err
+	}
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Waitlist offer withdrawn: Offer=%d, Slot=%d", offerID, slotAppointmentID))
+	return nil
+}
+
+// ExpireOffers marks lapsed offers as expired and offers each of their slots to the next entry.
+// Entries whose date range has passed are expired too.
+func ExpireOffers() {
+	if _, err := database.DB.Exec("UPDATE waitlist_entries SET status = 'expired' WHERE status = 'waiting' AND latest < " + database.ClinicNow()); err != nil {
+		utils.LogMessage(config.LogError, "Failed to expire waitlist entries: "+err.Error())
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to begin transaction: "+err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE waitlist_offers SET status = 'expired'
+		WHERE status = 'pending' AND expires_at <= NOW()
+		RETURNING slot_appointment_id
+	`)
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to expire waitlist offers: "+err.Error())
+		return
+	}
+	var slots []int
+	for rows.Next() {
+		var slotID int
+		if err := rows.Scan(&slotID); err != nil {
+			continue
+		}
+		slots = append(slots, slotID)
+	}
+	rows.Close()
+	if len(slots) == 0 {
+		return
+	}
+
+	for _, slotID := range slots {
+		if err := OfferSlot(tx, slotID); err != nil {
+			utils.LogMessage(config.LogError, fmt.Sprintf("Failed to offer slot %d: %s", slotID, err.Error()))
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.LogMessage(config.LogError, "Failed to commit waitlist offers: "+err.Error())
+		return
+	}
+	utils.LogMessage(config.LogInfo, fmt.Sprintf("Waitlist offers expired: %d", len(slots)))
+}
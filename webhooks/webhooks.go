@@ -0,0 +1,236 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"petclinic/config"
+	"petclinic/database"
+	"petclinic/events"
+	"petclinic/outbox"
+	"petclinic/utils"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// KindDelivery is the outbox message kind for sending one webhook delivery
+const KindDelivery = "webhook.delivery"
+
+// SignatureHeader carries "t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>" with the subscription secret>"
+const SignatureHeader = "X-PetClinic-Signature"
+
+// maxErrorBody is how much of a failed response body is kept in the delivery log
+const maxErrorBody = 500
+
+// client sends deliveries. Redirects are not followed so a subscription can't be bounced elsewhere,
+// proxies are bypassed, and every address dialed is checked by dialControl.
+var client = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: dialControl}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// ErrInternalAddress means a webhook URL points at an address deliveries may not reach
+var ErrInternalAddress = errors.New("webhook URL resolves to an internal address")
+
+// internalNets are ranges not covered by the net.IP predicates in PublicIP
+var internalNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),     // "this" network
+	mustParseCIDR("100.64.0.0/10"), // carrier-grade NAT
+	mustParseCIDR("198.18.0.0/15"), // benchmarking
+}
+
+// dialControl runs after DNS resolution, for the address actually being connected to, so a host
+// that resolves (or re-resolves) to an internal address is refused
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !PublicIP(ip) {
+		return ErrInternalAddress
+	}
+	return nil
+}
+
+// PublicIP reports whether deliveries may be sent to ip. Loopback, private, link-local,
+// multicast and unspecified addresses are refused, except in development.
+func PublicIP(ip net.IP) bool {
+	if config.IsDevelopment() {
+		return true
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range internalNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// mustParseCIDR parses a constant CIDR range
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// deliveryMessage is the outbox payload of a KindDelivery message
+type deliveryMessage struct {
+	DeliveryID int `json:"delivery_id"`
+}
+
+// Init subscribes webhooks to published events and registers the delivery handler with the outbox
+func Init() {
+	events.Subscribe(fanOut)
+	outbox.Register(KindDelivery, deliver)
+}
+
+// Sign returns the signature header value for body sent at the given time
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// EnqueueDelivery schedules a delivery to be sent by the outbox dispatcher
+func EnqueueDelivery(ex outbox.Execer, deliveryID int) error {
+	return outbox.Enqueue(ex, KindDelivery, deliveryMessage{DeliveryID: deliveryID})
+}
+
+// fanOut creates a delivery for each active subscription to the event's type. Running it
+// again for the same event adds nothing, so outbox retries are harmless.
+func fanOut(evt events.Event) error {
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, payload)
+		SELECT id, $1::text, $2::text, $3::jsonb FROM webhook_subscriptions WHERE active AND $2::text = ANY(event_types)
+		ON CONFLICT (subscription_id, event_id) WHERE replay_of IS NULL DO NOTHING
+		RETURNING id
+	`, evt.ID, evt.Type, string(payload))
+	if err != nil {
+		return err
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := EnqueueDelivery(tx, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// deliver POSTs a delivery's payload to its subscription and logs the outcome on the delivery.
+// A failed attempt returns an error so the outbox retries it with backoff.
+func deliver(payload json.RawMessage) error {
+	var msg deliveryMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+
+	var url, secret, eventType, eventID string
+	var active bool
+	var body []byte
+	err := database.DB.QueryRow(`
+		SELECT s.url, s.secret, s.active, d.event_type, d.event_id, d.payload
+		FROM webhook_deliveries d JOIN webhook_subscriptions s ON d.subscription_id = s.id
+		WHERE d.id = $1
+	`, msg.DeliveryID).Scan(&url, &secret, &active, &eventType, &eventID, &body)
+	if err != nil {
+		// The subscription (and its deliveries) was deleted
+		return nil
+	}
+	if !active {
+		_, err := database.DB.Exec("UPDATE webhook_deliveries SET status = 'skipped' WHERE id = $1", msg.DeliveryID)
+		return err
+	}
+
+	statusCode, sendErr := send(url, secret, eventType, eventID, msg.DeliveryID, body)
+
+	var responseStatus interface{}
+	if statusCode != 0 {
+		responseStatus = statusCode
+	}
+	if sendErr == nil {
+		_, err = database.DB.Exec(`
+			UPDATE webhook_deliveries SET status = 'delivered', attempts = attempts + 1, response_status = $1, last_error = '', delivered_at = NOW()
+			WHERE id = $2
+		`, responseStatus, msg.DeliveryID)
+	} else {
+		_, err = database.DB.Exec(`
+			UPDATE webhook_deliveries SET status = 'failed', attempts = attempts + 1, response_status = $1, last_error = $2
+			WHERE id = $3
+		`, responseStatus, sendErr.Error(), msg.DeliveryID)
+	}
+	if err != nil {
+		utils.LogMessage(config.LogError, "Failed to record webhook delivery: "+err.Error())
+	}
+	return sendErr
+}
+
+// send makes one delivery attempt, returning the response status code if there was a response
+func send(url, secret, eventType, eventID string, deliveryID int, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PetClinic-Webhooks/1.0")
+	req.Header.Set("X-PetClinic-Event", eventType)
+	req.Header.Set("X-PetClinic-Event-ID", eventID)
+	req.Header.Set("X-PetClinic-Delivery", strconv.Itoa(deliveryID))
+	req.Header.Set(SignatureHeader, Sign(secret, time.Now().Unix(), body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return resp.StatusCode, fmt.Errorf("endpoint returned %s: %s", resp.Status, snippet)
+	}
+	return resp.StatusCode, nil
+}